@@ -28,6 +28,7 @@ package gorest
 import (
 //	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"github.com/rmullinnix461332/logger"
 	"runtime"
@@ -50,13 +51,18 @@ func TestInit(t *testing.T) {
 	RegisterServiceOnPath(MUX_ROOT, new(PathsService))
 	RegisterServiceOnPath(MUX_ROOT, new(StressService))
 
-	http.Handle(MUX_ROOT, handle())
+	http.Handle(MUX_ROOT, Handle())
 
 	//http.HandleFunc(MUX_ROOT, HandleFunc)
 	//httptest.NewServer(Handle())
 	//server.Start()
 
-	go http.ListenAndServe(":8787", nil)
+	// listen before the tests start sending requests
+	listener, err := net.Listen("tcp", ":8787")
+	if err != nil {
+		t.Fatal("Could not listen on :8787", err)
+	}
+	go http.Serve(listener, nil)
 	//go ServeStandAlone(8787)
 
 }
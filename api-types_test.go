@@ -255,6 +255,7 @@ func postInteger(t *testing.T) {
 
 	rb2, _ := NewRequestBuilder(RootPath + "types-service/int/true/5" + xrefStr2)
 	rb2.AddCookie(cook2)
+	rb2.Request().Header.Set("Authorization", "fox")
 	res, _ = rb2.Post(6)
 	AssertEqual(res.StatusCode, 200, "Post Integer correct user", t)
 }
@@ -26,13 +26,14 @@
 package gorest
 
 import (
-	"compress/gzip"
 	"github.com/rmullinnix461332/logger"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -101,20 +102,13 @@ func (sess SessionData) Get(key string) (interface{}, bool) {
 	return value, found
 }
 
-//Get the value of the item referenced by key as a string from the Session Data
-func (sess SessionData) GetString(key string) (string, bool) {
-	svalue := ""
-	ivalue, found := sess.relSessionData[key]
-	if found {
-		svalue = ivalue.(string)
-	}
-
-	return svalue, found
-}
-
 // Set the value of the item referenced by key in the Session Data
+// With a session store the value is kept for the client's later requests, the session starting on the first Set
 func (sess SessionData) Set(key string, value interface{}) {
 	sess.relSessionData[key] = value
+	if sess.state != nil && sess.state.id == "" && !requestScopedKeys[key] {
+		sess.state.start()
+	}
 }
 
 //Returns a *http.Request associated with this Context
@@ -122,6 +116,11 @@ func (serv RestService) Request() *http.Request {
 	return serv.RB().ctx.request
 }
 
+//Returns the Principal authenticated for this request, nil when the endpoint has no security scheme
+func (serv RestService) Principal() *Principal {
+	return serv.RB().ctx.principal
+}
+
 //Facilitates the construction of the response to be sent to the client.
 type ResponseBuilder struct {
 	ctx *Context
@@ -134,6 +133,49 @@ func (this *ResponseBuilder) SessionToken() string {
 	return this.ctx.xsrftoken
 }
 
+//Returns the Principal authenticated for this request
+func (this *ResponseBuilder) Principal() *Principal {
+	return this.ctx.principal
+}
+
+//Sets the Principal for this request, for use by an Authorizer that returns a bool
+func (this *ResponseBuilder) SetPrincipal(p *Principal) {
+	this.ctx.principal = p
+}
+
+var clientIPMu sync.RWMutex
+var clientIPHeader string
+
+//Names the header a proxy in front of the services puts the caller's address in, e.g. X-Forwarded-For.
+//Its last address is taken as the client, so only set it when such a proxy always sets the header.
+func SetClientIPHeader(header string) {
+	clientIPMu.Lock()
+	clientIPHeader = header
+	clientIPMu.Unlock()
+}
+
+//The address of the caller, from the header named by SetClientIPHeader when there is one
+func (this *ResponseBuilder) ClientIP() string {
+	clientIPMu.RLock()
+	header := clientIPHeader
+	clientIPMu.RUnlock()
+	return clientIP(this.ctx.request, header)
+}
+
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if forwarded := r.Header.Get(header); forwarded != "" {
+			addrs := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addrs[len(addrs) - 1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 //Sets the "xsrftoken" token associated with the current request and hence session, only valid for the sepcified root path and period.
 //This creates a cookie and sets an http header with the name "X-Xsrf-Cookie"
 func (this *ResponseBuilder) SetSessionToken(token string, path string, expires time.Time) {
@@ -179,12 +221,22 @@ func (this *ResponseBuilder) Overide(overide bool) {
 
 type SessionData struct {
 	relSessionData		map[string]interface{}
+	values			map[interface{}]interface{}	// request scoped values of typed keys
+	state			*sessionState	// nil unless SetSessionStore made sessions persistent
+	ctx			*Context
 }
 
 type Context struct {
 	writer         http.ResponseWriter
 	request        *http.Request
 	xsrftoken      string
+	csrfToken      string
+	requestID      string
+	queueWait      time.Duration // waited for a concurrency slot
+	etag           string // the endpoint's etag tag, strong or weak
+	shed           bool
+	credentials    map[string]string
+	principal      *Principal
 	sessData       SessionData
 	sessStart	time.Time
 
@@ -227,20 +279,30 @@ func (this *ResponseBuilder) WritePacket() *ResponseBuilder {
 			this.writer().Header().Set("Content-Type", this.ctx.responseMimeType)
 		}
 
-		if value, found := this.Session().Get("Origin"); found {
-			this.writer().Header().Set("Access-Control-Allow-Headers", "Origin")
-			this.writer().Header().Set("Access-Control-Allow-Origin", value.(string))
+		if this.notModified() {
+			if this.ctx.respPacket != nil {
+				this.ctx.respPacket.Close()
+			}
+			this.writer().Header().Del("Content-Type")
+			if this.ctx.encodeGzip {
+				this.AddHeader("Vary", "Accept-Encoding")
+			}
+			this.writer().WriteHeader(http.StatusNotModified)
+			this.ctx.responseCode = http.StatusNotModified
+			this.ctx.dataHasBeenWritten = true
+			return this
+		}
+
+		if this.ctx.respPacket != nil {
+			// streaming marshallers stop encoding once the packet is closed
+			defer this.ctx.respPacket.Close()
 		}
 
 		if this.ctx.respPacket == nil {
 			this.writer().WriteHeader(this.ctx.responseCode)
 			this.writer().Write([]byte(this.ctx.responseMsg))
-		} else if this.ctx.encodeGzip && strings.Contains(this.ctx.request.Header.Get("Accept-Encoding"), "gzip") {
-			this.writer().Header().Set("Content-Encoding", "gzip")
-			this.writer().WriteHeader(this.ctx.responseCode)
-			gzipWriter := gzip.NewWriter(this.writer())
-			defer gzipWriter.Close()
-			io.Copy(gzipWriter, this.ctx.respPacket)
+		} else if this.ctx.encodeGzip {
+			this.writeCompressed()
 		} else {
 			this.writer().WriteHeader(this.ctx.responseCode)
 			io.Copy(this.writer(), this.ctx.respPacket)
@@ -257,11 +319,6 @@ func (this *ResponseBuilder) Write(data []byte) *ResponseBuilder {
 		this.SetResponseCode(getDefaultResponseCode(this.ctx.request.Method))
 	}
 	if !this.ctx.dataHasBeenWritten {
-		if value, found := this.Session().Get("Origin"); found {
-			this.writer().Header().Set("Access-Control-Allow-Headers", "Origin")
-			this.writer().Header().Set("Access-Control-Allow-Origin", value.(string))
-		}
-
 		//TODO: Check for content type set.......
 		this.writer().WriteHeader(this.ctx.responseCode)
 	}
@@ -301,6 +358,17 @@ func (this *ResponseBuilder) DelHeader(key string) *ResponseBuilder {
 	return this
 }
 
+// the caller for logging, the principal's subject or the UserUUID left in the session
+func (this *ResponseBuilder) subject() string {
+	if this.ctx.principal != nil && this.ctx.principal.Subject != "" {
+		return this.ctx.principal.Subject
+	}
+	if useruuid, found := this.Session().GetString(SessionUserUUID); found {
+		return useruuid
+	}
+	return "public"
+}
+
 func (this *ResponseBuilder) PerfLog() {
 	r := this.ctx.request
 
@@ -308,22 +376,23 @@ func (this *ResponseBuilder) PerfLog() {
 	elapsed := time.Since(this.ctx.sessStart)
 	host, _ := os.Hostname()
 
-	useruuid, found := this.Session().GetString("UserUUID")
-	if !found {
-		useruuid = "public"
-	}
+	useruuid := this.subject()
 
+	if this.ctx.queueWait > 0 || this.ctx.shed {
+		logger.Info.Println("[perf] host: " + host + " remote: " + r.RemoteAddr + " useruuid: " + useruuid + " url: " + url_ + " method: " + r.Method + " dur:", int64(elapsed/time.Millisecond), "ms", " response: ", this.ctx.responseCode, " queued:", int64(this.ctx.queueWait/time.Millisecond), "ms shed:", this.ctx.shed)
+		return
+	}
 	logger.Info.Println("[perf] host: " + host + " remote: " + r.RemoteAddr + " useruuid: " + useruuid + " url: " + url_ + " method: " + r.Method + " dur:", int64(elapsed/time.Millisecond), "ms", " response: ", this.ctx.responseCode)
 }
 
 func (this *ResponseBuilder) TraceLog() {
 	span := this.ctx.span
 
-	useruuid, found := this.Session().GetString("UserUUID")
-	if !found {
-		useruuid = "public"
-	}
+	useruuid := this.subject()
 
 	span.SetAttributes(attribute.Int("status.code", this.ctx.responseCode))
 	span.SetAttributes(attribute.String("useruuid", useruuid))
+	if this.ctx.queueWait > 0 || this.ctx.shed {
+		span.SetAttributes(attribute.Int64("queue.wait_ms", int64(this.ctx.queueWait/time.Millisecond)), attribute.Bool("shed", this.ctx.shed))
+	}
 }
@@ -0,0 +1,223 @@
+package authorizers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/rmullinnix461332/gorest"
+	"github.com/rmullinnix461332/logger"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A stored api key, the key itself is only held as a hash. Keys are "<prefix>.<secret>".
+type APIKey struct {
+	Prefix		string		`json:"prefix"`
+	Hash		string		`json:"hash"`	// HashAPIKey of the whole key
+	Owner		string		`json:"owner"`
+	Scopes		[]string	`json:"scopes"`
+	Expires		time.Time	`json:"expires,omitempty"`	// zero never expires
+	Enabled		bool		`json:"enabled"`
+	LastUsed	time.Time	`json:"lastUsed,omitempty"`
+}
+
+//Source of api keys, by prefix
+type APIKeyStore interface {
+	LookupKey(prefix string) (APIKey, bool)
+}
+
+//Configuration of an api key authorizer
+type APIKeyOptions struct {
+	Scheme		string
+	Store		APIKeyStore
+	Used		func(prefix string, at time.Time)	// called after each accepted request, e.g. MemoryAPIKeys.Touch
+}
+
+//Authorizer for api keys sent in the header or query parameter of the api_key security definition
+type APIKeys struct {
+	opts		APIKeyOptions
+}
+
+//Creates an api key authorizer bound to opts.Scheme
+func NewAPIKeys(opts APIKeyOptions) *APIKeys {
+	if opts.Store == nil {
+		logger.Error.Panicln("[sec] api key authorizer needs a key store")
+	}
+	return &APIKeys{opts: opts}
+}
+
+//Registers the authorizer for its scheme
+func (a *APIKeys) Register() {
+	gorest.RegisterPrincipalAuthorizer(a.opts.Scheme, a.Authorize)
+}
+
+//A gorest.PrincipalAuthorizer for the scheme, the principal is the key's owner with the key's scopes
+func (a *APIKeys) Authorize(token string, scheme string, scopes []string, method string, rb *gorest.ResponseBuilder) gorest.AuthResult {
+	if a.opts.Scheme != "" && scheme != a.opts.Scheme {
+		return gorest.Unauthenticated("api key authorizer for " + a.opts.Scheme + " called for scheme " + scheme)
+	}
+	if token == "" {
+		return gorest.Unauthenticated("no api key")
+	}
+
+	prefix, ok := apiKeyPrefix(token)
+	if !ok {
+		// without a prefix the whole key is secret, it is neither looked up nor logged
+		logger.Error.Println("[sec] api_key auth: false response: 401 reason: malformed key")
+		return gorest.Unauthenticated("malformed api key")
+	}
+	key, found := a.opts.Store.LookupKey(prefix)
+	if !found || !key.matches(token) {
+		logger.Error.Println("[sec] api_key prefix: " + prefix + " auth: false response: 401 reason: unknown key")
+		return gorest.Unauthenticated("unknown api key " + prefix)
+	}
+	if !key.Enabled {
+		logger.Error.Println("[sec] api_key prefix: " + prefix + " owner: " + key.Owner + " auth: false response: 401 reason: key disabled")
+		return gorest.Unauthenticated("api key " + prefix + " is disabled")
+	}
+	if !key.Expires.IsZero() && time.Now().After(key.Expires) {
+		logger.Error.Println("[sec] api_key prefix: " + prefix + " owner: " + key.Owner + " auth: false response: 401 reason: key expired")
+		return gorest.Unauthenticated("api key " + prefix + " expired")
+	}
+
+	principal := &gorest.Principal{
+		Subject:	key.Owner,
+		Scopes:		key.Scopes,
+		Claims:		map[string]interface{}{"key_prefix": prefix},
+	}
+
+	if len(scopes) > 0 && !scopesAuthorized(scopes, key.Scopes, rb) {
+		logger.Error.Println("[sec] api_key prefix: " + prefix + " owner: " + key.Owner + " auth: false response: 403 reason: key not authorized for scope " + strings.Join(scopes, ", "))
+		return gorest.Forbidden(principal, "api key " + prefix + " not authorized for scope " + strings.Join(scopes, ", "))
+	}
+
+	if a.opts.Used != nil {
+		a.opts.Used(prefix, time.Now())
+	}
+	return gorest.Authenticated(principal)
+}
+
+func (key APIKey) matches(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(key.Hash), []byte(HashAPIKey(token))) == 1
+}
+
+//The stored form of an api key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// the part of a "<prefix>.<secret>" key that is not secret
+func apiKeyPrefix(key string) (string, bool) {
+	dot := strings.Index(key, ".")
+	if dot < 1 || dot == len(key) - 1 {
+		return "", false
+	}
+	return key[:dot], true
+}
+
+//Creates a random key for the owner, the returned key is shown once and only its hash is stored
+func GenerateAPIKey(owner string, scopes []string, expires time.Time) (string, APIKey) {
+	prefix := make([]byte, 6)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(prefix); err != nil {
+		logger.Error.Panicln("[sec] api key: no randomness: " + err.Error())
+	}
+	if _, err := rand.Read(secret); err != nil {
+		logger.Error.Panicln("[sec] api key: no randomness: " + err.Error())
+	}
+
+	key := hex.EncodeToString(prefix) + "." + base64.RawURLEncoding.EncodeToString(secret)
+	return key, APIKey{
+		Prefix:		hex.EncodeToString(prefix),
+		Hash:		HashAPIKey(key),
+		Owner:		owner,
+		Scopes:		scopes,
+		Expires:	expires,
+		Enabled:	true,
+	}
+}
+
+//APIKeyStore kept in memory
+type MemoryAPIKeys struct {
+	mu		sync.RWMutex
+	keys		map[string]APIKey
+}
+
+func NewMemoryAPIKeys() *MemoryAPIKeys {
+	return &MemoryAPIKeys{keys: make(map[string]APIKey)}
+}
+
+//Reads a json array of APIKey, as written by Save
+func LoadAPIKeys(path string) (*MemoryAPIKeys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]APIKey, 0)
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+
+	store := NewMemoryAPIKeys()
+	for i := range keys {
+		store.Put(keys[i])
+	}
+	return store, nil
+}
+
+//Writes the keys as a json array
+func (m *MemoryAPIKeys) Save(path string) error {
+	m.mu.RLock()
+	keys := make([]APIKey, 0, len(m.keys))
+	for _, key := range m.keys {
+		keys = append(keys, key)
+	}
+	m.mu.RUnlock()
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+//Adds, or replaces, the key with the same prefix
+func (m *MemoryAPIKeys) Put(key APIKey) {
+	m.mu.Lock()
+	m.keys[key.Prefix] = key
+	m.mu.Unlock()
+}
+
+//Disables the key with the prefix
+func (m *MemoryAPIKeys) Revoke(prefix string) {
+	m.mu.Lock()
+	if key, found := m.keys[prefix]; found {
+		key.Enabled = false
+		m.keys[prefix] = key
+	}
+	m.mu.Unlock()
+}
+
+//Records the key's last use
+func (m *MemoryAPIKeys) Touch(prefix string, at time.Time) {
+	m.mu.Lock()
+	if key, found := m.keys[prefix]; found {
+		key.LastUsed = at
+		m.keys[prefix] = key
+	}
+	m.mu.Unlock()
+}
+
+func (m *MemoryAPIKeys) LookupKey(prefix string) (APIKey, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key, found := m.keys[prefix]
+	return key, found
+}
@@ -0,0 +1,151 @@
+package authorizers
+
+import (
+	"github.com/rmullinnix461332/gorest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type apiKeyService struct {
+	gorest.RestService	`root:"/apikey-service/" consumes:"application/json" produces:"application/json"`
+	PartnerKey	gorest.Security	`mode:"api_key" location:"header" name:"X-Api-Key"`
+	Feeds		gorest.Security	`mode:"api_key" location:"query" name:"key"`
+	orders		gorest.EndPoint	`method:"GET" path:"/orders" output:"string" security:"PartnerKey:[orders]"`
+	feed		gorest.EndPoint	`method:"GET" path:"/feed?{key:string}" output:"string" security:"Feeds"`
+	summary		gorest.EndPoint	`method:"GET" path:"/summary" output:"string" security:"PartnerKey:[orders,reports]"`
+}
+
+func (serv apiKeyService) Orders() string {
+	return serv.Principal().Subject
+}
+
+func (serv apiKeyService) Feed(key string) string {
+	return serv.Principal().Subject
+}
+
+func (serv apiKeyService) Summary() string {
+	return serv.Principal().Subject
+}
+
+func TestAPIKeyAuthorizer(t *testing.T) {
+	acme, acmeKey := GenerateAPIKey("acme", []string{"orders"}, time.Time{})
+	globex, globexKey := GenerateAPIKey("globex", []string{"reports"}, time.Time{})
+	expired, expiredKey := GenerateAPIKey("initech", []string{"orders"}, time.Now().Add(-time.Hour))
+
+	// a store written to and read back from a file
+	file := filepath.Join(t.TempDir(), "keys.json")
+	seed := NewMemoryAPIKeys()
+	seed.Put(acmeKey)
+	seed.Put(globexKey)
+	seed.Put(expiredKey)
+	if err := seed.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	store, err := LoadAPIKeys(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	NewAPIKeys(APIKeyOptions{Scheme: "PartnerKey", Store: store, Used: store.Touch}).Register()
+	NewAPIKeys(APIKeyOptions{Scheme: "Feeds", Store: store}).Register()
+	gorest.RegisterService(new(apiKeyService))
+
+	srv := httptest.NewServer(gorest.Handle())
+	defer srv.Close()
+
+	call := func(path string, key string) (int, string) {
+		req, _ := http.NewRequest("GET", srv.URL + "/apikey-service" + path, nil)
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := call("/orders", acme); code != 200 || body != `"acme"` {
+		t.Error("valid key:", code, body)
+	}
+	if key, _ := store.LookupKey(acmeKey.Prefix); key.LastUsed.IsZero() {
+		t.Error("last use was not recorded")
+	}
+	if code, _ := call("/orders", globex); code != 403 {
+		t.Error("key without the scope:", code)
+	}
+	// any one of the endpoint's scopes will do, as with jwt
+	if code, body := call("/summary", acme); code != 200 || body != `"acme"` {
+		t.Error("key with one of the scopes:", code, body)
+	}
+	if code, body := call("/summary", globex); code != 200 || body != `"globex"` {
+		t.Error("key with the other scope:", code, body)
+	}
+	if code, _ := call("/orders", expired); code != 401 {
+		t.Error("expired key:", code)
+	}
+	if code, _ := call("/orders", acmeKey.Prefix + ".forged"); code != 401 {
+		t.Error("known prefix with a wrong secret:", code)
+	}
+	if code, body := call("/feed?key=" + globex, ""); code != 200 || body != `"globex"` {
+		t.Error("key in the query:", code, body)
+	}
+
+	store.Revoke(acmeKey.Prefix)
+	if code, _ := call("/orders", acme); code != 401 {
+		t.Error("revoked key:", code)
+	}
+}
+
+func TestAPIKeyMalformed(t *testing.T) {
+	store := NewMemoryAPIKeys()
+	a := NewAPIKeys(APIKeyOptions{Scheme: "PartnerKey", Store: store})
+
+	for _, key := range []string{"legacysecretwithoutprefix", ".secret", "prefixonly."} {
+		result := a.Authorize(key, "PartnerKey", nil, "GET", nil)
+		if result.Decision != gorest.AuthUnauthenticated {
+			t.Errorf("%q: expected unauthenticated, got %v", key, result.Decision)
+		}
+		if strings.Contains(result.Reason, strings.Trim(key, ".")) {
+			t.Errorf("%q: the reason gives the key away: %s", key, result.Reason)
+		}
+	}
+
+	_, known := GenerateAPIKey("acme", nil, time.Time{})
+	store.Put(known)
+	result := a.Authorize(known.Prefix + ".wrong", "PartnerKey", nil, "GET", nil)
+	if result.Decision != gorest.AuthUnauthenticated || strings.Contains(result.Reason, "wrong") {
+		t.Errorf("wrong secret: %+v", result)
+	}
+}
+
+func TestAPIKeyScopeBoundary(t *testing.T) {
+	store := NewMemoryAPIKeys()
+	a := NewAPIKeys(APIKeyOptions{Scheme: "PartnerKey", Store: store})
+
+	cases := []struct {
+		scope		string
+		decision	gorest.AuthDecision
+	}{
+		{"admin", gorest.AuthAllow},
+		{"admin:write", gorest.AuthAllow},
+		{"admin.write", gorest.AuthAllow},
+		{"admin_readonly", gorest.AuthForbidden},
+		{"admin2", gorest.AuthForbidden},
+	}
+
+	for _, tc := range cases {
+		secret, key := GenerateAPIKey(tc.scope, []string{tc.scope}, time.Time{})
+		store.Put(key)
+		if result := a.Authorize(secret, "PartnerKey", []string{"admin"}, "GET", nil); result.Decision != tc.decision {
+			t.Errorf("key holding %q: expected %v, got %v", tc.scope, tc.decision, result.Decision)
+		}
+	}
+}
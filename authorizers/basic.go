@@ -0,0 +1,294 @@
+package authorizers
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/rmullinnix461332/gorest"
+	"github.com/rmullinnix461332/logger"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Source of the stored password, or password hash, for a user
+type CredentialStore interface {
+	Lookup(username string) (string, bool)
+}
+
+//Configuration of an HTTP Basic authorizer
+type BasicOptions struct {
+	Scheme		string
+	Store		CredentialStore
+	Scopes		func(username string) []string	// scopes granted to the user, required when endpoints name scopes
+	MaxFailures	int		// failures within Window before the user is locked out from the client's address, default 5
+	Window		time.Duration	// default 1 minute
+	Lockout		time.Duration	// default 5 minutes
+}
+
+//Authorizer for HTTP Basic credentials, the service realm is sent in the WWW-Authenticate challenge
+type Basic struct {
+	opts		BasicOptions
+
+	mu		sync.Mutex
+	failures	map[string]*basicFailures	// by user and client address, so others can not lock a user out
+}
+
+type basicFailures struct {
+	count		int
+	since		time.Time
+	lockedUntil	time.Time
+}
+
+//Creates a basic authorizer bound to opts.Scheme
+func NewBasic(opts BasicOptions) *Basic {
+	if opts.Store == nil {
+		logger.Error.Panicln("[sec] basic authorizer needs a credential store")
+	}
+	if opts.MaxFailures == 0 {
+		opts.MaxFailures = 5
+	}
+	if opts.Window == 0 {
+		opts.Window = time.Minute
+	}
+	if opts.Lockout == 0 {
+		opts.Lockout = 5 * time.Minute
+	}
+	return &Basic{opts: opts, failures: make(map[string]*basicFailures)}
+}
+
+//Registers the authorizer for its scheme
+func (b *Basic) Register() {
+	gorest.RegisterPrincipalAuthorizer(b.opts.Scheme, b.Authorize)
+}
+
+//A gorest.PrincipalAuthorizer for the scheme, the token is the decoded "user:password"
+func (b *Basic) Authorize(token string, scheme string, scopes []string, method string, rb *gorest.ResponseBuilder) gorest.AuthResult {
+	if b.opts.Scheme != "" && scheme != b.opts.Scheme {
+		return gorest.Unauthenticated("basic authorizer for " + b.opts.Scheme + " called for scheme " + scheme)
+	}
+
+	sep := strings.Index(token, ":")
+	if sep < 0 {
+		return gorest.Unauthenticated("no basic credentials")
+	}
+	username := token[:sep]
+	password := token[sep+1:]
+
+	client := ""
+	if rb != nil {
+		client = rb.ClientIP()
+	}
+	attempt := username + "\x00" + client
+
+	// the same reason as a wrong password, a caller can not tell a lockout or an unknown user apart
+	if b.locked(attempt) {
+		logger.Error.Println("[sec] basic userid: " + username + " client: " + client + " active: true locked: true auth: false response: 401 reason: too many failures")
+		return gorest.Unauthenticated("invalid credentials")
+	}
+
+	stored, found := b.opts.Store.Lookup(username)
+	if !found {
+		// spend the time a real check would, so unknown users can not be told apart
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+	}
+	if !found || !VerifyPassword(stored, password) {
+		b.fail(attempt)
+		logger.Error.Println("[sec] basic userid: " + username + " client: " + client + " active: true locked: false auth: false response: 401 reason: invalid credentials")
+		return gorest.Unauthenticated("invalid credentials")
+	}
+	b.succeed(attempt)
+
+	principal := &gorest.Principal{Subject: username}
+	if b.opts.Scopes != nil {
+		principal.Scopes = b.opts.Scopes(username)
+	}
+	if rb != nil {
+		rb.Session().Set(gorest.SessionUserID, username)
+	}
+
+	if len(scopes) > 0 && !scopesAuthorized(scopes, principal.Scopes, rb) {
+		logger.Error.Println("[sec] basic userid: " + username + " active: true locked: false auth: false response: 403 reason: user not authorized for scope " + strings.Join(scopes, ", "))
+		return gorest.Forbidden(principal, "not authorized for scope " + strings.Join(scopes, ", "))
+	}
+	return gorest.Authenticated(principal)
+}
+
+func (b *Basic) locked(attempt string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, found := b.failures[attempt]
+	return found && time.Now().Before(f.lockedUntil)
+}
+
+func (b *Basic) fail(attempt string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if len(b.failures) > 10000 {
+		for name, f := range b.failures {
+			if now.Sub(f.since) > b.opts.Window && now.After(f.lockedUntil) {
+				delete(b.failures, name)
+			}
+		}
+	}
+
+	f, found := b.failures[attempt]
+	if !found || now.Sub(f.since) > b.opts.Window {
+		f = &basicFailures{since: now}
+		b.failures[attempt] = f
+	}
+	f.count++
+	if f.count >= b.opts.MaxFailures {
+		f.lockedUntil = now.Add(b.opts.Lockout)
+		f.count = 0
+		f.since = now
+	}
+}
+
+func (b *Basic) succeed(attempt string) {
+	b.mu.Lock()
+	delete(b.failures, attempt)
+	b.mu.Unlock()
+}
+
+//CredentialStore kept in memory, values are a bcrypt or argon2 hash, or a plain password
+type MemoryCredentials struct {
+	mu		sync.RWMutex
+	users		map[string]string
+}
+
+func NewMemoryCredentials() *MemoryCredentials {
+	return &MemoryCredentials{users: make(map[string]string)}
+}
+
+//Sets the password hash, or password, for the user
+func (m *MemoryCredentials) Set(username string, hash string) {
+	m.mu.Lock()
+	m.users[username] = hash
+	m.mu.Unlock()
+}
+
+func (m *MemoryCredentials) Delete(username string) {
+	m.mu.Lock()
+	delete(m.users, username)
+	m.mu.Unlock()
+}
+
+func (m *MemoryCredentials) Lookup(username string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	hash, found := m.users[username]
+	return hash, found
+}
+
+//Reads an htpasswd file of user:hash lines, bcrypt ($2y$) and argon2 ($argon2id$) hashes are supported
+func LoadHtpasswd(path string) (*MemoryCredentials, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	creds := NewMemoryCredentials()
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.Index(line, ":")
+		if sep < 1 {
+			return nil, fmt.Errorf("%s:%d: expecting user:hash", path, lineNo)
+		}
+		hash := line[sep+1:]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$argon2") {
+			logger.Warning.Printf("[sec] %s:%d: unsupported hash for %s, the user can not log in", path, lineNo, line[:sep])
+			continue
+		}
+		creds.Set(line[:sep], hash)
+	}
+	return creds, scanner.Err()
+}
+
+//Hashes a password with bcrypt, for MemoryCredentials or an htpasswd file
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+//Checks a password against a bcrypt or argon2 hash, any other value that is not a hash is compared as a plain password
+func VerifyPassword(stored string, password string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, "$argon2"):
+		ok, err := verifyArgon2(stored, password)
+		if err != nil {
+			logger.Warning.Println("[sec] argon2 hash: " + err.Error())
+		}
+		return ok
+	case strings.HasPrefix(stored, "$"), strings.HasPrefix(stored, "{"):
+		// $apr1$, {SHA} and the like are not supported
+		return false
+	}
+
+	// hashed so the comparison does not depend on the length
+	s := sha256.Sum256([]byte(stored))
+	p := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(s[:], p[:]) == 1
+}
+
+// $argon2id$v=19$m=65536,t=3,p=4$salt$hash, salt and hash in unpadded base64
+func verifyArgon2(stored string, password string) (bool, error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false, errors.New("expecting $argon2id$v=19$m=..,t=..,p=..$salt$hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("unsupported version " + parts[2])
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, errors.New("invalid parameters " + parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+
+	var computed []byte
+	switch parts[1] {
+	case "argon2id":
+		computed = argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(hash)))
+	case "argon2i":
+		computed = argon2.Key([]byte(password), salt, iterations, memory, threads, uint32(len(hash)))
+	default:
+		return false, errors.New("unsupported variant " + parts[1])
+	}
+	return subtle.ConstantTimeCompare(hash, computed) == 1, nil
+}
+
+var dummyOnce		sync.Once
+var dummy		[]byte
+
+func dummyHash() []byte {
+	dummyOnce.Do(func() {
+		dummy, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	})
+	return dummy
+}
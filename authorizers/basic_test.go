@@ -0,0 +1,172 @@
+package authorizers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/rmullinnix461332/gorest"
+	"golang.org/x/crypto/argon2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+type basicService struct {
+	gorest.RestService	`root:"/basic-service/" realm:"ops" consumes:"application/json" produces:"application/json"`
+	Login		gorest.Security	`mode:"basic"`
+	status		gorest.EndPoint	`method:"GET" path:"/status" output:"string" security:"Login"`
+	restart		gorest.EndPoint	`method:"POST" path:"/restart" security:"Login:[admin]"`
+	report		gorest.EndPoint	`method:"GET" path:"/report" output:"string" security:"Login:[admin,ops]"`
+}
+
+func (serv basicService) Status() string {
+	return serv.Principal().Subject
+}
+
+func (serv basicService) Restart() {
+}
+
+func (serv basicService) Report() string {
+	return serv.Principal().Subject
+}
+
+func argon2Hash(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	hash := argon2.IDKey([]byte(password), salt, 1, 8*1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, 8*1024, 1, 1, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash))
+}
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, _ := HashPassword("s3cret")
+
+	cases := []struct {
+		stored		string
+		password	string
+		ok		bool
+	}{
+		{bcryptHash, "s3cret", true},
+		{bcryptHash, "wrong", false},
+		{argon2Hash("s3cret"), "s3cret", true},
+		{argon2Hash("s3cret"), "wrong", false},
+		{"s3cret", "s3cret", true},
+		{"s3cret", "s3cre", false},
+		{"$apr1$abc$def", "s3cret", false},
+		{"$argon2id$v=19$garbage", "s3cret", false},
+	}
+
+	for _, tc := range cases {
+		if VerifyPassword(tc.stored, tc.password) != tc.ok {
+			t.Errorf("VerifyPassword(%q, %q) expected %v", tc.stored, tc.password, tc.ok)
+		}
+	}
+}
+
+func TestBasicAuthorizer(t *testing.T) {
+	bcryptHash, _ := HashPassword("bcrypt-pass")
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	ioutil.WriteFile(file, []byte("# users\nalice:" + bcryptHash + "\nbob:" + argon2Hash("argon-pass") + "\neve:plaintext\n"), 0600)
+
+	store, err := LoadHtpasswd(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := store.Lookup("eve"); found {
+		t.Error("htpasswd entry without a supported hash was loaded")
+	}
+
+	NewBasic(BasicOptions{
+		Scheme:		"Login",
+		Store:		store,
+		Scopes:		func(username string) []string {
+			if username == "alice" {
+				return []string{"admin"}
+			}
+			return []string{"ops"}
+		},
+		MaxFailures:	3,
+	}).Register()
+	gorest.RegisterService(new(basicService))
+
+	srv := httptest.NewServer(gorest.Handle())
+	defer srv.Close()
+
+	gorest.SetClientIPHeader("X-Forwarded-For")
+	defer gorest.SetClientIPHeader("")
+
+	client := ""
+	call := func(method string, path string, user string, password string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL + "/basic-service" + path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		if client != "" {
+			req.Header.Set("X-Forwarded-For", client)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	if resp, body := call("GET", "/status", "alice", "bcrypt-pass"); resp.StatusCode != 200 || body != `"alice"` {
+		t.Error("bcrypt user:", resp.StatusCode, body)
+	}
+	if resp, body := call("GET", "/status", "bob", "argon-pass"); resp.StatusCode != 200 || body != `"bob"` {
+		t.Error("argon2 user:", resp.StatusCode, body)
+	}
+	if resp, _ := call("GET", "/status", "", ""); resp.StatusCode != 401 || resp.Header.Get("WWW-Authenticate") != `Basic realm="ops"` {
+		t.Error("no credentials:", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+	if resp, _ := call("POST", "/restart", "bob", "argon-pass"); resp.StatusCode != 403 {
+		t.Error("user without the admin scope:", resp.StatusCode)
+	}
+	if resp, _ := call("POST", "/restart", "alice", "bcrypt-pass"); resp.StatusCode >= 300 {
+		t.Error("admin user:", resp.StatusCode)
+	}
+
+	// any one of the endpoint's scopes will do, as with jwt
+	if resp, body := call("GET", "/report", "bob", "argon-pass"); resp.StatusCode != 200 || body != `"bob"` {
+		t.Error("user with one of the scopes:", resp.StatusCode, body)
+	}
+	if resp, body := call("GET", "/report", "alice", "bcrypt-pass"); resp.StatusCode != 200 || body != `"alice"` {
+		t.Error("user with the other scope:", resp.StatusCode, body)
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp, _ := call("GET", "/status", "bob", "wrong"); resp.StatusCode != 401 {
+			t.Error("wrong password:", resp.StatusCode)
+		}
+	}
+	// locked out, the right password is refused too
+	if resp, _ := call("GET", "/status", "bob", "argon-pass"); resp.StatusCode != 401 {
+		t.Error("locked out user:", resp.StatusCode)
+	}
+	if resp, _ := call("GET", "/status", "alice", "bcrypt-pass"); resp.StatusCode != 200 {
+		t.Error("other users are not locked out:", resp.StatusCode)
+	}
+	// failures from one address do not lock the user out everywhere
+	client = "10.0.0.9"
+	if resp, body := call("GET", "/status", "bob", "argon-pass"); resp.StatusCode != 200 || body != `"bob"` {
+		t.Error("user locked out from another address:", resp.StatusCode, body)
+	}
+}
+
+func TestBasicWithoutResponseBuilder(t *testing.T) {
+	hash, _ := HashPassword("secret")
+	store := NewMemoryCredentials()
+	store.Set("carol", hash)
+	b := NewBasic(BasicOptions{Scheme: "Login", Store: store, Scopes: func(string) []string { return []string{"orders[7,9]"} }})
+
+	if result := b.Authorize("carol:secret", "Login", []string{"orders[9]"}, "GET", nil); result.Decision != gorest.AuthAllow {
+		t.Errorf("expected allow, got %+v", result)
+	}
+	if result := b.Authorize("carol:wrong", "Login", nil, "GET", nil); result.Decision != gorest.AuthUnauthenticated {
+		t.Errorf("expected unauthenticated, got %+v", result)
+	}
+}
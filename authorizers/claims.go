@@ -0,0 +1,205 @@
+package authorizers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/rmullinnix461332/gorest"
+	"strings"
+	"time"
+)
+
+//Registered claim checks for the tokens of a scheme, exp, nbf and iat are always checked when present
+type JWTValidation struct {
+	Issuers		[]string	// iss must be one of these, any when empty
+	Audiences	[]string	// aud must hold one of these, any when empty
+	Leeway		time.Duration	// clock skew allowed on exp, nbf and iat
+	RequiredClaims	[]string	// claims that must be present, e.g. "exp", "sub"
+}
+
+//Sets the claim checks applied to the tokens of the scheme
+func SetValidation(scheme string, v JWTValidation) {
+	schemeJWT(scheme).SetValidation(v)
+}
+
+// the reason a token's claims are refused, nil when they pass
+func validateClaims(claims map[string]interface{}, v JWTValidation, now time.Time) error {
+	for _, name := range v.RequiredClaims {
+		if _, found := claims[name]; !found {
+			return errors.New("missing required claim " + name)
+		}
+	}
+
+	if exp, found, err := numericClaim(claims, "exp"); err != nil {
+		return err
+	} else if found && !now.Before(exp.Add(v.Leeway)) {
+		return errors.New("token is expired")
+	}
+
+	if nbf, found, err := numericClaim(claims, "nbf"); err != nil {
+		return err
+	} else if found && now.Add(v.Leeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+
+	if iat, found, err := numericClaim(claims, "iat"); err != nil {
+		return err
+	} else if found && now.Add(v.Leeway).Before(iat) {
+		return errors.New("token used before issued")
+	}
+
+	if len(v.Issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !containsAny(v.Issuers, []string{iss}) {
+			return errors.New("issuer " + iss + " is not accepted")
+		}
+	}
+
+	if len(v.Audiences) > 0 {
+		aud, ok := claimStrings(claims["aud"])
+		if !ok {
+			return errors.New("aud claim is not a string or array of strings")
+		}
+		if !containsAny(v.Audiences, aud) {
+			return errors.New("audience " + strings.Join(aud, ",") + " is not accepted")
+		}
+	}
+
+	return nil
+}
+
+// the token's scopes, from the scope claim as a space delimited string (RFC 8693) or an array, or from scp
+func claimScopes(claims map[string]interface{}) ([]string, bool) {
+	for _, name := range []string{"scope", "scp"} {
+		if value, found := claims[name]; found {
+			if str, ok := value.(string); ok {
+				return strings.Fields(str), true
+			}
+			return claimStrings(value)
+		}
+	}
+	return nil, false
+}
+
+// a string or array of strings claim, e.g. aud
+func claimStrings(value interface{}) ([]string, bool) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, true
+	case []string:
+		return v, true
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for i := range v {
+			str, ok := v[i].(string)
+			if !ok {
+				return nil, false
+			}
+			strs = append(strs, str)
+		}
+		return strs, true
+	}
+	return nil, false
+}
+
+// a NumericDate claim (RFC 7519), seconds since the epoch
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	value, found := claims[name]
+	if !found {
+		return time.Time{}, false, nil
+	}
+
+	var secs float64
+	switch v := value.(type) {
+	case float64:
+		secs = v
+	case int64:
+		secs = float64(v)
+	case int:
+		secs = float64(v)
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false, errors.New(name + " claim is not a number")
+		}
+		secs = f
+	default:
+		return time.Time{}, false, errors.New(name + " claim is not a number")
+	}
+
+	return time.Unix(0, int64(secs * float64(time.Second))), true, nil
+}
+
+func containsAny(accepted []string, values []string) bool {
+	for i := range values {
+		for j := range accepted {
+			if values[i] == accepted[j] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Reports whether the held scopes grant any of the required ones, the matching used by every authorizer.
+//"<valid>" asks for no particular scope, a required scope is granted by the same held scope or one below it
+//(orders by orders:write or orders.read, not orders_archive), and a required scope[ctx] needs ctx in the list of
+//a held scope[a,b], which is left in SessionScopeContext.
+func scopesAuthorized(required []string, held []string, rb *gorest.ResponseBuilder) bool {
+	for i := range required {
+		// just interested in a valid credential with no specific privileges
+		if required[i] == "<valid>" {
+			return true
+		}
+
+		contextAuth := -1
+		contextKey := ""
+		scopeName := required[i]
+		if contextAuth = strings.Index(required[i], "["); contextAuth > -1 {
+			contextKey = required[i][contextAuth + 1 : strings.Index(required[i], "]")]
+			scopeName = required[i][:contextAuth]
+		}
+
+		for j := range held {
+			arrStr := held[j]
+
+			if scopeGrants(arrStr, scopeName) {
+				if contextAuth = strings.Index(arrStr, "["); contextAuth > -1 {
+					if rb != nil {
+						rb.Session().Set(gorest.SessionScopeContext, arrStr[contextAuth + 1 : len(arrStr) - 1])
+					}
+					keys := strings.Split(arrStr[contextAuth + 1 : len(arrStr) - 1], ",")
+
+					// restricted list, filtered in application code
+					if contextKey == "" {
+						return true
+					}
+
+					for k := range keys {
+						if keys[k] == contextKey {
+							return true
+						}
+					}
+				} else {
+					return true
+				}
+
+			}
+			
+			if len(contextKey) > 0 {
+				if required[i] == held[j] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// whether a held scope is the named one or below it, a prefix only counts up to a : or . separator
+func scopeGrants(held string, name string) bool {
+	if !strings.HasPrefix(held, name) {
+		return false
+	}
+	rest := held[len(name):]
+	return rest == "" || rest[0] == ':' || rest[0] == '.' || rest[0] == '['
+}
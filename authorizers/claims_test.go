@@ -0,0 +1,112 @@
+package authorizers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateClaims(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	secs := func(d time.Duration) float64 { return float64(now.Add(d).Unix()) }
+
+	v := JWTValidation{
+		Issuers:	[]string{"https://issuer.example"},
+		Audiences:	[]string{"orders"},
+		Leeway:		30 * time.Second,
+		RequiredClaims:	[]string{"exp", "sub"},
+	}
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": "https://issuer.example",
+			"aud": []interface{}{"billing", "orders"},
+			"sub": "bob",
+			"exp": secs(time.Minute),
+			"nbf": secs(-time.Minute),
+			"iat": secs(-time.Minute),
+		}
+	}
+
+	cases := []struct {
+		name	string
+		edit	func(map[string]interface{})
+		reason	string
+	}{
+		{"valid", func(c map[string]interface{}) {}, ""},
+		{"aud string", func(c map[string]interface{}) { c["aud"] = "orders" }, ""},
+		{"json number", func(c map[string]interface{}) { c["exp"] = json.Number("1700000060") }, ""},
+		{"expired within leeway", func(c map[string]interface{}) { c["exp"] = secs(-20 * time.Second) }, ""},
+		{"expired", func(c map[string]interface{}) { c["exp"] = secs(-time.Minute) }, "expired"},
+		{"nbf within leeway", func(c map[string]interface{}) { c["nbf"] = secs(20 * time.Second) }, ""},
+		{"not yet valid", func(c map[string]interface{}) { c["nbf"] = secs(time.Minute) }, "not valid yet"},
+		{"issued in the future", func(c map[string]interface{}) { c["iat"] = secs(time.Minute) }, "before issued"},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://other.example" }, "issuer"},
+		{"missing issuer", func(c map[string]interface{}) { delete(c, "iss") }, "issuer"},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "billing" }, "audience"},
+		{"audience not strings", func(c map[string]interface{}) { c["aud"] = []interface{}{1} }, "aud claim"},
+		{"missing sub", func(c map[string]interface{}) { delete(c, "sub") }, "required claim sub"},
+		{"exp not a number", func(c map[string]interface{}) { c["exp"] = "tomorrow" }, "exp claim is not a number"},
+	}
+
+	for _, tc := range cases {
+		claims := valid()
+		tc.edit(claims)
+		err := validateClaims(claims, v, now)
+		if tc.reason == "" && err != nil {
+			t.Errorf("%s: unexpected refusal: %v", tc.name, err)
+		} else if tc.reason != "" && (err == nil || !strings.Contains(err.Error(), tc.reason)) {
+			t.Errorf("%s: expected refusal containing %q, got %v", tc.name, tc.reason, err)
+		}
+	}
+}
+
+func TestClaimScopes(t *testing.T) {
+	cases := []struct {
+		claims	map[string]interface{}
+		scopes	string
+		found	bool
+	}{
+		{map[string]interface{}{"scope": "read write"}, "read,write", true},
+		{map[string]interface{}{"scope": []interface{}{"read", "write"}}, "read,write", true},
+		{map[string]interface{}{"scp": []interface{}{"read"}}, "read", true},
+		{map[string]interface{}{"scp": "read write"}, "read,write", true},
+		{map[string]interface{}{"scope": []interface{}{"read", 7}}, "", false},
+		{map[string]interface{}{"scope": 7}, "", false},
+		{map[string]interface{}{}, "", false},
+	}
+
+	for _, tc := range cases {
+		scopes, found := claimScopes(tc.claims)
+		if found != tc.found || strings.Join(scopes, ",") != tc.scopes {
+			t.Errorf("%v: got %v %v, expected %s %v", tc.claims, scopes, found, tc.scopes, tc.found)
+		}
+	}
+}
+
+func TestScopesAuthorized(t *testing.T) {
+	cases := []struct {
+		required	string
+		held		string
+		authorized	bool
+	}{
+		{"admin", "admin", true},
+		{"admin", "read admin", true},
+		{"admin", "admin:read", true},
+		{"admin", "admin.read", true},
+		{"admin", "admin_readonly", false},
+		{"admin", "admin2", false},
+		{"admin", "administrator", false},
+		{"admin:read", "admin", false},
+		{"admin:read", "admin:readonly", false},
+		{"admin,orders", "orders", true},
+		{"<valid>", "", true},
+		{"admin", "", false},
+	}
+
+	for _, tc := range cases {
+		if authorized := scopesAuthorized(strings.Split(tc.required, ","), strings.Fields(tc.held), nil); authorized != tc.authorized {
+			t.Errorf("%q holding %q: expected %v", tc.required, tc.held, tc.authorized)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package authorizers
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/rmullinnix461332/logger"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// an unknown kid refetches the document at most this often, so bad tokens can not hammer the issuer
+const jwksRefetchInterval = 30 * time.Second
+
+//Keys for verifying tokens, loaded from a JSON Web Key Set (RFC 7517) document
+type JWKS struct {
+	source		string
+	client		*http.Client
+	refresh		time.Duration
+	minRefetch	time.Duration
+
+	mu		sync.RWMutex
+	keys		map[string]signingKey
+	fetched		time.Time
+	flight		*jwksFlight	// the fetch in progress, guarded by mu
+}
+
+type jwksFlight struct {
+	done		chan struct{}
+	err		error
+}
+
+type jsonWebKey struct {
+	Kty		string	`json:"kty"`
+	Kid		string	`json:"kid"`
+	Use		string	`json:"use"`
+	Alg		string	`json:"alg"`
+	N		string	`json:"n"`
+	E		string	`json:"e"`
+	Crv		string	`json:"crv"`
+	X		string	`json:"x"`
+	Y		string	`json:"y"`
+}
+
+//Creates a key set read from source, an http(s) URL or a file path, and reloaded every refresh (0 never reloads)
+//The document is loaded on first use; call Refresh to load it, and check it, up front.
+func NewJWKS(source string, refresh time.Duration) *JWKS {
+	return &JWKS{
+		source:		source,
+		client:		&http.Client{Timeout: 10 * time.Second},
+		refresh:	refresh,
+		minRefetch:	jwksRefetchInterval,
+	}
+}
+
+//Resolves keys for tokens of the scheme from the key set, after any key added with AddKey
+func AddJWKS(scheme string, jwks *JWKS) {
+	schemeJWT(scheme).SetJWKS(jwks)
+}
+
+//Reloads the document, the previous keys are kept if it can not be read. Concurrent calls share one fetch.
+func (j *JWKS) Refresh() error {
+	j.mu.Lock()
+	if flight := j.flight; flight != nil {
+		j.mu.Unlock()
+		<-flight.done
+		return flight.err
+	}
+	flight := &jwksFlight{done: make(chan struct{})}
+	j.flight = flight
+	j.mu.Unlock()
+
+	flight.err = j.fetch()
+
+	j.mu.Lock()
+	j.flight = nil
+	j.mu.Unlock()
+	close(flight.done)
+	return flight.err
+}
+
+func (j *JWKS) fetch() error {
+	data, err := j.read()
+	if err != nil {
+		return err
+	}
+
+	var doc struct {
+		Keys	[]jsonWebKey	`json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return errors.New("jwks " + j.source + ": " + err.Error())
+	}
+
+	keys := make(map[string]signingKey, len(doc.Keys))
+	for i := range doc.Keys {
+		jwk := doc.Keys[i]
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		sKey, err := jwk.signingKey()
+		if err != nil {
+			// one unsupported key should not take the others down
+			logger.Warning.Println("[sec] jwks " + j.source + " kid: " + jwk.Kid + " skipped: " + err.Error())
+			continue
+		}
+		keys[jwk.Kid] = sKey
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.fetched = time.Now()
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *JWKS) read() ([]byte, error) {
+	if !strings.HasPrefix(j.source, "http://") && !strings.HasPrefix(j.source, "https://") {
+		return ioutil.ReadFile(strings.TrimPrefix(j.source, "file://"))
+	}
+
+	resp, err := j.client.Get(j.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("jwks " + j.source + ": " + resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// the key for kid, an empty kid matches when the set holds a single key for the algorithm
+func (j *JWKS) key(kid string, alg string) (*signingKey, error) {
+	j.mu.RLock()
+	stale := j.keys == nil || (j.refresh > 0 && time.Since(j.fetched) > j.refresh)
+	j.mu.RUnlock()
+
+	if stale {
+		if err := j.Refresh(); err != nil {
+			logger.Error.Println("[sec] jwks refresh failed: " + err.Error())
+		}
+	}
+
+	sKey, found := j.lookup(kid, alg)
+	if !found && kid != "" {
+		// keys may have rotated since the last load
+		j.mu.RLock()
+		retry := time.Since(j.fetched) >= j.minRefetch
+		j.mu.RUnlock()
+		if retry {
+			if err := j.Refresh(); err != nil {
+				logger.Error.Println("[sec] jwks refresh failed: " + err.Error())
+			}
+			sKey, found = j.lookup(kid, alg)
+		}
+	}
+
+	if !found {
+		if kid == "" {
+			return nil, errors.New("token has no kid and the key set does not hold exactly one key for " + alg)
+		}
+		return nil, errors.New("key for kid " + kid + " does not exist")
+	}
+	return &sKey, nil
+}
+
+func (j *JWKS) lookup(kid string, alg string) (signingKey, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	if kid != "" {
+		sKey, found := j.keys[kid]
+		return sKey, found
+	}
+
+	var match signingKey
+	count := 0
+	for _, sKey := range j.keys {
+		if sKey.alg == "" || sKey.alg == alg {
+			match = sKey
+			count++
+		}
+	}
+	return match, count == 1
+}
+
+func (jwk jsonWebKey) signingKey() (signingKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeB64(jwk.N)
+		if err != nil {
+			return signingKey{}, err
+		}
+		e, err := decodeB64(jwk.E)
+		if err != nil {
+			return signingKey{}, err
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return signingKey{key: pub, signType: "RSA", alg: jwk.Alg}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return signingKey{}, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decodeB64(jwk.X)
+		if err != nil {
+			return signingKey{}, err
+		}
+		y, err := decodeB64(jwk.Y)
+		if err != nil {
+			return signingKey{}, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return signingKey{}, errors.New("point is not on curve " + jwk.Crv)
+		}
+		return signingKey{key: pub, signType: "ECDSA", alg: jwk.Alg}, nil
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return signingKey{}, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decodeB64(jwk.X)
+		if err != nil {
+			return signingKey{}, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return signingKey{}, errors.New("invalid Ed25519 key length")
+		}
+		return signingKey{key: ed25519.PublicKey(x), signType: "EdDSA", alg: jwk.Alg}, nil
+	}
+
+	return signingKey{}, errors.New("unsupported key type " + jwk.Kty)
+}
+
+func decodeB64(str string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(str, "="))
+}
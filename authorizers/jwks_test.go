@@ -0,0 +1,196 @@
+package authorizers
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rmullinnix461332/logger"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init("error")
+	os.Exit(m.Run())
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, pub *rsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}
+}
+
+func ecJWK(kid string, pub *ecdsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(pub.X.Bytes()), "y": b64(pub.Y.Bytes())}
+}
+
+func edJWK(kid string, pub ed25519.PublicKey) map[string]string {
+	return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64(pub)}
+}
+
+func jwksDoc(keys ...map[string]string) []byte {
+	doc, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return doc
+}
+
+func signed(method jwt.SigningMethod, kid string, key interface{}) string {
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"user": "bob", "exp": time.Now().Add(time.Minute).Unix()})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	str, _ := token.SignedString(key)
+	return str
+}
+
+func parseFor(scheme string, token string) error {
+	_, err := jwt.Parse(token, schemeJWT(scheme).keyFunc)
+	return err
+}
+
+func TestJWKSKeyTypes(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	ioutil.WriteFile(file, jwksDoc(rsaJWK("r1", &rsaKey.PublicKey), ecJWK("e1", &ecKey.PublicKey), edJWK("d1", edPub)), 0600)
+	AddJWKS("jwks-file", NewJWKS(file, time.Hour))
+
+	if err := parseFor("jwks-file", signed(jwt.SigningMethodRS256, "r1", rsaKey)); err != nil {
+		t.Error("RSA token:", err)
+	}
+	if err := parseFor("jwks-file", signed(jwt.SigningMethodES256, "e1", ecKey)); err != nil {
+		t.Error("ECDSA token:", err)
+	}
+	if err := parseFor("jwks-file", signed(jwt.SigningMethodEdDSA, "d1", edKey)); err != nil {
+		t.Error("EdDSA token:", err)
+	}
+	if err := parseFor("jwks-file", signed(jwt.SigningMethodES256, "r1", ecKey)); err == nil {
+		t.Error("ECDSA token verified against the RSA key")
+	}
+	if err := parseFor("jwks-file", signed(jwt.SigningMethodRS256, "missing", rsaKey)); err == nil {
+		t.Error("token with an unknown kid verified")
+	}
+	// three keys, a token without kid can not pick one
+	if err := parseFor("jwks-file", signed(jwt.SigningMethodRS256, "", rsaKey)); err == nil {
+		t.Error("token without kid verified against a set of three keys")
+	}
+}
+
+func TestJWKSWithoutKid(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	ioutil.WriteFile(file, jwksDoc(rsaJWK("only", &rsaKey.PublicKey)), 0600)
+	AddJWKS("jwks-single", NewJWKS(file, 0))
+
+	if err := parseFor("jwks-single", signed(jwt.SigningMethodRS256, "", rsaKey)); err != nil {
+		t.Error("token without kid against a single key:", err)
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var mu sync.Mutex
+	doc := jwksDoc(rsaJWK("old", &oldKey.PublicKey))
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		w.Write(doc)
+	}))
+	defer srv.Close()
+
+	jwks := NewJWKS(srv.URL, time.Hour)
+	AddJWKS("jwks-url", jwks)
+
+	if err := parseFor("jwks-url", signed(jwt.SigningMethodRS256, "old", oldKey)); err != nil {
+		t.Fatal("token signed with the published key:", err)
+	}
+
+	mu.Lock()
+	doc = jwksDoc(rsaJWK("new", &newKey.PublicKey))
+	mu.Unlock()
+
+	// within the refetch interval an unknown kid does not reach the issuer
+	if err := parseFor("jwks-url", signed(jwt.SigningMethodRS256, "new", newKey)); err == nil {
+		t.Error("rotated key resolved before the refetch interval")
+	}
+
+	jwks.minRefetch = 0
+	if err := parseFor("jwks-url", signed(jwt.SigningMethodRS256, "new", newKey)); err != nil {
+		t.Error("token signed with the rotated key:", err)
+	}
+	if err := parseFor("jwks-url", signed(jwt.SigningMethodRS256, "old", oldKey)); err == nil {
+		t.Error("token signed with the retired key verified")
+	}
+
+	mu.Lock()
+	if fetches < 2 {
+		t.Error("expected the key set to be refetched, fetches:", fetches)
+	}
+	mu.Unlock()
+}
+
+func TestJWKSConcurrentRefresh(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var mu sync.Mutex
+	fetches := 0
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		<-release
+		w.Write(jwksDoc(rsaJWK("k1", &key.PublicKey)))
+	}))
+	defer srv.Close()
+
+	jwks := NewJWKS(srv.URL, 0)
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- jwks.Refresh()
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error("refresh:", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 1 {
+		t.Error("concurrent refreshes fetched the key set", fetches, "times")
+	}
+	if _, found := jwks.lookup("k1", "RS256"); !found {
+		t.Error("key was not loaded")
+	}
+}
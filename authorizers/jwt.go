@@ -0,0 +1,223 @@
+package authorizers
+
+import (
+	"errors"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rmullinnix461332/gorest"
+	"github.com/rmullinnix461332/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Configuration of an oauth2 jwt authorizer
+type JWTOptions struct {
+	Scheme		string			// the security scheme the authorizer answers for
+	Keys		map[string]JWTKey	// verification keys by kid, "default" for tokens without a kid
+	JWKS		*JWKS			// consulted for a kid not in Keys
+	Validation	JWTValidation
+	Revoked		func(jti string) bool	// e.g. TokenService.Revoked
+}
+
+//A verification key, SignType is RSA, ECDSA, EdDSA or HMAC
+type JWTKey struct {
+	Key		interface{}
+	SignType	string
+}
+
+//Authorizer for oauth2 bearer tokens issued as signed jwts.
+//Each value has its own keys and claim checks and may serve concurrent requests.
+type JWT struct {
+	scheme		string
+
+	mu		sync.RWMutex
+	keys		map[string]signingKey
+	jwks		*JWKS
+	validation	JWTValidation
+	revoked		func(jti string) bool
+}
+
+//Creates a jwt authorizer bound to opts.Scheme
+func NewJWT(opts JWTOptions) *JWT {
+	a := &JWT{
+		scheme:		opts.Scheme,
+		keys:		make(map[string]signingKey),
+		jwks:		opts.JWKS,
+		validation:	opts.Validation,
+		revoked:	opts.Revoked,
+	}
+	for kid, key := range opts.Keys {
+		a.keys[kid] = signingKey{key: key.Key, signType: key.SignType}
+	}
+	return a
+}
+
+//Registers the authorizer for its scheme
+func (a *JWT) Register() {
+	gorest.RegisterPrincipalAuthorizer(a.scheme, a.Authorize)
+}
+
+//The security scheme the authorizer answers for
+func (a *JWT) Scheme() string {
+	return a.scheme
+}
+
+//Adds, or replaces, the verification key for keyid
+func (a *JWT) AddKey(keyid string, key interface{}, signType string) {
+	a.mu.Lock()
+	a.keys[keyid] = signingKey{key: key, signType: signType}
+	a.mu.Unlock()
+}
+
+//Resolves a kid not among the added keys from the key set
+func (a *JWT) SetJWKS(jwks *JWKS) {
+	a.mu.Lock()
+	a.jwks = jwks
+	a.mu.Unlock()
+}
+
+//Sets the claim checks applied to tokens
+func (a *JWT) SetValidation(v JWTValidation) {
+	a.mu.Lock()
+	a.validation = v
+	a.mu.Unlock()
+}
+
+func (a *JWT) getKey(keyid string) *signingKey {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if key, found := a.keys[keyid]; found {
+		return &key
+	}
+	return nil
+}
+
+//A gorest.PrincipalAuthorizer for the scheme.
+//The principal's subject is the "user" or "sub" claim, its scopes the "scope" or "scp" claim
+func (a *JWT) Authorize(token string, scheme string, scopes []string, method string, rb *gorest.ResponseBuilder) gorest.AuthResult {
+	if a.scheme != "" && scheme != a.scheme {
+		return gorest.Unauthenticated("jwt authorizer for " + a.scheme + " called for scheme " + scheme)
+	}
+
+	a.mu.RLock()
+	validation := a.validation
+	a.mu.RUnlock()
+
+	// the claims are checked below, with the scheme's leeway
+	jwtToken, err := jwt.NewParser(jwt.WithoutClaimsValidation()).Parse(token, a.keyFunc)
+
+	if err != nil {
+		logger.Error.Println("[sec] oauth2-jwt userid: unknown useruuid: unknown active: true locked: false auth: false failcnt: 0 response: 401 reason: jwt parse error", err)
+		return gorest.Unauthenticated("jwt parse error: " + err.Error())
+	}
+
+	claims, ok := jwtToken.Claims.(jwt.MapClaims)
+	if !ok {
+		return gorest.Unauthenticated("jwt claims are not a map")
+	}
+
+	if err := validateClaims(claims, validation, time.Now()); err != nil {
+		logger.Error.Println("[sec] oauth2-jwt userid: unknown useruuid: unknown active: true locked: false auth: false failcnt: 0 response: 401 reason: " + err.Error())
+		return gorest.Unauthenticated(err.Error())
+	}
+
+	if jti, ok := claims["jti"].(string); ok && a.revoked != nil && a.revoked(jti) {
+		logger.Error.Println("[sec] oauth2-jwt userid: unknown useruuid: unknown active: true locked: false auth: false failcnt: 0 response: 401 reason: token revoked")
+		return gorest.Unauthenticated("token revoked")
+	}
+
+	principal := &gorest.Principal{Claims: claims}
+
+	uid := "unknown"
+	uuid := "unknown"
+	if user, ufnd := claims["user"].(string); ufnd {
+		uid = user
+		principal.Subject = user
+		rb.Session().Set(gorest.SessionUserID, uid)
+	} else if sub, sfnd := claims["sub"].(string); sfnd {
+		principal.Subject = sub
+	}
+
+	if userUUID, uifnd := claims["useruuid"].(string); uifnd {
+		uuid = userUUID
+		rb.Session().Set(gorest.SessionUserUUID, uuid)
+	}
+
+	if tenant, tfnd := claims["tenant"].(string); tfnd {
+		principal.Tenant = tenant
+	} else if tid, tfnd := claims["tid"].(string); tfnd {
+		principal.Tenant = tid
+	}
+
+	arrClaim, found := claimScopes(claims)
+	if !found {
+		logger.Error.Println("[sec] oauth2-jwt userid: " + uid + " useruuid: " + uuid + " active: true locked: false auth: false failcnt: 0 response: 401 reason: No scope claims in the token")
+		return gorest.Unauthenticated("no scope claims in the token")
+	}
+
+	principal.Scopes = arrClaim
+	rb.Session().Set(gorest.SessionScope, arrClaim)
+
+	authorized := scopesAuthorized(scopes, arrClaim, rb)
+
+	if !authorized {
+		logger.Error.Println("[sec] oauth2-jwt userid: " + uid + " useruuid: " + uuid + " active: true locked: false auth: false failcnt: 0 response: 403 reason: user not authorized for scope " + strings.Join(arrClaim, ", "))
+		return gorest.Forbidden(principal, "not authorized for scope " + strings.Join(scopes, ", "))
+	}
+
+	return gorest.Authenticated(principal)
+}
+
+
+func (a *JWT) keyFunc(token *jwt.Token) (interface{}, error) {
+	// a missing or malformed kid falls back to the "default" key, or the key set's only key
+	kid, _ := token.Header["kid"].(string)
+	keyIndex := kid
+	if keyIndex == "" {
+		keyIndex = "default"
+	}
+
+	a.mu.RLock()
+	key, found := a.keys[keyIndex]
+	jwks := a.jwks
+	a.mu.RUnlock()
+
+	var sKey *signingKey
+	if found {
+		sKey = &key
+	} else if jwks != nil {
+		var err error
+		if sKey, err = jwks.key(kid, token.Method.Alg()); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, errors.New("key for kid " + keyIndex + " does not exist")
+	}
+
+	if sKey.alg != "" && sKey.alg != token.Method.Alg() {
+		return nil, errors.New("invalid signing method for key")
+	}
+
+	switch sKey.signType {
+	case "RSA":
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return sKey.key, nil
+		}
+	case "ECDSA":
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+			return sKey.key, nil
+		}
+	case "EdDSA":
+		if _, ok := token.Method.(*jwt.SigningMethodEd25519); ok {
+			return sKey.key, nil
+		}
+	case "HMAC":
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			return sKey.key, nil
+		}
+	default:
+		return nil, errors.New("invalid signing algorithm on key in keystore")
+	}
+	return nil, errors.New("invalid signing method for key")
+}
@@ -0,0 +1,103 @@
+package authorizers
+
+import (
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rmullinnix461332/gorest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type jwtService struct {
+	gorest.RestService	`root:"/jwt-service/" consumes:"application/json" produces:"application/json"`
+	Partner		gorest.Security	`mode:"oauth2" flow:"application"`
+	Staff		gorest.Security	`mode:"oauth2" flow:"application"`
+	orders		gorest.EndPoint	`method:"GET" path:"/orders" output:"string" security:"Partner:[orders]"`
+	reports		gorest.EndPoint	`method:"GET" path:"/reports" output:"string" security:"Staff:[reports]"`
+}
+
+func (serv jwtService) Orders() string {
+	return serv.Principal().Subject
+}
+
+func (serv jwtService) Reports() string {
+	return serv.Principal().Subject
+}
+
+func hmacToken(kid string, secret []byte, user string, scope string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user":		user,
+		"scope":	scope,
+		"exp":		time.Now().Add(time.Minute).Unix(),
+	})
+	token.Header["kid"] = kid
+	str, _ := token.SignedString(secret)
+	return str
+}
+
+func TestJWTSchemesConcurrently(t *testing.T) {
+	partnerSecret := []byte("partner-secret")
+	staffSecret := []byte("staff-secret")
+
+	// both schemes use kid "k1", each must resolve it from its own keys
+	NewJWT(JWTOptions{Scheme: "Partner", Keys: map[string]JWTKey{"k1": {partnerSecret, "HMAC"}}}).Register()
+	NewJWT(JWTOptions{Scheme: "Staff", Keys: map[string]JWTKey{"k1": {staffSecret, "HMAC"}}}).Register()
+	gorest.RegisterService(new(jwtService))
+
+	srv := httptest.NewServer(gorest.Handle())
+	defer srv.Close()
+
+	cases := []struct {
+		path	string
+		token	string
+		code	int
+		body	string
+	}{
+		{"/orders", hmacToken("k1", partnerSecret, "acme", "orders"), 200, `"acme"`},
+		{"/reports", hmacToken("k1", staffSecret, "alice", "reports"), 200, `"alice"`},
+		{"/orders", hmacToken("k1", staffSecret, "alice", "orders"), 401, ""},
+		{"/reports", hmacToken("k1", partnerSecret, "acme", "reports"), 401, ""},
+		{"/orders", hmacToken("k1", partnerSecret, "acme", "invoices"), 403, ""},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 1000)
+	for i := 0; i < 40; i++ {
+		for _, tc := range cases {
+			wg.Add(1)
+			go func(path string, token string, code int, body string) {
+				defer wg.Done()
+				req, _ := http.NewRequest("GET", srv.URL + "/jwt-service" + path, nil)
+				req.Header.Set("Authorization", "Bearer " + token)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					errs <- err.Error()
+					return
+				}
+				defer resp.Body.Close()
+				data, _ := ioutil.ReadAll(resp.Body)
+				if resp.StatusCode != code || (body != "" && strings.TrimSpace(string(data)) != body) {
+					errs <- fmt.Sprintf("%s: got %d %s, expected %d %s", path, resp.StatusCode, data, code, body)
+				}
+			}(tc.path, tc.token, tc.code, tc.body)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestJWTSchemeBinding(t *testing.T) {
+	a := NewJWT(JWTOptions{Scheme: "Bound"})
+	if result := a.Authorize("", "Other", nil, "GET", nil); result.Decision != gorest.AuthUnauthenticated {
+		t.Error("authorizer bound to one scheme allowed another")
+	}
+}
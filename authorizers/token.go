@@ -0,0 +1,516 @@
+package authorizers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rmullinnix461332/logger"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Who a token is issued to, and the scopes it may be granted
+type TokenSubject struct {
+	Subject		string
+	Scopes		[]string
+	Claims		map[string]interface{} // added to the access token
+}
+
+//Checks a client's credentials for the client_credentials grant, and client authentication on any grant
+type ClientVerifier func(clientID string, clientSecret string) (TokenSubject, bool)
+
+//Checks a resource owner's credentials for the password grant
+type CredentialVerifier func(username string, password string) (TokenSubject, bool)
+
+//A refresh token's grant, tokens rotated from the same original grant share a Family
+type RefreshGrant struct {
+	Family		string
+	ClientID	string
+	Subject		TokenSubject
+	Scopes		[]string
+	Expires		time.Time
+	Used		bool // the token was already exchanged, presenting it again revokes the family
+}
+
+//Storage for refresh tokens and revoked access tokens
+type TokenStore interface {
+	SaveRefresh(token string, grant RefreshGrant)
+	LookupRefresh(token string) (RefreshGrant, bool) // the grant as stored, leaving it unused
+	UseRefresh(token string) (RefreshGrant, bool) // the grant as stored, marking it used
+	RevokeFamily(family string)
+	RevokeAccess(jti string, expires time.Time)
+	AccessRevoked(jti string) bool
+}
+
+//Configuration of a TokenService
+type TokenOptions struct {
+	Issuer		string
+	Audience	[]string
+	Method		jwt.SigningMethod
+	SigningKey	interface{}	// default the key given to SetSigningKey, the one NewToken signs with
+	KeyID		string		// kid header of issued tokens
+	AccessTTL	time.Duration	// default 15 minutes
+	RefreshTTL	time.Duration	// default 24 hours, a negative value issues no refresh tokens
+	Clients		ClientVerifier	// required for client_credentials; when set every request must authenticate the client
+	Users		CredentialVerifier	// required for the password grant
+	Store		TokenStore	// default in memory
+}
+
+//OAuth2 token endpoint (RFC 6749) issuing jwts the oauth2 jwt authorizer accepts.
+//Mount it, and RevokeHandler, next to gorest.Handle(), e.g. http.Handle("/oauth/token", ts)
+type TokenService struct {
+	opts		TokenOptions
+}
+
+type tokenError struct {
+	code		int
+	Error		string	`json:"error"`
+	Description	string	`json:"error_description,omitempty"`
+}
+
+//Creates a token service, Method is required and SigningKey unless SetSigningKey was called
+func NewTokenService(opts TokenOptions) *TokenService {
+	if opts.SigningKey == nil {
+		if key := schemeJWT("").getKey("sign"); key != nil {
+			opts.SigningKey = key.key
+		}
+	}
+	if opts.Method == nil || opts.SigningKey == nil {
+		logger.Error.Panicln("[sec] token service needs a signing method and key")
+	}
+	if opts.AccessTTL == 0 {
+		opts.AccessTTL = 15 * time.Minute
+	}
+	if opts.RefreshTTL == 0 {
+		opts.RefreshTTL = 24 * time.Hour
+	}
+	if opts.Store == nil {
+		opts.Store = NewMemoryTokenStore()
+	}
+	return &TokenService{opts: opts}
+}
+
+//Reports whether the access token with the jti was revoked, for JWTOptions.Revoked
+func (ts *TokenService) Revoked(jti string) bool {
+	return ts.opts.Store.AccessRevoked(jti)
+}
+
+//The token endpoint, a POST of application/x-www-form-urlencoded parameters
+func (ts *TokenService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeTokenJSON(w, http.StatusMethodNotAllowed, tokenError{Error: "invalid_request", Description: "token requests must be POSTed"})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(w, tokenError{code: http.StatusBadRequest, Error: "invalid_request", Description: err.Error()})
+		return
+	}
+
+	clientID, client, terr := ts.authenticateClient(r)
+	if terr != nil {
+		writeTokenError(w, *terr)
+		return
+	}
+
+	var resp map[string]interface{}
+	switch r.PostForm.Get("grant_type") {
+	case "client_credentials":
+		resp, terr = ts.clientCredentials(clientID, client, r)
+	case "password":
+		resp, terr = ts.password(clientID, r)
+	case "refresh_token":
+		resp, terr = ts.refresh(clientID, r)
+	case "":
+		terr = &tokenError{code: http.StatusBadRequest, Error: "invalid_request", Description: "grant_type is required"}
+	default:
+		terr = &tokenError{code: http.StatusBadRequest, Error: "unsupported_grant_type"}
+	}
+
+	if terr != nil {
+		writeTokenError(w, *terr)
+		return
+	}
+	writeTokenJSON(w, http.StatusOK, resp)
+}
+
+//The revocation endpoint (RFC 7009), accepts refresh tokens and access tokens issued by the service
+func (ts *TokenService) RevokeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeTokenJSON(w, http.StatusMethodNotAllowed, tokenError{Error: "invalid_request"})
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeTokenError(w, tokenError{code: http.StatusBadRequest, Error: "invalid_request", Description: err.Error()})
+			return
+		}
+		clientID, _, terr := ts.authenticateClient(r)
+		if terr != nil {
+			writeTokenError(w, *terr)
+			return
+		}
+
+		// a client may only revoke its own tokens (RFC 7009 2.1)
+		if !ts.revoke(r.PostForm.Get("token"), clientID, false) {
+			writeTokenError(w, tokenError{code: http.StatusBadRequest, Error: "invalid_request", Description: "token was issued to another client"})
+			return
+		}
+		// unknown and already revoked tokens are not an error
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+//Revokes a refresh token, with every token rotated from the same grant, or an access token, whichever client
+//it was issued to
+func (ts *TokenService) Revoke(token string) {
+	ts.revoke(token, "", true)
+}
+
+// false when the token was issued to another client than clientID, unless any client may revoke it
+func (ts *TokenService) revoke(token string, clientID string, anyClient bool) bool {
+	if token == "" {
+		return true
+	}
+
+	if grant, found := ts.opts.Store.LookupRefresh(token); found {
+		if !anyClient && grant.ClientID != clientID {
+			return false
+		}
+		ts.opts.Store.RevokeFamily(grant.Family)
+		return true
+	}
+
+	jwtToken, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		if t.Method.Alg() != ts.opts.Method.Alg() {
+			return nil, errors.New("invalid signing method")
+		}
+		return verificationKey(ts.opts.SigningKey), nil
+	})
+	if err != nil {
+		return true
+	}
+	claims, _ := jwtToken.Claims.(jwt.MapClaims)
+	if issuedTo, _ := claims["client_id"].(string); !anyClient && issuedTo != clientID {
+		return false
+	}
+	if jti, ok := claims["jti"].(string); ok {
+		expires := time.Now().Add(ts.opts.AccessTTL)
+		if exp, found, _ := numericClaim(claims, "exp"); found {
+			expires = exp
+		}
+		ts.opts.Store.RevokeAccess(jti, expires)
+	}
+	return true
+}
+
+// the authenticated client, from HTTP Basic or the client_id and client_secret parameters
+func (ts *TokenService) authenticateClient(r *http.Request) (string, TokenSubject, *tokenError) {
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	if ts.opts.Clients == nil {
+		return clientID, TokenSubject{}, nil
+	}
+	if clientID == "" {
+		return "", TokenSubject{}, &tokenError{code: http.StatusUnauthorized, Error: "invalid_client", Description: "client authentication is required"}
+	}
+	client, ok := ts.opts.Clients(clientID, secret)
+	if !ok {
+		return "", TokenSubject{}, &tokenError{code: http.StatusUnauthorized, Error: "invalid_client"}
+	}
+	return clientID, client, nil
+}
+
+func (ts *TokenService) clientCredentials(clientID string, client TokenSubject, r *http.Request) (map[string]interface{}, *tokenError) {
+	if ts.opts.Clients == nil {
+		return nil, &tokenError{code: http.StatusBadRequest, Error: "unsupported_grant_type"}
+	}
+	if client.Subject == "" {
+		client.Subject = clientID
+	}
+
+	scopes, terr := grantedScopes(r.PostForm.Get("scope"), client.Scopes)
+	if terr != nil {
+		return nil, terr
+	}
+	// no refresh token for client credentials (RFC 6749 4.4.3)
+	return ts.issue(clientID, client, scopes, "", false)
+}
+
+func (ts *TokenService) password(clientID string, r *http.Request) (map[string]interface{}, *tokenError) {
+	if ts.opts.Users == nil {
+		return nil, &tokenError{code: http.StatusBadRequest, Error: "unsupported_grant_type"}
+	}
+	username := r.PostForm.Get("username")
+	if username == "" {
+		return nil, &tokenError{code: http.StatusBadRequest, Error: "invalid_request", Description: "username and password are required"}
+	}
+	subject, ok := ts.opts.Users(username, r.PostForm.Get("password"))
+	if !ok {
+		return nil, &tokenError{code: http.StatusBadRequest, Error: "invalid_grant", Description: "invalid resource owner credentials"}
+	}
+	if subject.Subject == "" {
+		subject.Subject = username
+	}
+
+	scopes, terr := grantedScopes(r.PostForm.Get("scope"), subject.Scopes)
+	if terr != nil {
+		return nil, terr
+	}
+	return ts.issue(clientID, subject, scopes, "", true)
+}
+
+func (ts *TokenService) refresh(clientID string, r *http.Request) (map[string]interface{}, *tokenError) {
+	token := r.PostForm.Get("refresh_token")
+	if token == "" {
+		return nil, &tokenError{code: http.StatusBadRequest, Error: "invalid_request", Description: "refresh_token is required"}
+	}
+
+	grant, found := ts.opts.Store.LookupRefresh(token)
+	if !found || time.Now().After(grant.Expires) {
+		return nil, &tokenError{code: http.StatusBadRequest, Error: "invalid_grant", Description: "refresh token is invalid or expired"}
+	}
+	// checked before the token is used, another client can not burn it
+	if grant.ClientID != clientID {
+		return nil, &tokenError{code: http.StatusBadRequest, Error: "invalid_grant", Description: "refresh token was issued to another client"}
+	}
+
+	grant, found = ts.opts.Store.UseRefresh(token)
+	if !found {
+		return nil, &tokenError{code: http.StatusBadRequest, Error: "invalid_grant", Description: "refresh token is invalid or expired"}
+	}
+	if grant.Used {
+		// a rotated token came back, it may have been stolen - revoke everything issued from the grant
+		ts.opts.Store.RevokeFamily(grant.Family)
+		logger.Warning.Println("[sec] token service: reuse of refresh token for " + grant.Subject.Subject + ", grant revoked")
+		return nil, &tokenError{code: http.StatusBadRequest, Error: "invalid_grant", Description: "refresh token is invalid or expired"}
+	}
+
+	// a refresh may narrow, never widen, the original scopes
+	scopes, terr := grantedScopes(r.PostForm.Get("scope"), grant.Scopes)
+	if terr != nil {
+		return nil, terr
+	}
+	return ts.issue(clientID, grant.Subject, scopes, grant.Family, true)
+}
+
+func (ts *TokenService) issue(clientID string, subject TokenSubject, scopes []string, family string, withRefresh bool) (map[string]interface{}, *tokenError) {
+	now := time.Now()
+
+	claims := jwt.MapClaims{}
+	for key, value := range subject.Claims {
+		claims[key] = value
+	}
+	claims["sub"] = subject.Subject
+	claims["user"] = subject.Subject
+	claims["scope"] = strings.Join(scopes, " ")
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ts.opts.AccessTTL).Unix()
+	claims["jti"] = randomToken()
+	if ts.opts.Issuer != "" {
+		claims["iss"] = ts.opts.Issuer
+	}
+	if len(ts.opts.Audience) == 1 {
+		claims["aud"] = ts.opts.Audience[0]
+	} else if len(ts.opts.Audience) > 1 {
+		claims["aud"] = ts.opts.Audience
+	}
+	if clientID != "" {
+		claims["client_id"] = clientID
+	}
+
+	signed, err := signToken(jwt.NewWithClaims(ts.opts.Method, claims), ts.opts.SigningKey, ts.opts.KeyID)
+	if err != nil {
+		logger.Error.Println("[sec] token service: signing failed: " + err.Error())
+		return nil, &tokenError{code: http.StatusInternalServerError, Error: "server_error"}
+	}
+
+	resp := map[string]interface{}{
+		"access_token":	signed,
+		"token_type":	"Bearer",
+		"expires_in":	int64(ts.opts.AccessTTL / time.Second),
+		"scope":	strings.Join(scopes, " "),
+	}
+
+	if withRefresh && ts.opts.RefreshTTL > 0 {
+		if family == "" {
+			family = randomToken()
+		}
+		refresh := randomToken()
+		ts.opts.Store.SaveRefresh(refresh, RefreshGrant{
+			Family:		family,
+			ClientID:	clientID,
+			Subject:	subject,
+			Scopes:		scopes,
+			Expires:	now.Add(ts.opts.RefreshTTL),
+		})
+		resp["refresh_token"] = refresh
+	}
+
+	return resp, nil
+}
+
+// the requested space delimited scopes, all of allowed when none are requested
+func grantedScopes(requested string, allowed []string) ([]string, *tokenError) {
+	if requested == "" {
+		return allowed, nil
+	}
+
+	scopes := strings.Fields(requested)
+	for i := range scopes {
+		if !containsAny(allowed, scopes[i:i+1]) {
+			return nil, &tokenError{code: http.StatusBadRequest, Error: "invalid_scope", Description: "scope " + scopes[i] + " is not granted"}
+		}
+	}
+	return scopes, nil
+}
+
+// the public half of an asymmetric signing key
+func verificationKey(key interface{}) interface{} {
+	if signer, ok := key.(interface{ Public() crypto.PublicKey }); ok {
+		return signer.Public()
+	}
+	return key
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		logger.Error.Panicln("[sec] token service: no randomness: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeTokenError(w http.ResponseWriter, terr tokenError) {
+	if terr.code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+	}
+	writeTokenJSON(w, terr.code, terr)
+}
+
+func writeTokenJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+//TokenStore kept in memory, for a single instance and for tests
+type MemoryTokenStore struct {
+	mu		sync.Mutex
+	refresh		map[string]RefreshGrant
+	revokedFamily	map[string]time.Time
+	revokedAccess	map[string]time.Time
+	nextPrune	time.Time
+}
+
+// how often expired tokens and revocations are dropped
+const tokenPruneInterval = time.Minute
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		refresh:	make(map[string]RefreshGrant),
+		revokedFamily:	make(map[string]time.Time),
+		revokedAccess:	make(map[string]time.Time),
+	}
+}
+
+func (m *MemoryTokenStore) SaveRefresh(token string, grant RefreshGrant) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now := time.Now(); now.After(m.nextPrune) {
+		m.prune(now)
+		m.nextPrune = now.Add(tokenPruneInterval)
+	}
+	m.refresh[token] = grant
+}
+
+func (m *MemoryTokenStore) LookupRefresh(token string) (RefreshGrant, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	grant, found := m.refresh[token]
+	if !found {
+		return grant, false
+	}
+	if _, revoked := m.revokedFamily[grant.Family]; revoked {
+		return RefreshGrant{}, false
+	}
+	return grant, true
+}
+
+func (m *MemoryTokenStore) UseRefresh(token string) (RefreshGrant, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	grant, found := m.refresh[token]
+	if !found {
+		return grant, false
+	}
+	if _, revoked := m.revokedFamily[grant.Family]; revoked {
+		return RefreshGrant{}, false
+	}
+	used := grant
+	used.Used = true
+	m.refresh[token] = used
+	return grant, true
+}
+
+func (m *MemoryTokenStore) RevokeFamily(family string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expires := time.Now()
+	for token, grant := range m.refresh {
+		if grant.Family == family {
+			if grant.Expires.After(expires) {
+				expires = grant.Expires
+			}
+			delete(m.refresh, token)
+		}
+	}
+	m.revokedFamily[family] = expires
+}
+
+func (m *MemoryTokenStore) RevokeAccess(jti string, expires time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revokedAccess[jti] = expires
+}
+
+func (m *MemoryTokenStore) AccessRevoked(jti string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, revoked := m.revokedAccess[jti]
+	return revoked
+}
+
+// drops what has expired, a revoked token past its expiry is refused anyway
+func (m *MemoryTokenStore) prune(now time.Time) {
+	for token, grant := range m.refresh {
+		if now.After(grant.Expires) {
+			delete(m.refresh, token)
+		}
+	}
+	for family, expires := range m.revokedFamily {
+		if now.After(expires) {
+			delete(m.revokedFamily, family)
+		}
+	}
+	for jti, expires := range m.revokedAccess {
+		if now.After(expires) {
+			delete(m.revokedAccess, jti)
+		}
+	}
+}
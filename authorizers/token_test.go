@@ -0,0 +1,248 @@
+package authorizers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rmullinnix461332/gorest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTokenService(t *testing.T) (*TokenService, *rsa.PrivateKey, *httptest.Server) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ts := NewTokenService(TokenOptions{
+		Issuer:		"https://issuer.example",
+		Audience:	[]string{"orders"},
+		Method:		jwt.SigningMethodRS256,
+		SigningKey:	key,
+		KeyID:		"2024-1",
+		Clients: func(id string, secret string) (TokenSubject, bool) {
+			if id == "portal" && secret == "portal-secret" {
+				return TokenSubject{Scopes: []string{"orders", "reports"}}, true
+			}
+			if id == "partner" && secret == "partner-secret" {
+				return TokenSubject{Scopes: []string{"orders"}}, true
+			}
+			return TokenSubject{}, false
+		},
+		Users: func(username string, password string) (TokenSubject, bool) {
+			if username == "bob" && password == "hunter2" {
+				return TokenSubject{Subject: "user-42", Scopes: []string{"orders"}, Claims: map[string]interface{}{"tenant": "acme"}}, true
+			}
+			return TokenSubject{}, false
+		},
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/token", ts)
+	mux.Handle("/revoke", ts.RevokeHandler())
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return ts, key, srv
+}
+
+func postForm(t *testing.T, url string, form url.Values) (int, map[string]interface{}) {
+	return postFormAs(t, url, form, "portal", "portal-secret")
+}
+
+func postFormAs(t *testing.T, url string, form url.Values, clientID string, secret string) (int, map[string]interface{}) {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body := make(map[string]interface{})
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func TestTokenClientCredentials(t *testing.T) {
+	_, key, srv := newTestTokenService(t)
+
+	code, body := postForm(t, srv.URL + "/token", url.Values{"grant_type": {"client_credentials"}, "scope": {"reports"}})
+	if code != 200 {
+		t.Fatal("client_credentials:", code, body)
+	}
+	if _, found := body["refresh_token"]; found {
+		t.Error("client_credentials issued a refresh token")
+	}
+
+	token, err := jwt.Parse(body["access_token"].(string), func(*jwt.Token) (interface{}, error) { return &key.PublicKey, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if token.Header["kid"] != "2024-1" || claims["sub"] != "portal" || claims["scope"] != "reports" || claims["iss"] != "https://issuer.example" || claims["aud"] != "orders" {
+		t.Error("unexpected token:", token.Header, claims)
+	}
+
+	if code, body = postForm(t, srv.URL + "/token", url.Values{"grant_type": {"client_credentials"}, "scope": {"admin"}}); code != 400 || body["error"] != "invalid_scope" {
+		t.Error("scope beyond the client's:", code, body)
+	}
+}
+
+func TestTokenClientAuthentication(t *testing.T) {
+	_, _, srv := newTestTokenService(t)
+
+	form := url.Values{"grant_type": {"client_credentials"}, "client_id": {"portal"}, "client_secret": {"wrong"}}
+	resp, _ := http.PostForm(srv.URL + "/token", form)
+	resp.Body.Close()
+	if resp.StatusCode != 401 || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Error("bad client secret:", resp.StatusCode)
+	}
+}
+
+func TestTokenPasswordAndRefreshRotation(t *testing.T) {
+	_, _, srv := newTestTokenService(t)
+
+	code, body := postForm(t, srv.URL + "/token", url.Values{"grant_type": {"password"}, "username": {"bob"}, "password": {"wrong"}})
+	if code != 400 || body["error"] != "invalid_grant" {
+		t.Error("bad password:", code, body)
+	}
+
+	code, body = postForm(t, srv.URL + "/token", url.Values{"grant_type": {"password"}, "username": {"bob"}, "password": {"hunter2"}})
+	if code != 200 {
+		t.Fatal("password:", code, body)
+	}
+	first := body["refresh_token"].(string)
+
+	code, body = postForm(t, srv.URL + "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first}})
+	if code != 200 {
+		t.Fatal("refresh:", code, body)
+	}
+	second := body["refresh_token"].(string)
+	if second == first {
+		t.Error("refresh token was not rotated")
+	}
+
+	// the rotated token is presented again - the whole grant is revoked
+	if code, body = postForm(t, srv.URL + "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first}}); code != 400 || body["error"] != "invalid_grant" {
+		t.Error("reused refresh token:", code, body)
+	}
+	if code, body = postForm(t, srv.URL + "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {second}}); code != 400 {
+		t.Error("refresh token of a revoked grant:", code, body)
+	}
+}
+
+func TestTokenRevocation(t *testing.T) {
+	ts, key, srv := newTestTokenService(t)
+
+	_, body := postForm(t, srv.URL + "/token", url.Values{"grant_type": {"password"}, "username": {"bob"}, "password": {"hunter2"}})
+	access := body["access_token"].(string)
+	refresh := body["refresh_token"].(string)
+
+	a := NewJWT(JWTOptions{
+		Scheme:		"Issued",
+		Keys:		map[string]JWTKey{"2024-1": {&key.PublicKey, "RSA"}},
+		Validation:	JWTValidation{Issuers: []string{"https://issuer.example"}, Audiences: []string{"orders"}},
+		Revoked:	ts.Revoked,
+	})
+
+	if code, _ := postForm(t, srv.URL + "/revoke", url.Values{"token": {access}}); code != 200 {
+		t.Error("revoke access token:", code)
+	}
+	if result := a.Authorize(access, "Issued", []string{"orders"}, "GET", nil); result.Decision != gorest.AuthUnauthenticated || result.Reason != "token revoked" {
+		t.Error("revoked access token:", result)
+	}
+
+	if code, _ := postForm(t, srv.URL + "/revoke", url.Values{"token": {refresh}}); code != 200 {
+		t.Error("revoke refresh token:", code)
+	}
+	if code, body := postForm(t, srv.URL + "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}}); code != 400 {
+		t.Error("revoked refresh token:", code, body)
+	}
+
+	if code, _ := postForm(t, srv.URL + "/revoke", url.Values{"token": {"unknown"}}); code != 200 {
+		t.Error("unknown tokens are not an error:", code)
+	}
+}
+
+func TestTokenOtherClient(t *testing.T) {
+	_, _, srv := newTestTokenService(t)
+
+	_, body := postForm(t, srv.URL + "/token", url.Values{"grant_type": {"password"}, "username": {"bob"}, "password": {"hunter2"}})
+	access := body["access_token"].(string)
+	refresh := body["refresh_token"].(string)
+
+	// another client can neither use, revoke nor burn the tokens
+	if code, body := postFormAs(t, srv.URL + "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}}, "partner", "partner-secret"); code != 400 || body["error"] != "invalid_grant" {
+		t.Error("refresh by another client:", code, body)
+	}
+	if code, body := postFormAs(t, srv.URL + "/revoke", url.Values{"token": {refresh}}, "partner", "partner-secret"); code != 400 {
+		t.Error("refresh token revoked by another client:", code, body)
+	}
+	if code, body := postFormAs(t, srv.URL + "/revoke", url.Values{"token": {access}}, "partner", "partner-secret"); code != 400 {
+		t.Error("access token revoked by another client:", code, body)
+	}
+
+	if code, body := postForm(t, srv.URL + "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}}); code != 200 {
+		t.Error("refresh by the owning client:", code, body)
+	}
+}
+
+func TestMemoryTokenStorePrune(t *testing.T) {
+	store := NewMemoryTokenStore()
+	past := time.Now().Add(-time.Second)
+
+	store.SaveRefresh("first", RefreshGrant{Family: "a", Expires: time.Now().Add(time.Hour)})
+	store.SaveRefresh("expired", RefreshGrant{Family: "b", Expires: past})
+	store.RevokeAccess("jti", past)
+
+	// saves within the interval leave expired entries for the next prune
+	store.SaveRefresh("second", RefreshGrant{Family: "c", Expires: time.Now().Add(time.Hour)})
+	if _, found := store.refresh["expired"]; !found {
+		t.Error("pruned before the interval passed")
+	}
+
+	store.nextPrune = past
+	store.SaveRefresh("third", RefreshGrant{Family: "d", Expires: time.Now().Add(time.Hour)})
+	if _, found := store.refresh["expired"]; found {
+		t.Error("expired refresh token was not pruned")
+	}
+	if store.AccessRevoked("jti") {
+		t.Error("expired revocation was not pruned")
+	}
+	if _, found := store.LookupRefresh("first"); !found {
+		t.Error("live refresh token was pruned")
+	}
+}
+
+func TestTokenServiceDefaultKey(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	SetSigningKey(key)
+
+	ts := NewTokenService(TokenOptions{
+		Method:	jwt.SigningMethodRS256,
+		Clients: func(id string, secret string) (TokenSubject, bool) {
+			return TokenSubject{Scopes: []string{"orders"}}, id == "portal" && secret == "portal-secret"
+		},
+	})
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+
+	code, body := postForm(t, srv.URL, url.Values{"grant_type": {"client_credentials"}})
+	if code != 200 {
+		t.Fatal("client_credentials:", code, body)
+	}
+	legacy, err := NewToken(jwt.SigningMethodRS256, "bob", "uuid-42", []string{"orders"}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the service and NewToken sign with the same key
+	for _, signed := range []string{body["access_token"].(string), legacy} {
+		if _, err := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) { return &key.PublicKey, nil }); err != nil {
+			t.Error("not signed with the SetSigningKey key:", err)
+		}
+	}
+}
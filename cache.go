@@ -0,0 +1,358 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/rmullinnix461332/logger"
+)
+
+//A response kept by the cache tag, with the headers the endpoint method set
+type CachedResponse struct {
+	Header		http.Header
+	Body		[]byte
+	Stored		time.Time
+	Expires		time.Time
+}
+
+//Backend of the response cache. Keys of one endpoint and path share a prefix, which DeletePrefix removes.
+//Get may return expired responses, they are not served.
+type ResponseCache interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, resp *CachedResponse)
+	DeletePrefix(prefix string)
+}
+
+// cache:"30s" or cache:"5m, private"
+type cacheOptions struct {
+	ttl		time.Duration
+	private		bool		// one entry per principal
+}
+
+type cacheFlight struct {
+	done		chan struct{}
+	resp		*CachedResponse
+}
+
+var cacheMu sync.Mutex
+var responseCache ResponseCache = NewMemoryResponseCache(64 << 20)
+var cacheFlights = make(map[string]*cacheFlight)
+
+// how long a miss waits on the same miss in flight before calling the method itself
+const cacheFlightWait = 5 * time.Second
+
+//Replaces the in-memory response cache, e.g. with one shared by every instance of the service
+func SetResponseCache(cache ResponseCache) {
+	if cache == nil {
+		logger.Error.Panicln("[gen] SetResponseCache needs a ResponseCache")
+	}
+	cacheMu.Lock()
+	responseCache = cache
+	cacheMu.Unlock()
+}
+
+func getResponseCache() ResponseCache {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	return responseCache
+}
+
+//Removes the cached responses of the GET endpoint serving url, for every query, mime type and principal
+//unless the url has a query. Write endpoints call it for the resources they change:
+//
+//	gorest.InvalidateCache("/orders-service/orders/" + strconv.Itoa(id))
+//	gorest.InvalidateCache("/orders-service/orders")
+func InvalidateCache(url string) {
+	ep, args, queryArgs, _, found := getEndPointByUrl(GET, url)
+	if !found || ep.cache == nil {
+		return
+	}
+
+	prefix := ep.Signiture + "\n" + encodeCacheArgs(args) + "\n"
+	if strings.Contains(url, "?") {
+		prefix += encodeCacheArgs(queryArgs) + "\n"
+	}
+	getResponseCache().DeletePrefix(prefix)
+}
+
+//Removes every cached response
+func PurgeCache() {
+	getResponseCache().DeletePrefix("")
+}
+
+func parseCacheTag(tag string) (*cacheOptions, error) {
+	parts := strings.Split(tag, ",")
+	ttl, err := time.ParseDuration(strings.TrimSpace(parts[0]))
+	if err != nil || ttl <= 0 {
+		return nil, errors.New("invalid duration " + parts[0])
+	}
+
+	opts := &cacheOptions{ttl: ttl}
+	for _, option := range parts[1:] {
+		switch option = strings.TrimSpace(option); option {
+		case "private":
+			opts.private = true
+		default:
+			return nil, errors.New("unknown option " + option)
+		}
+	}
+	return opts, nil
+}
+
+// method and path template, then the path args, query args, negotiated mime and principal. Endpoints with
+// security, roles or a realm are always cached per principal, false when the caller can not be told apart.
+func cacheKey(rb *ResponseBuilder, ep EndPointStruct, realm string, args map[string]string, queryArgs map[string]string, mime string) (string, bool) {
+	key := ep.Signiture + "\n" + encodeCacheArgs(args) + "\n" + encodeCacheArgs(queryArgs) + "\n" + mime + "\n"
+	if ep.cache.private || len(ep.Security) > 0 || len(ep.Roles) > 0 || realm != "" {
+		caller := rb.Session().UserID()
+		if p := rb.Session().Principal(); p != nil && p.Subject != "" {
+			caller = p.Subject
+		}
+		if caller == "" {
+			return "", false
+		}
+		key += caller
+	}
+	return key, true
+}
+
+func encodeCacheArgs(args map[string]string) string {
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make(url.Values)
+	encoded := make([]string, 0, len(names))
+	for _, name := range names {
+		values.Set(name, args[name])
+		encoded = append(encoded, values.Encode())
+		values.Del(name)
+	}
+	return strings.Join(encoded, "&")
+}
+
+// a fresh cached response, or the function the caller must pass its response to once the method returns.
+// Concurrent misses on a key wait for the first one instead of all calling the method.
+func lookupCache(key string) (*CachedResponse, func(*CachedResponse)) {
+	cache := getResponseCache()
+	if resp, found := cache.Get(key); found && time.Now().Before(resp.Expires) {
+		return resp, nil
+	}
+
+	cacheMu.Lock()
+	if flight, found := cacheFlights[key]; found {
+		cacheMu.Unlock()
+		timer := time.NewTimer(cacheFlightWait)
+		defer timer.Stop()
+		select {
+		case <-flight.done:
+		case <-timer.C:
+			// the request holds its concurrency slots while it waits, a slow method is not waited on for long
+			return nil, func(*CachedResponse) {}
+		}
+		if flight.resp != nil {
+			return flight.resp, nil
+		}
+		// nothing cacheable came back, the method is called again without waiting on each other
+		return nil, func(*CachedResponse) {}
+	}
+	flight := &cacheFlight{done: make(chan struct{})}
+	cacheFlights[key] = flight
+	cacheMu.Unlock()
+
+	return nil, func(resp *CachedResponse) {
+		if resp != nil {
+			cache.Set(key, resp)
+		}
+		cacheMu.Lock()
+		delete(cacheFlights, key)
+		cacheMu.Unlock()
+		flight.resp = resp
+		close(flight.done)
+	}
+}
+
+// the response the method produced, when it was a 200 with a body. before holds the headers from before the call.
+func captureResponse(rb *ResponseBuilder, before http.Header, ttl time.Duration) *CachedResponse {
+	if rb.ctx.respPacket == nil || (rb.ctx.responseCode != 0 && rb.ctx.responseCode != http.StatusOK) {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(rb.ctx.respPacket)
+	rb.ctx.respPacket.Close()
+	rb.ctx.respPacket = ioutil.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+
+	header := make(http.Header)
+	for name, values := range rb.writer().Header() {
+		if name == "Set-Cookie" || name == "X-Cache" || equalStrings(before[name], values) {
+			continue
+		}
+		header[name] = append([]string(nil), values...)
+	}
+
+	now := time.Now()
+	return &CachedResponse{Header: header, Body: data, Stored: now, Expires: now.Add(ttl)}
+}
+
+func serveCached(rb *ResponseBuilder, resp *CachedResponse) {
+	header := rb.writer().Header()
+	for name, values := range resp.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	if mime := resp.Header.Get("Content-Type"); mime != "" {
+		rb.SetContentType(mime)
+	}
+
+	age := int(time.Since(resp.Stored) / time.Second)
+	rb.SetHeader("Age", strconv.Itoa(age))
+	rb.SetHeader("X-Cache", "HIT")
+	rb.ctx.respPacket = ioutil.NopCloser(bytes.NewReader(resp.Body))
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//The default ResponseCache, least recently used responses are dropped once the bodies and keys
+//reach the size bound
+type MemoryResponseCache struct {
+	mu		sync.Mutex
+	maxBytes	int64
+	size		int64
+	order		*list.List
+	entries		map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key		string
+	resp		*CachedResponse
+	size		int64
+}
+
+func NewMemoryResponseCache(maxBytes int64) *MemoryResponseCache {
+	return &MemoryResponseCache{maxBytes: maxBytes, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (this *MemoryResponseCache) Get(key string) (*CachedResponse, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	elem, found := this.entries[key]
+	if !found {
+		return nil, false
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.resp.Expires) {
+		this.remove(elem)
+		return nil, false
+	}
+	this.order.MoveToFront(elem)
+	return entry.resp, true
+}
+
+func (this *MemoryResponseCache) Set(key string, resp *CachedResponse) {
+	size := int64(len(key) + len(resp.Body))
+	for name, values := range resp.Header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if elem, found := this.entries[key]; found {
+		this.remove(elem)
+	}
+	if size > this.maxBytes {
+		return
+	}
+	this.entries[key] = this.order.PushFront(&memoryCacheEntry{key: key, resp: resp, size: size})
+	this.size += size
+
+	for this.size > this.maxBytes {
+		this.remove(this.order.Back())
+	}
+}
+
+func (this *MemoryResponseCache) DeletePrefix(prefix string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for key, elem := range this.entries {
+		if strings.HasPrefix(key, prefix) {
+			this.remove(elem)
+		}
+	}
+}
+
+//The number of responses held and the bytes they take up
+func (this *MemoryResponseCache) Len() (int, int64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.entries), this.size
+}
+
+func (this *MemoryResponseCache) remove(elem *list.Element) {
+	entry := this.order.Remove(elem).(*memoryCacheEntry)
+	delete(this.entries, entry.key)
+	this.size -= entry.size
+}
+
+func countCache(ep EndPointStruct, hit bool) {
+	c := countersFor(ep)
+	if hit {
+		atomic.AddUint64(&c.cacheHits, 1)
+	} else {
+		atomic.AddUint64(&c.cacheMisses, 1)
+	}
+}
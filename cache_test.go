@@ -0,0 +1,236 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+package gorest
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type cacheTestService struct {
+	RestService	`root:"/cache-test-service/" consumes:"application/json" produces:"application/json"`
+	order		EndPoint	`method:"GET" path:"/orders/{id:int}?{view:string}" output:"string" cache:"30s"`
+}
+
+func (serv cacheTestService) Order(id int, view string) string {
+	return view
+}
+
+func cacheTestBuilder(principal *Principal, user string) *ResponseBuilder {
+	ctx := &Context{principal: principal}
+	ctx.sessData = SessionData{relSessionData: make(map[string]interface{}), ctx: ctx}
+	if user != "" {
+		ctx.sessData.relSessionData[SessionUserID] = user
+	}
+	return &ResponseBuilder{ctx: ctx}
+}
+
+func TestCacheKey(t *testing.T) {
+	public := EndPointStruct{Signiture: "GET /orders/{id}", cache: &cacheOptions{ttl: time.Minute}}
+	private := EndPointStruct{Signiture: "GET /orders/{id}", cache: &cacheOptions{ttl: time.Minute, private: true}}
+	secured := EndPointStruct{Signiture: "GET /orders/{id}", cache: &cacheOptions{ttl: time.Minute}, Security: []SecurityRequirement{{"Bearer": nil}}}
+	bob := cacheTestBuilder(&Principal{Subject: "bob"}, "")
+	alice := cacheTestBuilder(&Principal{Subject: "alice"}, "")
+	nobody := cacheTestBuilder(nil, "")
+	args := map[string]string{"id": "7"}
+
+	key := func(rb *ResponseBuilder, ep EndPointStruct, realm string, query map[string]string, mime string) string {
+		k, ok := cacheKey(rb, ep, realm, args, query, mime)
+		if !ok {
+			return "<none>"
+		}
+		return k
+	}
+
+	base := key(nobody, public, "", map[string]string{"a": "1", "b": "x y"}, "application/json")
+	if base != "GET /orders/{id}\nid=7\na=1&b=x+y\napplication/json\n" {
+		t.Errorf("key composition: %q", base)
+	}
+	if key(bob, public, "", map[string]string{"b": "x y", "a": "1"}, "application/json") != base {
+		t.Error("public key depends on the principal or the query order")
+	}
+	if key(nobody, public, "", map[string]string{"a": "1", "b": "x y"}, "application/xml") == base {
+		t.Error("key ignores the mime type")
+	}
+
+	cases := []struct {
+		name	string
+		rb	*ResponseBuilder
+		ep	EndPointStruct
+		realm	string
+		suffix	string
+	}{
+		{"private", bob, private, "", "bob"},
+		{"private other", alice, private, "", "alice"},
+		{"private by session user", cacheTestBuilder(nil, "carol"), private, "", "carol"},
+		{"secured without private", bob, secured, "", "bob"},
+		{"realm without private", alice, public, "testing", "alice"},
+		{"secured without a caller", nobody, secured, "", "<none>"},
+		{"private without a caller", nobody, private, "", "<none>"},
+	}
+	for _, tc := range cases {
+		k := key(tc.rb, tc.ep, tc.realm, nil, "application/json")
+		if !strings.HasSuffix(k, "\n" + tc.suffix) && k != tc.suffix {
+			t.Errorf("%s: %q, expected it to end in %q", tc.name, k, tc.suffix)
+		}
+	}
+}
+
+func TestCacheStampede(t *testing.T) {
+	SetResponseCache(NewMemoryResponseCache(1 << 20))
+	defer SetResponseCache(NewMemoryResponseCache(64 << 20))
+
+	cached, finish := lookupCache("stampede")
+	if cached != nil || finish == nil {
+		t.Fatal("first miss did not get to call the method")
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	calls, served := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cached, _ := lookupCache("stampede")
+			mu.Lock()
+			defer mu.Unlock()
+			if cached != nil && string(cached.Body) == "once" {
+				served++
+			} else {
+				calls++
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	finish(&CachedResponse{Body: []byte("once"), Stored: time.Now(), Expires: time.Now().Add(time.Minute)})
+	wg.Wait()
+	if calls != 0 || served != 20 {
+		t.Errorf("concurrent misses called the method %d times, %d served from the first call", calls, served)
+	}
+
+	// nothing cacheable: the waiters call the method themselves
+	_, finish = lookupCache("uncacheable")
+	done := make(chan bool)
+	go func() {
+		cached, next := lookupCache("uncacheable")
+		done <- cached == nil && next != nil
+	}()
+	time.Sleep(50 * time.Millisecond)
+	finish(nil)
+	if !<-done {
+		t.Error("waiter on an uncacheable response was not let through")
+	}
+}
+
+func TestInvalidateCache(t *testing.T) {
+	RegisterService(new(cacheTestService))
+	SetResponseCache(NewMemoryResponseCache(1 << 20))
+	defer SetResponseCache(NewMemoryResponseCache(64 << 20))
+
+	resp := &CachedResponse{Body: []byte("{}"), Stored: time.Now(), Expires: time.Now().Add(time.Minute)}
+	store := func(url string) string {
+		ep, args, queryArgs, _, found := getEndPointByUrl(GET, url)
+		if !found {
+			t.Fatal("no endpoint for", url)
+		}
+		key, _ := cacheKey(cacheTestBuilder(nil, ""), ep, "", args, queryArgs, "application/json")
+		getResponseCache().Set(key, resp)
+		return key
+	}
+	cached := func(key string) bool {
+		_, found := getResponseCache().Get(key)
+		return found
+	}
+
+	full := store("/cache-test-service/orders/7?view=full")
+	short := store("/cache-test-service/orders/7?view=short")
+	other := store("/cache-test-service/orders/8?view=full")
+
+	// with a query only that query's entries go
+	InvalidateCache("/cache-test-service/orders/7?view=full")
+	if cached(full) || !cached(short) || !cached(other) {
+		t.Error("invalidate with a query:", cached(full), cached(short), cached(other))
+	}
+
+	// without one every query of the path
+	store("/cache-test-service/orders/7?view=full")
+	InvalidateCache("/cache-test-service/orders/7")
+	if cached(full) || cached(short) || !cached(other) {
+		t.Error("invalidate the path:", cached(full), cached(short), cached(other))
+	}
+
+	PurgeCache()
+	if cached(other) {
+		t.Error("purge left an entry")
+	}
+}
+
+func TestMemoryResponseCacheEviction(t *testing.T) {
+	// each entry is its one byte key and 9 byte body
+	cache := NewMemoryResponseCache(30)
+	resp := func() *CachedResponse {
+		return &CachedResponse{Body: []byte("123456789"), Expires: time.Now().Add(time.Minute)}
+	}
+
+	cache.Set("a", resp())
+	cache.Set("b", resp())
+	cache.Set("c", resp())
+	if n, size := cache.Len(); n != 3 || size != 30 {
+		t.Fatal("filled cache:", n, size)
+	}
+
+	// a is used, so b is the least recently used
+	cache.Get("a")
+	cache.Set("d", resp())
+	if _, found := cache.Get("b"); found {
+		t.Error("least recently used entry was kept")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, found := cache.Get(key); !found {
+			t.Error("evicted", key)
+		}
+	}
+
+	// larger than the whole cache
+	cache.Set("e", &CachedResponse{Body: make([]byte, 64), Expires: time.Now().Add(time.Minute)})
+	if _, found := cache.Get("e"); found {
+		t.Error("entry larger than the cache was stored")
+	}
+
+	cache.Set("f", &CachedResponse{Body: []byte("123456789"), Expires: time.Now().Add(-time.Second)})
+	if _, found := cache.Get("f"); found {
+		t.Error("expired entry was served")
+	}
+	if n, _ := cache.Len(); n != 2 {
+		t.Error("expired entry was not dropped:", n)
+	}
+}
@@ -77,6 +77,7 @@ func NewRequestBuilderFromClient(client *http.Client, url string) (*RequestBuild
 	if err != nil {
 		return nil, err
 	}
+	addMimeType(Application_Json)
 	rb := RequestBuilder{client, Application_Json, req}
 	return &rb, nil
 }
@@ -93,6 +94,7 @@ func NewRequestBuilder(url string) (*RequestBuilder, error) {
 	if err != nil {
 		return nil, err
 	}
+	addMimeType(Application_Json)
 	rb := RequestBuilder{sharedClient, Application_Json, req}
 	return &rb, nil
 }
@@ -106,7 +108,10 @@ type RequestBuilder struct {
 func (this *RequestBuilder) Request() *http.Request {
 	return this._req
 }
+//Sets the mime type used to encode posted data and decode responses, e.g. application/x-protobuf or application/msgpack.
+//The built-in Marshaller for the mime type is registered if one is not already.
 func (this *RequestBuilder) UseContentType(mime string) *RequestBuilder {
+	addMimeType(mime)
 	this.defaultContentType = mime
 	return this
 }
@@ -150,6 +155,9 @@ func (this *RequestBuilder) Options(opts *[]string) (*http.Response, error) {
 func (this *RequestBuilder) Get(i interface{}, expecting int) (*http.Response, error) {
 	//this._req.URL = u
 	this._req.Method = GET
+	if this._req.Header.Get("Accept") == "" {
+		this._req.Header.Set("Accept", this.defaultContentType)
+	}
 
 	res, err := this.client.Do(this._req)
 	if err != nil {
@@ -178,6 +186,10 @@ func (this *RequestBuilder) PostWithResponse(i interface{}, output interface{})
 		return nil, err
 	}
 	this._req.Body = bb
+	this._req.Header.Set("Content-Type", this.defaultContentType)
+	if this._req.Header.Get("Accept") == "" {
+		this._req.Header.Set("Accept", this.defaultContentType)
+	}
 
 	res, err := this.client.Do(this._req)
 	if err != nil {
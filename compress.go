@@ -0,0 +1,290 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"github.com/andybalholm/brotli"
+	"github.com/rmullinnix461332/logger"
+)
+
+const (
+	EncodingBrotli	= "br"
+	EncodingGzip	= "gzip"
+	EncodingDeflate	= "deflate"
+)
+
+//Response compression for the endpoints with gzip:"true" (or whose service has it), and the decoding of
+//compressed request bodies
+type CompressionOptions struct {
+	MinSize		int		// smaller bodies are sent uncompressed, default 1024 bytes
+	Level		int		// gzip and deflate level, default gzip.DefaultCompression, brotli keeps its default quality
+	Encodings	[]string	// preferred first when the client accepts several equally, default br, gzip, deflate
+	MaxRequestBody	int64		// largest decompressed request body, default 10MB, larger ones are refused with 413
+}
+
+var compressionMu sync.Mutex
+var compression = defaultCompression()
+
+func defaultCompression() CompressionOptions {
+	return CompressionOptions{
+		MinSize:	1024,
+		Level:		gzip.DefaultCompression,
+		Encodings:	[]string{EncodingBrotli, EncodingGzip, EncodingDeflate},
+		MaxRequestBody:	10 << 20,
+	}
+}
+
+//Replaces the compression defaults, zero values keep them
+func SetCompressionOptions(opts CompressionOptions) {
+	defaults := defaultCompression()
+	if opts.MinSize == 0 {
+		opts.MinSize = defaults.MinSize
+	}
+	if opts.Level == 0 {
+		opts.Level = defaults.Level
+	}
+	if len(opts.Encodings) == 0 {
+		opts.Encodings = defaults.Encodings
+	}
+	if opts.MaxRequestBody == 0 {
+		opts.MaxRequestBody = defaults.MaxRequestBody
+	}
+	for _, encoding := range opts.Encodings {
+		if encoding != EncodingBrotli && encoding != EncodingGzip && encoding != EncodingDeflate {
+			logger.Error.Panicln("[gen] SetCompressionOptions: unsupported encoding " + encoding)
+		}
+	}
+
+	compressionMu.Lock()
+	compression = opts
+	compressionMu.Unlock()
+}
+
+func getCompression() CompressionOptions {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	return compression
+}
+
+// writes the packet in the encoding the client prefers, unless it is small or compressed already
+func (this *ResponseBuilder) writeCompressed() {
+	opts := getCompression()
+	header := this.writer().Header()
+	this.AddHeader("Vary", "Accept-Encoding")
+
+	encoding := ""
+	if header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) {
+		encoding = negotiateEncoding(this.ctx.request.Header.Get("Accept-Encoding"), opts.Encodings)
+	}
+
+	var head	[]byte
+	if encoding != "" {
+		head = make([]byte, opts.MinSize)
+		n, err := io.ReadFull(this.ctx.respPacket, head)
+		head = head[:n]
+		if err != nil {
+			// shorter than MinSize
+			encoding = ""
+		}
+	}
+
+	if encoding == "" {
+		this.writer().WriteHeader(this.ctx.responseCode)
+		this.writer().Write(head)
+		io.Copy(this.writer(), this.ctx.respPacket)
+		return
+	}
+
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+	// a strong etag names the exact bytes sent, so each encoding has its own
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, "\"") {
+		header.Set("ETag", strings.TrimSuffix(etag, "\"") + "-" + encoding + "\"")
+	}
+	this.writer().WriteHeader(this.ctx.responseCode)
+
+	encoder := newEncoder(this.writer(), encoding, opts.Level)
+	defer encoder.Close()
+	encoder.Write(head)
+	io.Copy(encoder, this.ctx.respPacket)
+}
+
+func newEncoder(w io.Writer, encoding string, level int) io.WriteCloser {
+	switch encoding {
+	case EncodingBrotli:
+		return brotli.NewWriter(w)
+	case EncodingDeflate:
+		if encoder, err := zlib.NewWriterLevel(w, level); err == nil {
+			return encoder
+		}
+		return zlib.NewWriter(w)
+	}
+	if encoder, err := gzip.NewWriterLevel(w, level); err == nil {
+		return encoder
+	}
+	return gzip.NewWriter(w)
+}
+
+// the supported encoding with the highest q value, ties go to the first of supported. Empty for identity.
+func negotiateEncoding(accept string, supported []string) string {
+	if accept == "" {
+		return ""
+	}
+
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == "x-gzip" {
+			name = EncodingGzip
+		}
+		qualities[name] = q
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, encoding := range supported {
+		q, found := qualities[encoding]
+		if !found {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	// identity preferred over everything on offer
+	if q, found := qualities["identity"]; found && q > bestQ {
+		return ""
+	}
+	return best
+}
+
+// false for media types whose formats are compressed already
+func compressible(contentType string) bool {
+	mime := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch {
+	case mime == "image/svg+xml":
+		return true
+	case strings.HasPrefix(mime, "image/"), strings.HasPrefix(mime, "audio/"), strings.HasPrefix(mime, "video/"):
+		return false
+	case strings.HasPrefix(mime, "font/woff"):
+		return false
+	}
+	switch mime {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/x-brotli", "application/x-bzip2",
+		"application/x-7z-compressed", "application/x-rar-compressed", "application/x-xz", "application/zstd":
+		return false
+	}
+	return true
+}
+
+// replaces a request body sent with Content-Encoding by its decoded form, answering 415 for encodings
+// that are not supported and 413 when the decoded body is over MaxRequestBody
+func decodeRequestBody(rb *ResponseBuilder) bool {
+	r := rb.ctx.request
+	contentEncoding := r.Header.Get("Content-Encoding")
+	if contentEncoding == "" || r.Body == nil {
+		return true
+	}
+
+	// listed in the order they were applied
+	encodings := strings.Split(contentEncoding, ",")
+	var body	io.Reader = r.Body
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err		error
+		switch encoding := strings.ToLower(strings.TrimSpace(encodings[i])); encoding {
+		case "identity":
+		case EncodingGzip, "x-gzip":
+			body, err = gzip.NewReader(body)
+		case EncodingDeflate:
+			body, err = zlib.NewReader(body)
+		case EncodingBrotli:
+			body = brotli.NewReader(body)
+		default:
+			rb.SetResponseCode(http.StatusUnsupportedMediaType)
+			rb.SetResponseMsg("Unsupported Content-Encoding " + encoding)
+			return false
+		}
+		if err != nil {
+			rb.SetResponseCode(http.StatusBadRequest)
+			rb.SetResponseMsg("Could not decode the request body: " + err.Error())
+			return false
+		}
+	}
+
+	max := getCompression().MaxRequestBody
+	data, err := ioutil.ReadAll(io.LimitReader(body, max + 1))
+	if err != nil {
+		rb.SetResponseCode(http.StatusBadRequest)
+		rb.SetResponseMsg("Could not decode the request body: " + err.Error())
+		return false
+	}
+	if int64(len(data)) > max {
+		rb.SetResponseCode(http.StatusRequestEntityTooLarge)
+		rb.SetResponseMsg("The decoded request body is too large")
+		return false
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	return true
+}
+
+// the etag without the encoding suffix added by writeCompressed
+func trimEncodingSuffix(etag string) string {
+	for _, encoding := range []string{EncodingBrotli, EncodingGzip, EncodingDeflate} {
+		if strings.HasSuffix(etag, "-" + encoding + "\"") {
+			return strings.TrimSuffix(etag, "-" + encoding + "\"") + "\""
+		}
+	}
+	return etag
+}
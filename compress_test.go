@@ -0,0 +1,177 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+package gorest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{EncodingBrotli, EncodingGzip, EncodingDeflate}
+	cases := []struct {
+		accept		string
+		encoding	string
+	}{
+		{"", ""},
+		{"gzip", EncodingGzip},
+		{"x-gzip", EncodingGzip},
+		{"GZIP, deflate", EncodingGzip},
+		{"gzip, br", EncodingBrotli},
+		{"br;q=0.5, gzip;q=0.8", EncodingGzip},
+		{"br;q=0.8, gzip;q=0.8", EncodingBrotli},
+		{"deflate, gzip;q=0", EncodingDeflate},
+		{"gzip;q=0", ""},
+		{"*", EncodingBrotli},
+		{"*;q=0.5, gzip", EncodingGzip},
+		{"compress", ""},
+		{"identity", ""},
+		{"gzip;q=0.5, identity", ""},
+		{"gzip, identity;q=0.5", EncodingGzip},
+		{"gzip;q=invalid", EncodingGzip},
+	}
+
+	for _, tc := range cases {
+		if encoding := negotiateEncoding(tc.accept, supported); encoding != tc.encoding {
+			t.Errorf("%q: expected %q, got %q", tc.accept, tc.encoding, encoding)
+		}
+	}
+
+	if encoding := negotiateEncoding("gzip, br", []string{EncodingGzip, EncodingBrotli}); encoding != EncodingGzip {
+		t.Error("ties go to the first supported encoding, got", encoding)
+	}
+}
+
+func compressTestBuilder(accept string, body []byte, etag string) (*ResponseBuilder, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", accept)
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "application/json")
+	if etag != "" {
+		rec.Header().Set("ETag", etag)
+	}
+	ctx := &Context{writer: rec, request: req, responseCode: http.StatusOK, respPacket: ioutil.NopCloser(bytes.NewReader(body))}
+	return &ResponseBuilder{ctx: ctx}, rec
+}
+
+func TestWriteCompressed(t *testing.T) {
+	min := getCompression().MinSize
+	large := bytes.Repeat([]byte("a"), min)
+
+	// smaller than MinSize
+	rb, rec := compressTestBuilder("gzip", large[:min - 1], `"v1"`)
+	rb.writeCompressed()
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() != min - 1 || rec.Header().Get("ETag") != `"v1"` {
+		t.Error("small body was compressed:", rec.Header())
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Error("uncompressed response without Vary")
+	}
+
+	rb, rec = compressTestBuilder("gzip", large, `"v1"`)
+	rb.writeCompressed()
+	if rec.Header().Get("Content-Encoding") != EncodingGzip || rec.Header().Get("ETag") != `"v1-gzip"` {
+		t.Error("compressed response:", rec.Header())
+	}
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(reader); !bytes.Equal(data, large) {
+		t.Error("body does not decompress to the original")
+	}
+	if trimEncodingSuffix(rec.Header().Get("ETag")) != `"v1"` {
+		t.Error("suffix not trimmed:", trimEncodingSuffix(rec.Header().Get("ETag")))
+	}
+
+	// a weak etag names the content, not the bytes
+	rb, rec = compressTestBuilder("gzip", large, `W/"v1"`)
+	rb.writeCompressed()
+	if rec.Header().Get("ETag") != `W/"v1"` {
+		t.Error("weak etag was suffixed:", rec.Header().Get("ETag"))
+	}
+
+	rb, rec = compressTestBuilder("identity", large, "")
+	rb.writeCompressed()
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() != min {
+		t.Error("identity response was compressed:", rec.Header())
+	}
+}
+
+func decodeTestBuilder(encoding string, body []byte) *ResponseBuilder {
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	req.Header.Set("Content-Encoding", encoding)
+	return &ResponseBuilder{ctx: &Context{request: req}}
+}
+
+func TestDecodeRequestBody(t *testing.T) {
+	var gzipped	bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write([]byte(`{"id":7}`))
+	writer.Close()
+
+	rb := decodeTestBuilder("gzip", gzipped.Bytes())
+	if !decodeRequestBody(rb) {
+		t.Fatal("gzip body refused:", rb.ctx.responseCode)
+	}
+	if data, _ := ioutil.ReadAll(rb.ctx.request.Body); string(data) != `{"id":7}` || rb.ctx.request.Header.Get("Content-Encoding") != "" {
+		t.Error("decoded body:", string(data), rb.ctx.request.Header)
+	}
+
+	rb = decodeTestBuilder("compress", []byte("x"))
+	if decodeRequestBody(rb) || rb.ctx.responseCode != http.StatusUnsupportedMediaType {
+		t.Error("unsupported encoding:", rb.ctx.responseCode)
+	}
+
+	rb = decodeTestBuilder("gzip", []byte("not gzip"))
+	if decodeRequestBody(rb) || rb.ctx.responseCode != http.StatusBadRequest {
+		t.Error("corrupt body:", rb.ctx.responseCode)
+	}
+
+	// a small body inflating past MaxRequestBody
+	defer SetCompressionOptions(defaultCompression())
+	SetCompressionOptions(CompressionOptions{MaxRequestBody: 1024})
+	gzipped.Reset()
+	writer = gzip.NewWriter(&gzipped)
+	writer.Write([]byte(strings.Repeat("a", 1025)))
+	writer.Close()
+
+	rb = decodeTestBuilder("gzip", gzipped.Bytes())
+	if decodeRequestBody(rb) || rb.ctx.responseCode != http.StatusRequestEntityTooLarge {
+		t.Error("decoded body over the limit:", rb.ctx.responseCode)
+	}
+	rb = decodeTestBuilder("identity, gzip", gzipped.Bytes())
+	if decodeRequestBody(rb) || rb.ctx.responseCode != http.StatusRequestEntityTooLarge {
+		t.Error("stacked encodings over the limit:", rb.ctx.responseCode)
+	}
+}
@@ -0,0 +1,295 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"errors"
+	"github.com/rmullinnix461332/logger"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Limits on the requests served at once, by the maxConcurrent tag on an endpoint or SetMaxConcurrent for the process
+type ConcurrencyOptions struct {
+	Max		int			// requests served at once
+	Queue		int			// requests waiting for a slot, default Max, beyond it they are shed
+	Timeout		time.Duration		// longest wait in the queue, default 1 second
+	Adaptive	bool			// lowers the limit (down to 1) while latency rises above its baseline, raises it back up to Max
+}
+
+var globalLimiter atomic.Value	// *concurrencyLimiter
+
+//Caps the requests served at once across every endpoint, Max of 0 removes the cap
+func SetMaxConcurrent(opts ConcurrencyOptions) {
+	if opts.Max <= 0 {
+		globalLimiter.Store((*concurrencyLimiter)(nil))
+		return
+	}
+	globalLimiter.Store(newConcurrencyLimiter(opts))
+}
+
+// maxConcurrent:"8" or maxConcurrent:"8, queue=16, timeout=2s, adaptive"
+func parseConcurrency(tag string) (ConcurrencyOptions, error) {
+	var opts	ConcurrencyOptions
+
+	parts := strings.Split(tag, ",")
+	max, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || max < 1 {
+		return opts, errors.New("invalid limit " + parts[0])
+	}
+	opts.Max = max
+	opts.Queue = -1
+
+	for _, option := range parts[1:] {
+		option = strings.TrimSpace(option)
+		if option == "adaptive" {
+			opts.Adaptive = true
+			continue
+		}
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return opts, errors.New("invalid option " + option)
+		}
+		switch kv[0] {
+		case "queue":
+			if opts.Queue, err = strconv.Atoi(kv[1]); err != nil || opts.Queue < 0 {
+				return opts, errors.New("invalid queue " + kv[1])
+			}
+		case "timeout":
+			if opts.Timeout, err = time.ParseDuration(kv[1]); err != nil || opts.Timeout <= 0 {
+				return opts, errors.New("invalid timeout " + kv[1])
+			}
+		default:
+			return opts, errors.New("unknown option " + kv[0])
+		}
+	}
+	return opts, nil
+}
+
+type concurrencyLimiter struct {
+	opts		ConcurrencyOptions
+
+	mu		sync.Mutex
+	limit		int
+	inFlight	int
+	waiters		[]chan struct{}
+	shed		uint64
+
+	// adaptive limiting, evaluated once per limit samples
+	baseline	time.Duration	// lowest latency of recent batches, the unloaded service time
+	batchMin	time.Duration
+	batchTotal	time.Duration
+	batchCount	int
+	batchFull	bool		// the limit was reached during the batch
+}
+
+func newConcurrencyLimiter(opts ConcurrencyOptions) *concurrencyLimiter {
+	if opts.Queue < 0 {
+		opts.Queue = opts.Max
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+	return &concurrencyLimiter{opts: opts, limit: opts.Max}
+}
+
+// a slot, waiting in the queue for up to the timeout when all are taken
+func (l *concurrencyLimiter) acquire() (bool, time.Duration) {
+	l.mu.Lock()
+	if l.inFlight < l.limit {
+		l.inFlight++
+		if l.inFlight == l.limit {
+			l.batchFull = true
+		}
+		l.mu.Unlock()
+		return true, 0
+	}
+	if len(l.waiters) >= l.opts.Queue {
+		l.shed++
+		l.mu.Unlock()
+		return false, 0
+	}
+	wait := make(chan struct{})
+	l.waiters = append(l.waiters, wait)
+	l.batchFull = true
+	l.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(l.opts.Timeout)
+	defer timer.Stop()
+	select {
+	case <-wait:
+		return true, time.Since(start)
+	case <-timer.C:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.waiters {
+		if l.waiters[i] == wait {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			l.shed++
+			return false, time.Since(start)
+		}
+	}
+	// handed a slot as the timer fired
+	return true, time.Since(start)
+}
+
+// frees the slot, handing it to the longest waiting request when the limit allows
+func (l *concurrencyLimiter) release(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.opts.Adaptive {
+		l.adapt(latency)
+	}
+	l.free()
+}
+
+// frees a slot the request did not get to use, without a latency sample for the adaptive limit
+func (l *concurrencyLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.free()
+}
+
+// with l.mu held
+func (l *concurrencyLimiter) free() {
+	if len(l.waiters) > 0 && l.inFlight <= l.limit {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		return
+	}
+	l.inFlight--
+}
+
+// additive increase while the limit is used and latency holds, multiplicative decrease when it doubles
+func (l *concurrencyLimiter) adapt(latency time.Duration) {
+	if l.batchCount == 0 || latency < l.batchMin {
+		l.batchMin = latency
+	}
+	l.batchTotal += latency
+	l.batchCount++
+	if l.batchCount < l.limit {
+		return
+	}
+
+	average := l.batchTotal / time.Duration(l.batchCount)
+	if l.baseline == 0 || l.batchMin < l.baseline {
+		l.baseline = l.batchMin
+	} else {
+		// let the baseline follow a service that became slower for good
+		l.baseline += (l.batchMin - l.baseline) / 10
+	}
+
+	if average > 2 * l.baseline && l.limit > 1 {
+		l.limit = l.limit * 9 / 10
+		if l.limit < 1 {
+			l.limit = 1
+		}
+	} else if l.batchFull && l.limit < l.opts.Max {
+		l.limit++
+	}
+	l.batchCount = 0
+	l.batchTotal = 0
+	l.batchFull = false
+}
+
+func (l *concurrencyLimiter) metrics(m *EndpointMetrics) {
+	l.mu.Lock()
+	m.InFlight = l.inFlight
+	m.Queued = len(l.waiters)
+	m.ConcurrencyLimit = l.limit
+	m.Shed = l.shed
+	l.mu.Unlock()
+}
+
+// takes a slot of the process and of the endpoint, or sheds the request with a 503.
+// The returned func releases the slots once the response is written.
+func acquireConcurrency(rb *ResponseBuilder, ep EndPointStruct) (func(), bool) {
+	limiters := make([]*concurrencyLimiter, 0, 2)
+	if global, _ := globalLimiter.Load().(*concurrencyLimiter); global != nil {
+		limiters = append(limiters, global)
+	}
+	if ep.concurrency != nil {
+		limiters = append(limiters, ep.concurrency)
+	}
+	if len(limiters) == 0 {
+		return func() {}, true
+	}
+
+	for i, l := range limiters {
+		ok, waited := l.acquire()
+		rb.ctx.queueWait += waited
+		if !ok {
+			for j := 0; j < i; j++ {
+				limiters[j].cancel()
+			}
+			shedRequest(rb, ep, l)
+			return nil, false
+		}
+	}
+
+	start := time.Now()
+	return func() {
+		latency := time.Since(start)
+		for i := len(limiters) - 1; i >= 0; i-- {
+			limiters[i].release(latency)
+		}
+	}, true
+}
+
+func shedRequest(rb *ResponseBuilder, ep EndPointStruct, l *concurrencyLimiter) {
+	rb.ctx.shed = true
+	if rb.ctx.span != nil {
+		rb.ctx.span.AddEvent("load shed")
+	}
+	logger.Warning.Println("[gen] load shed method: " + ep.RequestMethod + " url: " + rb.ctx.request.URL.Path + " limit: " + strconv.Itoa(l.opts.Max) + " queued: " + rb.ctx.queueWait.String())
+
+	retry := seconds(l.opts.Timeout)
+	if retry < 1 {
+		retry = 1
+	}
+	rb.SetHeader("Retry-After", strconv.Itoa(retry))
+	rb.SetResponseCode(http.StatusServiceUnavailable)
+	rb.WriteAndOveride([]byte(http.StatusText(http.StatusServiceUnavailable)))
+}
+
+//How long the request waited for a concurrency slot
+func (this *ResponseBuilder) QueueWait() time.Duration {
+	return this.ctx.queueWait
+}
+
+//Reports whether the request was shed by a concurrency limit
+func (this *ResponseBuilder) Shed() bool {
+	return this.ctx.shed
+}
@@ -0,0 +1,277 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+
+package gorest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseConcurrency(t *testing.T) {
+	cases := []struct {
+		tag	string
+		opts	ConcurrencyOptions
+		err	string
+	}{
+		{"8", ConcurrencyOptions{Max: 8, Queue: -1}, ""},
+		{"8, queue=16, timeout=2s, adaptive", ConcurrencyOptions{Max: 8, Queue: 16, Timeout: 2 * time.Second, Adaptive: true}, ""},
+		{"1,queue=0", ConcurrencyOptions{Max: 1, Queue: 0}, ""},
+		{"0", ConcurrencyOptions{}, "invalid limit"},
+		{"x", ConcurrencyOptions{}, "invalid limit"},
+		{"8, queue=-1", ConcurrencyOptions{}, "invalid queue"},
+		{"8, timeout=soon", ConcurrencyOptions{}, "invalid timeout"},
+		{"8, timeout=0s", ConcurrencyOptions{}, "invalid timeout"},
+		{"8, burst=2", ConcurrencyOptions{}, "unknown option burst"},
+		{"8, queue", ConcurrencyOptions{}, "invalid option"},
+	}
+
+	for _, tc := range cases {
+		opts, err := parseConcurrency(tc.tag)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", tc.tag, err)
+			} else if opts != tc.opts {
+				t.Errorf("%q: expected %+v, got %+v", tc.tag, tc.opts, opts)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: expected error containing %q, got %v", tc.tag, tc.err, err)
+		}
+	}
+
+	if l := newConcurrencyLimiter(ConcurrencyOptions{Max: 4, Queue: -1}); l.opts.Queue != 4 || l.opts.Timeout != time.Second {
+		t.Error("limiter defaults:", l.opts)
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	l := newConcurrencyLimiter(ConcurrencyOptions{Max: 1, Queue: 1, Timeout: time.Second})
+
+	if ok, waited := l.acquire(); !ok || waited != 0 {
+		t.Fatal("free slot:", ok, waited)
+	}
+
+	// the next request waits in the queue for the slot
+	admitted := make(chan time.Duration)
+	go func() {
+		ok, waited := l.acquire()
+		if !ok {
+			waited = -1
+		}
+		admitted <- waited
+	}()
+	for queued := 0; queued == 0; {
+		time.Sleep(time.Millisecond)
+		l.mu.Lock()
+		queued = len(l.waiters)
+		l.mu.Unlock()
+	}
+
+	// the queue is full, the one after is shed at once
+	if ok, _ := l.acquire(); ok {
+		t.Error("admitted beyond the queue")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	l.release(time.Millisecond)
+	if waited := <-admitted; waited < 20 * time.Millisecond {
+		t.Error("queued request:", waited)
+	}
+
+	var m EndpointMetrics
+	l.metrics(&m)
+	if m.InFlight != 1 || m.Queued != 0 || m.Shed != 1 || m.ConcurrencyLimit != 1 {
+		t.Errorf("metrics with the slot handed over: %+v", m)
+	}
+	l.release(time.Millisecond)
+	if l.metrics(&m); m.InFlight != 0 {
+		t.Errorf("metrics after release: %+v", m)
+	}
+}
+
+func TestConcurrencyTimeout(t *testing.T) {
+	l := newConcurrencyLimiter(ConcurrencyOptions{Max: 1, Queue: 1, Timeout: 50 * time.Millisecond})
+	l.acquire()
+
+	if ok, waited := l.acquire(); ok || waited < 50 * time.Millisecond {
+		t.Error("wait beyond the timeout:", ok, waited)
+	}
+	var m EndpointMetrics
+	if l.metrics(&m); m.Queued != 0 || m.Shed != 1 || m.InFlight != 1 {
+		t.Errorf("timed out request left behind: %+v", m)
+	}
+}
+
+func TestConcurrencyCancel(t *testing.T) {
+	global := newConcurrencyLimiter(ConcurrencyOptions{Max: 2, Adaptive: true})
+	SetMaxConcurrent(global.opts)
+	defer SetMaxConcurrent(ConcurrencyOptions{})
+	global = globalLimiter.Load().(*concurrencyLimiter)
+
+	ep := EndPointStruct{RequestMethod: "GET", concurrency: newConcurrencyLimiter(ConcurrencyOptions{Max: 1, Queue: 0})}
+	newRB := func() (*ResponseBuilder, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		return &ResponseBuilder{ctx: &Context{writer: rec, request: httptest.NewRequest("GET", "/busy", nil)}}, rec
+	}
+
+	rb, _ := newRB()
+	release, ok := acquireConcurrency(rb, ep)
+	if !ok {
+		t.Fatal("first request was shed")
+	}
+
+	// the endpoint is full, the process slot taken on the way is given back
+	rb, rec := newRB()
+	if _, ok = acquireConcurrency(rb, ep); ok || !rb.Shed() {
+		t.Fatal("admitted beyond the endpoint limit")
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Error("shed response:", rec.Code, rec.Header())
+	}
+
+	var m EndpointMetrics
+	if global.metrics(&m); m.InFlight != 1 || global.batchCount != 0 {
+		t.Errorf("process slot of the shed request: %+v, samples %d", m, global.batchCount)
+	}
+
+	release()
+	if global.metrics(&m); m.InFlight != 0 || global.batchCount != 1 {
+		t.Errorf("process slot after release: %+v, samples %d", m, global.batchCount)
+	}
+	if ep.concurrency.metrics(&m); m.InFlight != 0 || m.Shed != 1 {
+		t.Errorf("endpoint slot after release: %+v", m)
+	}
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	l := newConcurrencyLimiter(ConcurrencyOptions{Max: 10, Adaptive: true})
+
+	// a batch is as many requests as the limit, all of them in flight at once
+	batch := func(latency time.Duration) int {
+		n := l.limit
+		for i := 0; i < n; i++ {
+			l.acquire()
+		}
+		for i := 0; i < n; i++ {
+			l.release(latency)
+		}
+		return l.limit
+	}
+
+	if limit := batch(10 * time.Millisecond); limit != 10 || l.baseline != 10 * time.Millisecond {
+		t.Fatal("baseline batch:", limit, l.baseline)
+	}
+	if limit := batch(15 * time.Millisecond); limit != 10 {
+		t.Error("latency under twice the baseline:", limit)
+	}
+	if limit := batch(50 * time.Millisecond); limit != 9 {
+		t.Error("latency over twice the baseline:", limit)
+	}
+	if limit := batch(50 * time.Millisecond); limit != 8 {
+		t.Error("latency still over twice the baseline:", limit)
+	}
+
+	// grows back under load while latency holds, up to Max
+	for want := 9; want <= 10; want++ {
+		if limit := batch(10 * time.Millisecond); limit != want {
+			t.Errorf("recovering: expected %d, got %d", want, limit)
+		}
+	}
+	if limit := batch(10 * time.Millisecond); limit != 10 {
+		t.Error("grew beyond Max:", limit)
+	}
+
+	// an idle service keeps its limit
+	l.acquire()
+	l.release(10 * time.Millisecond)
+	if l.limit != 10 || l.batchFull {
+		t.Error("single request:", l.limit, l.batchFull)
+	}
+
+	// never below one
+	l = newConcurrencyLimiter(ConcurrencyOptions{Max: 1, Adaptive: true})
+	batch(10 * time.Millisecond)
+	if limit := batch(time.Second); limit != 1 {
+		t.Error("limit of one:", limit)
+	}
+}
+
+var concurrencyGate = make(chan struct{})
+
+type concurrencyService struct {
+	RestService	`root:"/concurrency-service/" consumes:"application/json" produces:"application/json"`
+	busy		EndPoint	`method:"GET" path:"/busy" output:"string" maxConcurrent:"1, queue=0, timeout=2s"`
+}
+
+func (serv concurrencyService) Busy() string {
+	<-concurrencyGate
+	return "done"
+}
+
+func TestConcurrencyShedding(t *testing.T) {
+	RegisterService(new(concurrencyService))
+	srv := httptest.NewServer(Handle())
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if resp, err := http.Get(srv.URL + "/concurrency-service/busy"); err != nil || resp.StatusCode != 200 {
+			t.Error("admitted request:", err)
+		} else {
+			resp.Body.Close()
+		}
+	}()
+
+	// wait for the first request to hold the slot
+	for inFlight := 0; inFlight == 0; {
+		time.Sleep(time.Millisecond)
+		for _, m := range GetMetrics() {
+			if m.Path == "concurrency-service/busy" {
+				inFlight = m.InFlight
+			}
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/concurrency-service/busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "2" {
+		t.Error("shed request:", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	close(concurrencyGate)
+	wg.Wait()
+}
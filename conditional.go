@@ -0,0 +1,155 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Sets a strong ETag, the value is quoted unless it already is
+func (this *ResponseBuilder) SetETag(value string) *ResponseBuilder {
+	this.SetHeader("ETag", quoteETag(value))
+	return this
+}
+
+//Sets a weak ETag, for representations that are equivalent but not byte for byte identical
+func (this *ResponseBuilder) SetWeakETag(value string) *ResponseBuilder {
+	this.SetHeader("ETag", "W/" + quoteETag(value))
+	return this
+}
+
+func (this *ResponseBuilder) SetLastModified(modified time.Time) *ResponseBuilder {
+	this.SetHeader("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	return this
+}
+
+//Sets the Cache-Control header, e.g. "private, max-age=60" or "no-store"
+func (this *ResponseBuilder) SetCacheControl(value string) *ResponseBuilder {
+	this.SetHeader("Cache-Control", value)
+	return this
+}
+
+//Evaluates If-Match and If-Unmodified-Since against the resource's current ETag value and modification time,
+//before a PUT, PATCH or DELETE changes it. When they fail the response is set to 412 Precondition Failed and
+//false is returned, the method should then return without changing the resource:
+//
+//	if !serv.RB().CheckPreconditions(order.Version, order.Updated) {
+//		return
+//	}
+func (this *ResponseBuilder) CheckPreconditions(etag string, modified time.Time) bool {
+	r := this.ctx.request
+
+	if match := r.Header.Get("If-Match"); match != "" {
+		if etag != "" && etagListMatches(match, quoteETag(etag), false) {
+			return true
+		}
+		this.SetResponseCode(http.StatusPreconditionFailed)
+		this.SetResponseMsg("The resource has changed, If-Match does not hold")
+		return false
+	}
+
+	if since := r.Header.Get("If-Unmodified-Since"); since != "" && !modified.IsZero() {
+		if t, err := http.ParseTime(since); err == nil && modified.Truncate(time.Second).After(t) {
+			this.SetResponseCode(http.StatusPreconditionFailed)
+			this.SetResponseMsg("The resource has changed, If-Unmodified-Since does not hold")
+			return false
+		}
+	}
+	return true
+}
+
+// adds the endpoint's generated ETag and reports whether a conditional GET can be answered with 304
+func (this *ResponseBuilder) notModified() bool {
+	r := this.ctx.request
+	if (r.Method != GET && r.Method != HEAD) || this.ctx.responseCode != http.StatusOK {
+		return false
+	}
+
+	header := this.writer().Header()
+	if this.ctx.etag != "" && header.Get("ETag") == "" && this.ctx.respPacket != nil {
+		// the whole body is needed for the hash, the packet is buffered
+		data, err := ioutil.ReadAll(this.ctx.respPacket)
+		this.ctx.respPacket.Close()
+		this.ctx.respPacket = ioutil.NopCloser(bytes.NewReader(data))
+		if err == nil {
+			sum := sha256.Sum256(data)
+			value := base64.RawURLEncoding.EncodeToString(sum[:18])
+			if this.ctx.etag == "weak" {
+				this.SetWeakETag(value)
+			} else {
+				this.SetETag(value)
+			}
+		}
+	}
+
+	etag := header.Get("ETag")
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etag != "" && etagListMatches(match, etag, true)
+	}
+	if since := r.Header.Get("If-Modified-Since"); since != "" {
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		t, err2 := http.ParseTime(since)
+		return err == nil && err2 == nil && !modified.After(t)
+	}
+	return false
+}
+
+// whether the If-Match / If-None-Match list names the etag, weak comparison ignores W/
+func etagListMatches(list string, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	} else if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = trimEncodingSuffix(strings.TrimSpace(candidate))
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteETag(value string) string {
+	if strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "W/\"") {
+		return value
+	}
+	return "\"" + value + "\""
+}
@@ -0,0 +1,217 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+
+package gorest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestETagListMatches(t *testing.T) {
+	cases := []struct {
+		list	string
+		etag	string
+		weak	bool
+		match	bool
+	}{
+		{`"v1"`, `"v1"`, false, true},
+		{`"v0", "v1"`, `"v1"`, false, true},
+		{`"v2"`, `"v1"`, false, false},
+		{` * `, `"v1"`, false, true},
+		{`W/"v1"`, `"v1"`, false, false},
+		{`"v1"`, `W/"v1"`, false, false},
+		{`W/"v1"`, `"v1"`, true, true},
+		{`"v1"`, `W/"v1"`, true, true},
+		{`W/"v0",W/"v1"`, `W/"v1"`, true, true},
+		{`"v1-gzip"`, `"v1"`, false, true},
+		{`"v1-br"`, `"v1"`, true, true},
+		{`"v1"`, `"v1-gzip"`, false, false},
+	}
+
+	for _, tc := range cases {
+		if etagListMatches(tc.list, tc.etag, tc.weak) != tc.match {
+			t.Errorf("%s against %s, weak %v: expected match %v", tc.list, tc.etag, tc.weak, tc.match)
+		}
+	}
+
+	for value, quoted := range map[string]string{"v1": `"v1"`, `"v1"`: `"v1"`, `W/"v1"`: `W/"v1"`} {
+		if quoteETag(value) != quoted {
+			t.Errorf("quoteETag(%s): expected %s, got %s", value, quoted, quoteETag(value))
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	modified := time.Date(2024, 5, 6, 7, 8, 9, 500, time.UTC)
+	before := modified.Add(-time.Hour).Format(http.TimeFormat)
+	after := modified.Add(time.Hour).Format(http.TimeFormat)
+
+	cases := []struct {
+		name	string
+		header	map[string]string
+		etag	string
+		allowed	bool
+	}{
+		{"no preconditions", nil, "v1", true},
+		{"If-Match", map[string]string{"If-Match": `"v1"`}, "v1", true},
+		{"If-Match list", map[string]string{"If-Match": `"v0", "v1"`}, "v1", true},
+		{"If-Match changed", map[string]string{"If-Match": `"v0"`}, "v1", false},
+		{"If-Match weak", map[string]string{"If-Match": `W/"v1"`}, "v1", false},
+		{"If-Match any", map[string]string{"If-Match": "*"}, "v1", true},
+		{"If-Match any without a resource", map[string]string{"If-Match": "*"}, "", false},
+		{"If-Unmodified-Since later", map[string]string{"If-Unmodified-Since": after}, "v1", true},
+		{"If-Unmodified-Since the same second", map[string]string{"If-Unmodified-Since": modified.Format(http.TimeFormat)}, "v1", true},
+		{"If-Unmodified-Since earlier", map[string]string{"If-Unmodified-Since": before}, "v1", false},
+		{"If-Unmodified-Since not a date", map[string]string{"If-Unmodified-Since": "yesterday"}, "v1", true},
+		{"If-Match before If-Unmodified-Since", map[string]string{"If-Match": `"v1"`, "If-Unmodified-Since": before}, "v1", true},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest("PUT", "/orders/7", nil)
+		for key, value := range tc.header {
+			req.Header.Set(key, value)
+		}
+		rb := &ResponseBuilder{ctx: &Context{writer: httptest.NewRecorder(), request: req}}
+
+		allowed := rb.CheckPreconditions(tc.etag, modified)
+		if allowed != tc.allowed {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.allowed, allowed)
+		}
+		if !allowed && rb.ctx.responseCode != http.StatusPreconditionFailed {
+			t.Errorf("%s: expected 412, got %d", tc.name, rb.ctx.responseCode)
+		}
+	}
+
+	// without a modification time If-Unmodified-Since can not be evaluated
+	req := httptest.NewRequest("DELETE", "/orders/7", nil)
+	req.Header.Set("If-Unmodified-Since", before)
+	if rb := (&ResponseBuilder{ctx: &Context{writer: httptest.NewRecorder(), request: req}}); !rb.CheckPreconditions("v1", time.Time{}) {
+		t.Error("If-Unmodified-Since without a modification time")
+	}
+}
+
+var conditionalModified = time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+type conditionalService struct {
+	RestService	`root:"/conditional-service/" consumes:"application/json" produces:"application/json" etag:"strong"`
+	item		EndPoint	`method:"GET" path:"/item" output:"string"`
+	summary		EndPoint	`method:"GET" path:"/summary" output:"string" etag:"weak"`
+	report		EndPoint	`method:"GET" path:"/report" output:"string" etag:"none"`
+	add		EndPoint	`method:"POST" path:"/item" postdata:"string" output:"string"`
+}
+
+func (serv conditionalService) Item() string {
+	return "item"
+}
+
+func (serv conditionalService) Summary() string {
+	return "summary"
+}
+
+func (serv conditionalService) Report() string {
+	serv.RB().SetLastModified(conditionalModified)
+	return "report"
+}
+
+func (serv conditionalService) Add(item string) string {
+	return item
+}
+
+func TestConditionalGET(t *testing.T) {
+	RegisterService(new(conditionalService))
+	srv := httptest.NewServer(Handle())
+	defer srv.Close()
+
+	call := func(method string, path string, header map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL + "/conditional-service" + path, nil)
+		req.Header.Set("Content-Type", "application/json")
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(data)
+	}
+
+	resp, _ := call("GET", "/item", nil)
+	strong := resp.Header.Get("ETag")
+	resp, _ = call("GET", "/summary", nil)
+	weak := resp.Header.Get("ETag")
+	if len(strong) < 3 || strong[0] != '"' || len(weak) < 5 || weak[:3] != `W/"` {
+		t.Fatal("generated etags:", strong, weak)
+	}
+	if resp, _ = call("GET", "/report", nil); resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != conditionalModified.Format(http.TimeFormat) {
+		t.Fatal("validators with etag none:", resp.Header)
+	}
+
+	before := conditionalModified.Add(-time.Hour).Format(http.TimeFormat)
+	after := conditionalModified.Add(time.Hour).Format(http.TimeFormat)
+
+	cases := []struct {
+		name	string
+		method	string
+		path	string
+		header	map[string]string
+		code	int
+	}{
+		{"no validators", "GET", "/item", nil, http.StatusOK},
+		{"If-None-Match", "GET", "/item", map[string]string{"If-None-Match": strong}, http.StatusNotModified},
+		{"If-None-Match list", "GET", "/item", map[string]string{"If-None-Match": `"other", ` + strong}, http.StatusNotModified},
+		{"If-None-Match weak form of a strong etag", "GET", "/item", map[string]string{"If-None-Match": "W/" + strong}, http.StatusNotModified},
+		{"If-None-Match changed", "GET", "/item", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"If-None-Match any", "GET", "/item", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"weak etag", "GET", "/summary", map[string]string{"If-None-Match": weak}, http.StatusNotModified},
+		{"weak etag in its strong form", "GET", "/summary", map[string]string{"If-None-Match": weak[2:]}, http.StatusNotModified},
+		{"If-Modified-Since later", "GET", "/report", map[string]string{"If-Modified-Since": after}, http.StatusNotModified},
+		{"If-Modified-Since the same second", "GET", "/report", map[string]string{"If-Modified-Since": conditionalModified.Format(http.TimeFormat)}, http.StatusNotModified},
+		{"If-Modified-Since earlier", "GET", "/report", map[string]string{"If-Modified-Since": before}, http.StatusOK},
+		{"If-Modified-Since not a date", "GET", "/report", map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK},
+		{"If-Modified-Since without Last-Modified", "GET", "/item", map[string]string{"If-Modified-Since": after}, http.StatusOK},
+		{"If-None-Match before If-Modified-Since", "GET", "/item", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": after}, http.StatusOK},
+		{"POST is never 304", "POST", "/item", map[string]string{"If-None-Match": "*"}, http.StatusCreated},
+	}
+
+	for _, tc := range cases {
+		resp, body := call(tc.method, tc.path, tc.header)
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.code, resp.StatusCode)
+			continue
+		}
+		if tc.code == http.StatusNotModified && (body != "" || resp.Header.Get("Content-Type") != "" || (tc.path != "/report" && resp.Header.Get("ETag") == "")) {
+			t.Errorf("%s: 304 with body %q, headers %v", tc.name, body, resp.Header)
+		}
+	}
+}
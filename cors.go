@@ -0,0 +1,239 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"github.com/rmullinnix461332/logger"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Cross origin resource sharing rules for the endpoints a policy applies to.
+//SetCORSPolicy sets the default, RegisterCORSPolicy names policies for cors:"name" tags on a
+//service or endpoint, cors:"none" turns CORS off for them.
+type CORSPolicy struct {
+	AllowOrigins		[]string		// exact origins, patterns such as https://*.example.com, or *
+	AllowOriginFunc		func(origin string) bool	// consulted for origins not in AllowOrigins
+	AllowHeaders		[]string		// request headers allowed by preflight, * allows those requested
+	ExposeHeaders		[]string		// response headers scripts may read
+	AllowCredentials	bool			// cookies and Authorization, not allowed with the * origin
+	MaxAge			time.Duration		// how long browsers may cache a preflight, 0 leaves it to the browser
+}
+
+var defaultCORSHeaders = []string{"Origin", "X-Requested-With", "Content-Type", "Accept", "Authorization", "Location", XSRF_HEADER_NAME}
+
+// the methods a preflight may report, in the order they are listed
+var corsMethods = []string{GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS}
+
+// the swagger document is public unless a default policy is set
+var swaggerCORS = newCORSRule(CORSPolicy{AllowOrigins: []string{"*"}, AllowHeaders: []string{"Origin", "Content-Type", "Accept", "Authorization"}})
+
+var corsMu sync.RWMutex
+var corsPolicies = make(map[string]*corsRule)
+
+type corsRule struct {
+	policy		CORSPolicy
+	anyOrigin	bool
+	origins		map[string]bool
+	patterns	[]string
+}
+
+//Sets the policy of endpoints and services without a cors tag
+func SetCORSPolicy(policy CORSPolicy) {
+	rule := newCORSRule(policy)
+	corsMu.Lock()
+	corsPolicies[""] = rule
+	corsMu.Unlock()
+}
+
+//Registers a policy for cors:"name" tags, register it before the services using it
+func RegisterCORSPolicy(name string, policy CORSPolicy) {
+	if name == "" || name == "none" {
+		logger.Error.Panicln("[gen] cors policy name can not be empty or none")
+	}
+	rule := newCORSRule(policy)
+	corsMu.Lock()
+	corsPolicies[name] = rule
+	corsMu.Unlock()
+}
+
+//Allows the origin on every endpoint, use SetCORSPolicy for more control
+func SetAllowOrigin(origin string) {
+	SetCORSPolicy(CORSPolicy{AllowOrigins: []string{origin}})
+}
+
+func newCORSRule(policy CORSPolicy) *corsRule {
+	rule := &corsRule{policy: policy, origins: make(map[string]bool)}
+	for _, origin := range policy.AllowOrigins {
+		origin = strings.ToLower(strings.TrimRight(origin, "/"))
+		switch {
+		case origin == "*":
+			rule.anyOrigin = true
+		case strings.Contains(origin, "*"):
+			if _, err := path.Match(origin, ""); err != nil {
+				logger.Error.Panicln("[gen] cors policy: invalid origin pattern " + origin)
+			}
+			rule.patterns = append(rule.patterns, origin)
+		default:
+			rule.origins[origin] = true
+		}
+	}
+	if rule.anyOrigin && policy.AllowCredentials {
+		logger.Error.Panicln("[gen] cors policy: credentials can not be allowed for any origin, list the origins instead")
+	}
+	if policy.AllowHeaders == nil {
+		rule.policy.AllowHeaders = defaultCORSHeaders
+	}
+	return rule
+}
+
+func corsRegistered(name string) bool {
+	corsMu.RLock()
+	defer corsMu.RUnlock()
+	_, found := corsPolicies[name]
+	return found
+}
+
+// the policy for the endpoint's cors tag, nil when CORS is off
+func corsFor(ep EndPointStruct) *corsRule {
+	if ep.cors == "none" {
+		return nil
+	}
+	corsMu.RLock()
+	defer corsMu.RUnlock()
+	return corsPolicies[ep.cors]
+}
+
+// the Access-Control-Allow-Origin value for the origin, empty when it is not allowed
+func (rule *corsRule) allowOrigin(origin string) string {
+	if rule.anyOrigin {
+		return "*"
+	}
+	if origin == "" {
+		return ""
+	}
+
+	lower := strings.ToLower(origin)
+	if rule.origins[lower] {
+		return origin
+	}
+	for _, pattern := range rule.patterns {
+		if matched, _ := path.Match(pattern, lower); matched {
+			return origin
+		}
+	}
+	if rule.policy.AllowOriginFunc != nil && rule.policy.AllowOriginFunc(origin) {
+		return origin
+	}
+	return ""
+}
+
+// adds the CORS response headers, true when the request's origin is allowed
+func (rule *corsRule) apply(rb *ResponseBuilder) bool {
+	origin := rb.ctx.request.Header.Get("Origin")
+	allowed := rule.allowOrigin(origin)
+	if allowed != "*" {
+		// caches must not hand one origin's answer to another
+		rb.AddHeader("Vary", "Origin")
+	}
+	if origin == "" || allowed == "" {
+		return false
+	}
+
+	rb.SetHeader("Access-Control-Allow-Origin", allowed)
+	if rule.policy.AllowCredentials {
+		rb.SetHeader("Access-Control-Allow-Credentials", "true")
+	}
+	if len(rule.policy.ExposeHeaders) > 0 {
+		rb.SetHeader("Access-Control-Expose-Headers", strings.Join(rule.policy.ExposeHeaders, ", "))
+	}
+	return true
+}
+
+// answers a preflight with the methods registered on the path, under the policy of the requested method's endpoint
+func servePreflight(rb *ResponseBuilder, url string) {
+	r := rb.ctx.request
+	requested := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+
+	var rule	*corsRule
+	methods := make([]string, 0)
+	for _, method := range corsMethods {
+		ep, _, _, _, found := getEndPointByUrl(method, url)
+		if !found || corsFor(ep) == nil {
+			continue
+		}
+		methods = append(methods, method)
+		if method == requested {
+			rule = corsFor(ep)
+		}
+	}
+	if len(methods) == 0 {
+		logger.Warning.Println("[gen] Could not serve preflight, path not found: ", url)
+		rb.SetResponseCode(http.StatusNotFound)
+		rb.WriteAndOveride([]byte("The resource in the requested path could not be found."))
+		return
+	}
+	if requested != OPTIONS && !containsString(methods, OPTIONS) {
+		methods = append(methods, OPTIONS)
+	}
+
+	rb.AddHeader("Vary", "Access-Control-Request-Method")
+	rb.AddHeader("Vary", "Access-Control-Request-Headers")
+	if rule == nil || !rule.apply(rb) {
+		logger.Warning.Println("[gen] cors preflight refused, origin: " + r.Header.Get("Origin") + " method: " + requested + " url: " + url)
+		rb.SetResponseCode(http.StatusForbidden)
+		rb.WriteAndOveride([]byte(""))
+		return
+	}
+
+	rb.SetHeader("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if containsString(rule.policy.AllowHeaders, "*") {
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			rb.SetHeader("Access-Control-Allow-Headers", headers)
+		}
+	} else if len(rule.policy.AllowHeaders) > 0 {
+		rb.SetHeader("Access-Control-Allow-Headers", strings.Join(rule.policy.AllowHeaders, ", "))
+	}
+	if rule.policy.MaxAge > 0 {
+		rb.SetHeader("Access-Control-Max-Age", strconv.Itoa(int(rule.policy.MaxAge / time.Second)))
+	}
+	rb.SetResponseCode(http.StatusNoContent)
+	rb.WriteAndOveride([]byte(""))
+}
+
+func containsString(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
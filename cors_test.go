@@ -0,0 +1,175 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+package gorest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type corsService struct {
+	RestService	`root:"/cors-service/" consumes:"application/json" produces:"application/json" cors:"corsTest"`
+	list		EndPoint	`method:"GET" path:"/items" output:"string"`
+	add		EndPoint	`method:"POST" path:"/items" postdata:"string"`
+	remove		EndPoint	`method:"DELETE" path:"/items/{id:int}"`
+	private		EndPoint	`method:"GET" path:"/private" output:"string" cors:"none"`
+	account		EndPoint	`method:"GET" path:"/account" output:"string" cors:"corsCreds"`
+	public		EndPoint	`method:"GET" path:"/public" output:"string" cors:"corsAny"`
+}
+
+func (serv corsService) List() string {
+	return "items"
+}
+
+func (serv corsService) Add(item string) {
+}
+
+func (serv corsService) Remove(id int) {
+}
+
+func (serv corsService) Private() string {
+	return "private"
+}
+
+func (serv corsService) Account() string {
+	return "account"
+}
+
+func (serv corsService) Public() string {
+	return "public"
+}
+
+func TestCORS(t *testing.T) {
+	RegisterCORSPolicy("corsTest", CORSPolicy{AllowOrigins: []string{"https://app.example.com", "https://*.example.org"}, ExposeHeaders: []string{"X-Total"}, MaxAge: 10 * time.Minute})
+	RegisterCORSPolicy("corsCreds", CORSPolicy{AllowOrigins: []string{"https://app.example.com"}, AllowHeaders: []string{"*"}, AllowCredentials: true})
+	RegisterCORSPolicy("corsAny", CORSPolicy{AllowOrigins: []string{"*"}})
+	RegisterService(new(corsService))
+	srv := httptest.NewServer(Handle())
+	defer srv.Close()
+
+	call := func(method string, path string, header map[string]string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL + "/cors-service" + path, nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	preflight := func(path string, origin string, method string) *http.Response {
+		return call("OPTIONS", path, map[string]string{"Origin": origin, "Access-Control-Request-Method": method, "Access-Control-Request-Headers": "X-Custom"})
+	}
+
+	cases := []struct {
+		name	string
+		resp	*http.Response
+		code	int
+		headers	map[string]string
+	}{
+		{"preflight", preflight("/items", "https://app.example.com", "POST"), http.StatusNoContent, map[string]string{
+			"Access-Control-Allow-Origin":	"https://app.example.com",
+			"Access-Control-Allow-Methods":	"GET, POST, OPTIONS",
+			"Access-Control-Allow-Headers":	strings.Join(defaultCORSHeaders, ", "),
+			"Access-Control-Max-Age":	"600",
+		}},
+		{"preflight of a path with a parameter", preflight("/items/7", "https://app.example.com", "DELETE"), http.StatusNoContent, map[string]string{
+			"Access-Control-Allow-Methods":	"DELETE, OPTIONS",
+		}},
+		{"preflight from an origin pattern", preflight("/items", "https://api.example.org", "GET"), http.StatusNoContent, map[string]string{
+			"Access-Control-Allow-Origin":	"https://api.example.org",
+		}},
+		{"preflight from another origin", preflight("/items", "https://example.org.evil.com", "GET"), http.StatusForbidden, map[string]string{
+			"Access-Control-Allow-Origin":	"",
+		}},
+		{"preflight of an unknown path", preflight("/missing", "https://app.example.com", "GET"), http.StatusNotFound, nil},
+		{"preflight with cors off", preflight("/private", "https://app.example.com", "GET"), http.StatusNotFound, nil},
+		{"preflight allowing requested headers", preflight("/account", "https://app.example.com", "GET"), http.StatusNoContent, map[string]string{
+			"Access-Control-Allow-Headers":		"X-Custom",
+			"Access-Control-Allow-Credentials":	"true",
+		}},
+		{"allowed origin", call("GET", "/items", map[string]string{"Origin": "https://app.example.com"}), http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin":		"https://app.example.com",
+			"Access-Control-Expose-Headers":	"X-Total",
+			"Access-Control-Allow-Credentials":	"",
+		}},
+		{"other origin", call("GET", "/items", map[string]string{"Origin": "https://evil.com"}), http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin":	"",
+		}},
+		{"cors off", call("GET", "/private", map[string]string{"Origin": "https://app.example.com"}), http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin":	"",
+		}},
+		{"credentials", call("GET", "/account", map[string]string{"Origin": "https://app.example.com"}), http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin":		"https://app.example.com",
+			"Access-Control-Allow-Credentials":	"true",
+		}},
+		{"any origin", call("GET", "/public", map[string]string{"Origin": "https://evil.com"}), http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin":	"*",
+		}},
+	}
+
+	for _, tc := range cases {
+		if tc.resp.StatusCode != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.code, tc.resp.StatusCode)
+		}
+		for key, value := range tc.headers {
+			if got := tc.resp.Header.Get(key); got != value {
+				t.Errorf("%s: expected %s %q, got %q", tc.name, key, value, got)
+			}
+		}
+	}
+
+	// answers that depend on the origin say so, even when the origin was refused or not sent
+	for _, path := range []string{"/items", "/account"} {
+		for _, origin := range []string{"https://app.example.com", "https://evil.com", ""} {
+			if vary := call("GET", path, map[string]string{"Origin": origin}).Header.Values("Vary"); !containsString(vary, "Origin") {
+				t.Errorf("%s from %q: Vary %v", path, origin, vary)
+			}
+		}
+	}
+	if vary := call("GET", "/public", map[string]string{"Origin": "https://app.example.com"}).Header.Values("Vary"); containsString(vary, "Origin") {
+		t.Error("Vary: Origin on an answer for any origin")
+	}
+	if vary := preflight("/items", "https://app.example.com", "GET").Header.Values("Vary"); !containsString(vary, "Origin") || !containsString(vary, "Access-Control-Request-Method") {
+		t.Error("preflight Vary:", vary)
+	}
+}
+
+func TestCORSCredentialsWithAnyOrigin(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("credentials were allowed for any origin")
+		}
+	}()
+	RegisterCORSPolicy("corsInvalid", CORSPolicy{AllowOrigins: []string{"*"}, AllowCredentials: true})
+}
@@ -0,0 +1,202 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/rmullinnix461332/logger"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Double submit CSRF protection for browser clients. The token is issued in a cookie script can read,
+//and unsafe requests (POST, PUT, PATCH, DELETE) must send it back in the header, or the xsrft query parameter.
+//Tokens are signed so a cookie planted by a sibling domain is refused.
+//
+//Endpoints authenticated by an api_key scheme with location:"cookie" are protected, csrf:"true" on a
+//service or endpoint protects others and csrf:"none" opts out.
+type CSRFOptions struct {
+	Secret		[]byte			// signs tokens, share it between instances; random when empty
+	CookieName	string			// default X-Xsrf-Cookie
+	HeaderName	string			// default X-Xsrf-Token
+	Path		string			// cookie path, default /
+	Domain		string
+	MaxAge		time.Duration		// cookie lifetime, default 12 hours
+	Secure		bool			// always mark the cookie Secure, it is for https requests
+	SameSite	http.SameSite		// default Lax
+}
+
+const XSRF_HEADER_NAME = "X-Xsrf-Token"
+
+var csrfMu sync.RWMutex
+var csrfOpts *CSRFOptions
+
+//Configures CSRF protection, without it a random secret and the defaults are used
+func SetCSRFOptions(opts CSRFOptions) {
+	if opts.Secret == nil {
+		opts.Secret = randomBytes(32)
+	}
+	if opts.CookieName == "" {
+		opts.CookieName = XSXRF_COOKIE_NAME
+	}
+	if opts.HeaderName == "" {
+		opts.HeaderName = XSRF_HEADER_NAME
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = 12 * time.Hour
+	}
+	if opts.SameSite == 0 {
+		opts.SameSite = http.SameSiteLaxMode
+	}
+
+	csrfMu.Lock()
+	csrfOpts = &opts
+	csrfMu.Unlock()
+}
+
+func csrfOptions() *CSRFOptions {
+	csrfMu.RLock()
+	opts := csrfOpts
+	csrfMu.RUnlock()
+	if opts == nil {
+		SetCSRFOptions(CSRFOptions{})
+		return csrfOptions()
+	}
+	return opts
+}
+
+//Returns the request's CSRF token, issuing a new one in the cookie when the request has none.
+//Pages rendered by the service can embed it for form posts (xsrft) or scripts.
+func (this *ResponseBuilder) CSRFToken() string {
+	if this.ctx.csrfToken != "" {
+		return this.ctx.csrfToken
+	}
+	opts := csrfOptions()
+	if cookie, err := this.ctx.request.Cookie(opts.CookieName); err == nil && validCSRFToken(opts, cookie.Value) {
+		this.ctx.csrfToken = cookie.Value
+		return cookie.Value
+	}
+	return this.issueCSRFToken(opts)
+}
+
+func (this *ResponseBuilder) issueCSRFToken(opts *CSRFOptions) string {
+	nonce := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	token := nonce + "." + signCSRF(opts, nonce)
+
+	http.SetCookie(this.writer(), &http.Cookie{
+		Name:		opts.CookieName,
+		Value:		token,
+		Path:		opts.Path,
+		Domain:		opts.Domain,
+		Expires:	time.Now().Add(opts.MaxAge),
+		MaxAge:		int(opts.MaxAge / time.Second),
+		Secure:		opts.Secure || this.ctx.request.TLS != nil,
+		HttpOnly:	false,	// read by script to submit it back
+		SameSite:	opts.SameSite,
+	})
+	this.ctx.csrfToken = token
+	return token
+}
+
+func signCSRF(opts *CSRFOptions, nonce string) string {
+	mac := hmac.New(sha256.New, opts.Secret)
+	mac.Write([]byte(nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validCSRFToken(opts *CSRFOptions, token string) bool {
+	dot := strings.Index(token, ".")
+	if dot < 1 {
+		return false
+	}
+	return hmac.Equal([]byte(token[dot+1:]), []byte(signCSRF(opts, token[:dot])))
+}
+
+// safe methods are given a token if they have none, unsafe ones must submit the cookie's token
+func checkCSRF(rb *ResponseBuilder, submitted string) bool {
+	r := rb.ctx.request
+	switch r.Method {
+	case GET, HEAD, OPTIONS:
+		rb.CSRFToken()
+		return true
+	}
+
+	opts := csrfOptions()
+	if header := r.Header.Get(opts.HeaderName); header != "" {
+		submitted = header
+	}
+
+	reason := ""
+	cookie, err := r.Cookie(opts.CookieName)
+	switch {
+	case err != nil:
+		reason = "no csrf cookie"
+	case submitted == "":
+		reason = "no csrf token in " + opts.HeaderName + " or " + XSXRF_PARAM_NAME
+	case !validCSRFToken(opts, cookie.Value):
+		reason = "csrf cookie not signed by this service"
+	case subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(submitted)) != 1:
+		reason = "csrf token does not match the cookie"
+	default:
+		rb.ctx.csrfToken = cookie.Value
+		return true
+	}
+
+	logger.Warning.Println("[sec] csrf method: " + r.Method + " url: " + r.URL.Path + " remote: " + r.RemoteAddr + " response: 403 reason: " + reason)
+	rb.SetResponseCode(http.StatusForbidden)
+	rb.SetResponseMsg("CSRF token missing or invalid")
+	return false
+}
+
+// endpoints relying on a cookie credential, which browsers send on cross site requests
+func cookieAuthenticated(reqs []SecurityRequirement) bool {
+	for _, req := range reqs {
+		for scheme := range req {
+			if def, found := _manager().securityDef[scheme]; found && def.Location == "cookie" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		logger.Error.Panicln("[sec] no randomness: " + err.Error())
+	}
+	return b
+}
@@ -0,0 +1,156 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+
+package gorest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type csrfService struct {
+	RestService	`root:"/csrf-service/" consumes:"application/json" produces:"application/json"`
+	CsrfSession	Security	`mode:"api_key" location:"cookie" name:"csrf-test-session"`
+	form		EndPoint	`method:"GET" path:"/form" output:"string" csrf:"true"`
+	submit		EndPoint	`method:"POST" path:"/submit" postdata:"string" csrf:"true"`
+	open		EndPoint	`method:"POST" path:"/open" postdata:"string"`
+	account		EndPoint	`method:"POST" path:"/account" postdata:"string" security:"CsrfSession"`
+	hook		EndPoint	`method:"POST" path:"/hook" postdata:"string" security:"CsrfSession" csrf:"none"`
+}
+
+func (serv csrfService) Form() string {
+	return serv.RB().CSRFToken()
+}
+
+func (serv csrfService) Submit(s string) {
+}
+
+func (serv csrfService) Open(s string) {
+}
+
+func (serv csrfService) Account(s string) {
+}
+
+func (serv csrfService) Hook(s string) {
+}
+
+func TestCSRF(t *testing.T) {
+	SetCSRFOptions(CSRFOptions{Secret: []byte("csrf-test-secret")})
+	defer func() {
+		csrfMu.Lock()
+		csrfOpts = nil
+		csrfMu.Unlock()
+	}()
+	opts := csrfOptions()
+	RegisterPrincipalAuthorizer("CsrfSession", func(token string, scheme string, scopes []string, method string, rb *ResponseBuilder) AuthResult {
+		if token == "" {
+			return Unauthenticated("no session")
+		}
+		return Authenticated(&Principal{Subject: token})
+	})
+	RegisterService(new(csrfService))
+	srv := httptest.NewServer(Handle())
+	defer srv.Close()
+
+	call := func(method string, path string, cookie string, header string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL + "/csrf-service" + path, strings.NewReader(`"data"`))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "csrf-test-session", Value: "alice"})
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: opts.CookieName, Value: cookie})
+		}
+		if header != "" {
+			req.Header.Set(opts.HeaderName, header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	issued := func(resp *http.Response) *http.Cookie {
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == opts.CookieName {
+				return cookie
+			}
+		}
+		return nil
+	}
+
+	// a safe request is given a signed token readable by script
+	resp, body := call("GET", "/form", "", "")
+	cookie := issued(resp)
+	if resp.StatusCode != 200 || cookie == nil {
+		t.Fatal("no token issued:", resp.StatusCode, body)
+	}
+	token := cookie.Value
+	if !validCSRFToken(opts, token) || body != `"` + token + `"` || cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/" {
+		t.Errorf("issued token: %+v, body %s", cookie, body)
+	}
+
+	// a valid token is kept, an unsigned one replaced
+	if resp, body = call("GET", "/form", token, ""); issued(resp) != nil || body != `"` + token + `"` {
+		t.Error("valid token was replaced:", body)
+	}
+	if resp, _ = call("GET", "/form", "forged.token", ""); issued(resp) == nil || issued(resp).Value == "forged.token" {
+		t.Error("unsigned token was kept")
+	}
+
+	other := &CSRFOptions{Secret: []byte("another-secret")}
+	forged := "bm9uY2U." + signCSRF(other, "bm9uY2U")
+
+	cases := []struct {
+		name	string
+		path	string
+		cookie	string
+		header	string
+		code	int
+	}{
+		{"header matching the cookie", "/submit", token, token, http.StatusCreated},
+		{"xsrft parameter matching the cookie", "/submit?xsrft=" + token, token, "", http.StatusCreated},
+		{"no cookie", "/submit", "", token, http.StatusForbidden},
+		{"no token", "/submit", token, "", http.StatusForbidden},
+		{"token not matching the cookie", "/submit", token, issued(resp).Value, http.StatusForbidden},
+		{"cookie signed by another secret", "/submit", forged, forged, http.StatusForbidden},
+		{"unprotected endpoint", "/open", "", "", http.StatusCreated},
+		{"cookie authenticated endpoint", "/account", "", "", http.StatusForbidden},
+		{"cookie authenticated endpoint with the token", "/account", token, token, http.StatusCreated},
+		{"cookie authenticated endpoint opted out", "/hook", "", "", http.StatusCreated},
+	}
+
+	for _, tc := range cases {
+		if resp, body := call("POST", tc.path, tc.cookie, tc.header); resp.StatusCode != tc.code {
+			t.Errorf("%s: expected %d, got %d %s", tc.name, tc.code, resp.StatusCode, body)
+		}
+	}
+}
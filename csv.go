@@ -0,0 +1,360 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+package gorest
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a flattened struct member, nested structs are walked with index and
+// named Parent.Child unless a csv tag gives the column a name
+type csvColumn struct {
+	name	string
+	index	[]int
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+//text/csv: Slices of structs are written one row per element after a header row of field names.
+//Field names can be overridden with a csv:"name" tag, csv:"-" skips the field and nested structs
+//are flattened into Parent.Child columns. Rows are streamed to the reader as they are encoded.
+func NewCSVMarshaller() *Marshaller {
+	m := Marshaller{csvMarshal, csvUnMarshal}
+	return &m
+}
+
+func csvMarshal(v interface{}) (io.ReadCloser, error) {
+	rows, elemType, err := csvRows(v)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := csvColumns(elemType)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w := csv.NewWriter(pw)
+
+		header := make([]string, len(columns))
+		for i := range columns {
+			header[i] = columns[i].name
+		}
+		if err := w.Write(header); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		for i := 0; i < rows.Len(); i++ {
+			if err := w.Write(csvRecord(rows.Index(i), columns)); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			// a reader that went away shows up on the flush
+			if w.Flush(); w.Error() != nil {
+				pw.CloseWithError(w.Error())
+				return
+			}
+		}
+
+		w.Flush()
+		pw.CloseWithError(w.Error())
+	}()
+
+	return pr, nil
+}
+
+func csvUnMarshal(data []byte, v interface{}) error {
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Slice {
+		return errors.New("text/csv can only be unmarshalled into a pointer to a slice")
+	}
+
+	slice := ptr.Elem()
+	elemType := slice.Type().Elem()
+	columns, err := csvColumns(elemType)
+	if err != nil {
+		return err
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	// match the header against our columns, unknown columns are ignored
+	position := make([]int, len(records[0]))
+	for i, name := range records[0] {
+		position[i] = -1
+		for j := range columns {
+			if columns[j].name == name {
+				position[i] = j
+				break
+			}
+		}
+	}
+
+	for _, record := range records[1:] {
+		elem := reflect.New(elemType).Elem()
+		for i, cell := range record {
+			if i >= len(position) || position[i] == -1 || cell == "" {
+				continue
+			}
+			if err := setCSVField(elem, columns[position[i]].index, cell); err != nil {
+				return errors.New("column " + records[0][i] + ": " + err.Error())
+			}
+		}
+		slice = reflect.Append(slice, elem)
+	}
+
+	ptr.Elem().Set(slice)
+	return nil
+}
+
+// normalises the output into a slice of rows and the type of a row
+func csvRows(v interface{}) (reflect.Value, reflect.Type, error) {
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+
+	switch val.Kind() {
+	case reflect.Slice, reflect.Array:
+		elemType := val.Type().Elem()
+		for elemType.Kind() == reflect.Ptr {
+			elemType = elemType.Elem()
+		}
+		return val, elemType, nil
+	case reflect.Struct:
+		rows := reflect.MakeSlice(reflect.SliceOf(val.Type()), 0, 1)
+		return reflect.Append(rows, val), val.Type(), nil
+	case reflect.Invalid:
+		return val, nil, errors.New("Type is invalid!")
+	}
+
+	return val, nil, errors.New("Type " + val.Type().String() + " can not be written as text/csv")
+}
+
+func csvColumns(t reflect.Type) ([]csvColumn, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct || t == timeType {
+		if csvScalar(t) {
+			return []csvColumn{{"value", nil}}, nil
+		}
+		return nil, errors.New("Type " + t.String() + " can not be written as text/csv")
+	}
+
+	return csvStructColumns(t, "", nil, make(map[reflect.Type]bool)), nil
+}
+
+// nested structs become prefixed columns, one already being flattened (type Node struct{ Next *Node }) is left out
+func csvStructColumns(t reflect.Type, prefix string, index []int, visiting map[reflect.Type]bool) []csvColumn {
+	columns := make([]csvColumn, 0)
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+
+		name := f.Name
+		if tag := f.Tag.Get("csv"); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = strings.Split(tag, ",")[0]
+		}
+
+		fIndex := make([]int, len(index) + 1)
+		copy(fIndex, index)
+		fIndex[len(index)] = i
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		if ft.Kind() == reflect.Struct && ft != timeType {
+			if !visiting[ft] {
+				columns = append(columns, csvStructColumns(ft, prefix + name + ".", fIndex, visiting)...)
+			}
+		} else {
+			columns = append(columns, csvColumn{prefix + name, fIndex})
+		}
+	}
+
+	return columns
+}
+
+func csvScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+
+	return t == timeType
+}
+
+func csvRecord(row reflect.Value, columns []csvColumn) []string {
+	record := make([]string, len(columns))
+
+	for i := range columns {
+		if field, ok := csvField(row, columns[i].index); ok {
+			record[i] = csvCell(field)
+		}
+	}
+
+	return record
+}
+
+// walks the index through nested structs, a nil pointer along the way leaves the cell empty
+func csvField(v reflect.Value, index []int) (reflect.Value, bool) {
+	for {
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return v, false
+			}
+			v = v.Elem()
+		}
+		if len(index) == 0 {
+			return v, true
+		}
+		v = v.Field(index[0])
+		index = index[1:]
+	}
+}
+
+func csvCell(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits())
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return v.Interface().(time.Time).Format(time.RFC3339)
+		}
+	}
+
+	// slices, maps and the like are kept in a single cell as json
+	if (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.IsNil() {
+		return ""
+	}
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprint(v.Interface())
+	}
+	return string(data)
+}
+
+func setCSVField(elem reflect.Value, index []int, cell string) error {
+	field := elem
+	for _, i := range index {
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		field = field.Field(i)
+	}
+	for field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		field = field.Elem()
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(cell)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(cell)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(cell, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(cell, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(cell, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(n)
+	default:
+		if field.Type() == timeType {
+			t, err := time.Parse(time.RFC3339, cell)
+			if err != nil {
+				return err
+			}
+			field.Set(reflect.ValueOf(t))
+			return nil
+		}
+		return json.Unmarshal([]byte(cell), field.Addr().Interface())
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+package gorest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type csvPerson struct {
+	Login	string
+}
+
+type csvReport struct {
+	Name		string		`csv:"name"`
+	Count		int
+	Ratio		float64
+	Done		bool
+	Owner		*csvPerson
+	Tags		[]string
+	Created		time.Time
+	Internal	string		`csv:"-"`
+}
+
+type reportService struct {
+	RestService	`root:"/report-service/" consumes:"application/json" produces:"application/json,text/csv,application/x-ndjson"`
+	reports		EndPoint	`method:"GET" path:"/reports" output:"[]csvReport"`
+}
+
+func (serv reportService) Reports() []csvReport {
+	return testReports
+}
+
+var testReports = []csvReport{
+	{Name: "north", Count: 3, Ratio: 0.5, Done: true, Owner: &csvPerson{Login: "ann"}, Tags: []string{"a", "b"}, Created: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+	{Name: "south, east", Count: -1, Ratio: 1e-7},
+}
+
+const testReportsCSV = "name,Count,Ratio,Done,Owner.Login,Tags,Created\n" +
+	"north,3,0.5,true,ann,\"[\"\"a\"\",\"\"b\"\"]\",2024-01-02T03:04:05Z\n" +
+	"\"south, east\",-1,1e-07,false,,,0001-01-01T00:00:00Z\n"
+
+type csvNode struct {
+	Name	string
+	Next	*csvNode
+	Owner	csvOwner
+}
+
+type csvOwner struct {
+	Login	string
+	Last	*csvNode
+}
+
+func TestCSVRecursiveType(t *testing.T) {
+	addMimeType("text/csv")
+	nodes := []csvNode{{Name: "a", Next: &csvNode{Name: "b"}, Owner: csvOwner{Login: "root"}}}
+
+	// a struct already being flattened is left out instead of recursing without end
+	reader, err := interfaceToBytes(nodes, "text/csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readerToString(reader, t); got != "Name,Owner.Login\na,root\n" {
+		t.Errorf("recursive struct marshall: got %q", got)
+	}
+
+	decoded := make([]csvNode, 0)
+	if err := bytesToInterface(bytes.NewBufferString("Name,Owner.Login\nc,admin\n"), &decoded, "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || decoded[0].Name != "c" || decoded[0].Owner.Login != "admin" || decoded[0].Next != nil {
+		t.Errorf("recursive struct unmarshall: %+v", decoded)
+	}
+}
+
+func TestCSVMarshall(t *testing.T) {
+	addMimeType("text/csv")
+
+	reader, err := interfaceToBytes(testReports, "text/csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readerToString(reader, t); got != testReportsCSV {
+		t.Errorf("Slice marshall: got\n%s\nexpected\n%s", got, testReportsCSV)
+	}
+
+	// a single struct is one row, a slice of scalars a value column
+	reader, _ = interfaceToBytes(csvPerson{Login: "ann"}, "text/csv")
+	if got := readerToString(reader, t); got != "Login\nann\n" {
+		t.Errorf("Struct marshall: got %q", got)
+	}
+	reader, _ = interfaceToBytes([]int{1, 2}, "text/csv")
+	if got := readerToString(reader, t); got != "value\n1\n2\n" {
+		t.Errorf("Scalar slice marshall: got %q", got)
+	}
+	if _, err := interfaceToBytes(map[string]int{"a": 1}, "text/csv"); err == nil {
+		t.Error("a map was written as text/csv")
+	}
+}
+
+func TestCSVUnmarshall(t *testing.T) {
+	addMimeType("text/csv")
+
+	reports := make([]csvReport, 0)
+	if err := bytesToInterface(bytes.NewBufferString(testReportsCSV), &reports, "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reports, testReports) {
+		t.Errorf("Slice unmarshall: got %+v, expected %+v", reports, testReports)
+	}
+
+	// columns in another order, unknown columns ignored
+	reports = make([]csvReport, 0)
+	if err := bytesToInterface(bytes.NewBufferString("Count,extra,name\n4,x,west\n"), &reports, "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Name != "west" || reports[0].Count != 4 {
+		t.Errorf("Reordered unmarshall: %+v", reports)
+	}
+
+	if err := bytesToInterface(bytes.NewBufferString("Count\nfour\n"), &reports, "text/csv"); err == nil {
+		t.Error("a bad number was accepted")
+	}
+}
+
+func TestCSVAcceptNegotiation(t *testing.T) {
+	RegisterService(new(reportService))
+	srv := httptest.NewServer(Handle())
+	defer srv.Close()
+
+	cases := []struct {
+		accept	string
+		mime	string
+		body	string
+	}{
+		{"text/csv", "text/csv", testReportsCSV},
+		{"application/x-ndjson", "application/x-ndjson", ""},
+		{"application/json", "application/json", ""},
+		{"", "application/json", ""},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest("GET", srv.URL + "/report-service/reports", nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byt, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != tc.mime {
+			t.Errorf("Accept %q: got %d %s, expected %s", tc.accept, resp.StatusCode, resp.Header.Get("Content-Type"), tc.mime)
+			continue
+		}
+		if tc.body != "" && string(byt) != tc.body {
+			t.Errorf("Accept %q: got %s", tc.accept, byt)
+		}
+
+		reports := make([]csvReport, 0)
+		if err := bytesToInterface(bytes.NewBuffer(byt), &reports, tc.mime); err != nil || len(reports) != len(testReports) || reports[0].Owner.Login != "ann" {
+			t.Errorf("Accept %q: decoded %+v %v", tc.accept, reports, err)
+		}
+	}
+}
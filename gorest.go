@@ -59,11 +59,13 @@ package gorest
 
 import (
 	"context"
-	"encoding/json"
 	"encoding/base64"
+	"encoding/hex"
 	"github.com/rmullinnix461332/logger"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -108,20 +110,42 @@ type EndPointStruct struct {
 	OutputType           string
 	OutputTypeIsArray    bool
 	OutputTypeIsMap      bool
+	OutputTypeExpr       *TypeExpr
 	PostdataType         string
+	PostdataTypeExpr     *TypeExpr
 	postdataTypeIsArray  bool
 	postdataTypeIsMap    bool
 	isVariableLength     bool
 	parentTypeName       string
 	MethodNumberInParent int
-	role                 string
+	Roles                []string // role tag, the principal must hold one of them
+	Policy               string // policy tag, decided by the registered PolicyEngine before the method is invoked
 	ProducesMime 	     []string // overrides the produces mime type
 	ConsumesMime 	     []string // overrides the consumes mime type
 	allowGzip 	     int // 0 false, 1 true, 2 unitialized
-	SecurityScheme	     map[string][]string // must match one of securityDef
+	nilCode		     int // response code for a nil pointer output, 0 uses the service's
+	SecurityScheme	     map[string][]string // every scheme named in Security, must match one of securityDef
+	Security	     []SecurityRequirement // alternatives, satisfying any one authorizes the request
+	public		     bool // security:"none", the service default does not apply
+	cors		     string // cors tag, a policy registered with RegisterCORSPolicy, none, or empty for the default
+	csrf		     string // csrf tag, true or none, empty protects cookie authenticated endpoints
+	rateLimit	     *RateLimit // ratelimit tag, nil when unlimited
+	concurrency	     *concurrencyLimiter // maxConcurrent tag, nil when unlimited
+	etag		     string // etag tag, strong or weak ETags generated from the body of GET responses
+	cache		     *cacheOptions // cache tag, nil when responses are not cached
 	perfLog		     bool
 }
 
+func (ep EndPointStruct) csrfProtected() bool {
+	switch ep.csrf {
+	case "true":
+		return true
+	case "none":
+		return false
+	}
+	return cookieAuthenticated(ep.Security)
+}
+
 type restStatus struct {
 	httpCode int
 	reason   string //Especially for code in range 4XX to 5XX
@@ -139,11 +163,20 @@ type ServiceMetaData struct {
 	Root         string
 	realm        string
 	allowGzip    bool
+	nilCode      int
+	Security     []SecurityRequirement // default for endpoints without a security tag
+	cors         string // default for endpoints without a cors tag
+	csrf         string // default for endpoints without a csrf tag
+	rateLimit    *RateLimit // default for endpoints without a ratelimit tag, each endpoint is counted separately
+	etag         string // default for endpoints without an etag tag
 }
 
 var restManager *manager
 var handlerInitialised bool
 
+// representations the swagger endpoint can be served in, the first is the default
+var swaggerMime = []string{Application_Json, Application_Yaml, Application_X_Yaml}
+
 type manager struct {
 	root		string
 	serviceTypes 	map[string]ServiceMetaData
@@ -151,8 +184,6 @@ type manager struct {
 	securityDef     map[string]SecurityStruct
 	pathDict	map[string]int
 	pathDictIndex	int
-	allowOrigin	string
-	allowOriginSet	bool
 	swaggerEP	string
 	tracer		trace.Tracer
 	tracerSet	bool
@@ -161,7 +192,7 @@ type manager struct {
 type SecurityStruct struct {
 	Mode		string // basic, api_key or oauth2
 	Description	string
-	Location	string // header or query
+	Location	string // header, query or cookie
 	Name		string // name of query param or header element
 	Prefix		string // if auth header has a prefix (e.g., "Bearer ")
 	Flow		string
@@ -170,10 +201,26 @@ type SecurityStruct struct {
 	Scope		[]string
 }
 
+//The schemes, and their scopes, that must all authorize a request
+type SecurityRequirement map[string][]string
+
+// scheme names in a stable order
+func (req SecurityRequirement) schemes() []string {
+	names := make([]string, 0, len(req))
+	for name := range req {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type PathSecurity struct {
 	Path		string
 	Method		string
 	Scope		[]string
+	Security	[]SecurityRequirement // effective requirements, empty for public endpoints
+	Roles		[]string
+	Policy		string
 }
 
 func newManager() *manager {
@@ -181,7 +228,6 @@ func newManager() *manager {
 	man.serviceTypes = make(map[string]ServiceMetaData, 0)
 	man.endpoints = make(map[string]EndPointStruct, 0)
 	man.securityDef = make(map[string]SecurityStruct, 0)
-	man.allowOriginSet = false
 	man.tracerSet = false
 
 	man.pathDict = make(map[string]int, 0)
@@ -195,11 +241,6 @@ func newManager() *manager {
 	return man
 }
 
-func SetAllowOrigin(origin string) {
-	_manager().allowOrigin = origin
-	_manager().allowOriginSet = true
-}
-
 //Registers a service on the rootpath.
 //See example below:
 //
@@ -313,15 +354,19 @@ func (this manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	rb.ctx.writer = w
 	rb.ctx.request = r
 	rb.ctx.sessData.relSessionData = make(map[string]interface{})
-	rb.ctx.sessData.relSessionData["Host"] = r.Host
-	rb.ctx.sessStart = time.Now().Local()
+	rb.ctx.sessData.relSessionData[SessionHost] = r.Host
+	rb.ctx.sessData.values = make(map[interface{}]interface{})
+	rb.ctx.sessData.ctx = rb.ctx
 
-	if _manager().allowOriginSet {
-		rb.ctx.sessData.relSessionData["Origin"] = _manager().allowOrigin
+	rb.ctx.requestID = r.Header.Get("X-Request-Id")
+	if rb.ctx.requestID == "" {
+		rb.ctx.requestID = hex.EncodeToString(randomBytes(16))
 	}
+	w.Header().Set("X-Request-Id", rb.ctx.requestID)
+	rb.ctx.sessStart = time.Now().Local()
 
 	url_, err := url.QueryUnescape(r.URL.RequestURI())
-	ep, args, queryArgs, _, found := getEndPointByUrl(r.Method, url_)
+	ep, args, queryArgs, xsrft, found := getEndPointByUrl(r.Method, url_)
 
 	if this.tracerSet {
 		defer rb.TraceLog()
@@ -338,27 +383,41 @@ func (this manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Header.Get("Origin") != "" {
-		if r.Method == OPTIONS {
-			rb.AddHeader("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			rb.AddHeader("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, Location")
-			if _manager().allowOriginSet {
-				rb.AddHeader("Access-Control-Allow-Origin", _manager().allowOrigin)
-			}
-			rb.SetResponseCode(http.StatusOK)
-			rb.WriteAndOveride([]byte(""))
-			return
-		}
+	if r.Method == OPTIONS && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+		servePreflight(rb, url_)
+		return
 	}
 
 	if url_ == _manager().swaggerEP {
 		basePath :=  _manager().root
 		doc := GetDocumentor("swagger")
 		swagDoc := doc.Document(basePath, this.serviceTypes, this.endpoints, this.securityDef)
-		data, _ := json.Marshal(swagDoc)
+
+		// json unless the client asks for yaml, e.g. spec linting pipelines
+		mimeType := Application_Json
+		if valid, accepted := validMime(r.Header.Get("Accept"), nil, swaggerMime); valid {
+			mimeType = accepted
+		}
+		addMimeType(mimeType)
+
+		packet, err := interfaceToBytes(swagDoc, mimeType)
+		if err != nil {
+			logger.Error.Println("[gen] Could not marshal swagger document as " + mimeType, err)
+			rb.SetResponseCode(http.StatusInternalServerError)
+			rb.WriteAndOveride([]byte("Could not marshal swagger document."))
+			return
+		}
+		defer packet.Close()
+		data, _ := ioutil.ReadAll(packet)
+
 		rb.SetResponseCode(http.StatusOK)
-		rb.AddHeader("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
-		rb.AddHeader("Access-Control-Allow-Origin", "*")
+		rb.SetHeader("Content-Type", mimeType)
+		rb.AddHeader("Vary", "Accept")
+		if cors := corsFor(EndPointStruct{}); cors != nil {
+			cors.apply(rb)
+		} else {
+			swaggerCORS.apply(rb)
+		}
 		rb.WriteAndOveride(data)
 		return
 	} 
@@ -374,11 +433,28 @@ func (this manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		rb.ctx.xsrftoken = getAuthKey(ep.SecurityScheme, queryArgs, r, w)
+		rb.ctx.credentials = getAuthKeys(ep.Security, queryArgs, r, w)
+		rb.ctx.xsrftoken = firstCredential(ep.Security, rb.ctx.credentials)
+
+		if cors := corsFor(ep); cors != nil {
+			cors.apply(rb)
+		}
+
+		release, admitted := acquireConcurrency(rb, ep)
+		if !admitted {
+			return
+		}
+		defer release()
 
-		prepareServe(rb, ep, args, queryArgs)
+		rb.ctx.etag = ep.etag
+		rb.ctx.encodeGzip = ep.allowGzip == 1
+		loadSession(rb)
+		if !ep.csrfProtected() || checkCSRF(rb, xsrft) {
+			prepareServe(rb, ep, args, queryArgs)
+		}
 
 		rb.WritePacket()
+		saveSession(rb)
 	} else {
 		logger.Warning.Println("[gen] Could not serve page, path not found: ", r.Method, url_)
 		rb.SetResponseCode(http.StatusNotFound)
@@ -386,48 +462,79 @@ func (this manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getAuthKey(schemes map[string][]string, queryArgs map[string]string, r *http.Request, w http.ResponseWriter) string {
+// extracts each scheme's own credential, keyed by scheme name
+func getAuthKeys(reqs []SecurityRequirement, queryArgs map[string]string, r *http.Request, w http.ResponseWriter) map[string]string {
+	keys := make(map[string]string)
+
+	for _, req := range reqs {
+		for scheme, _ := range req {
+			if _, done := keys[scheme]; !done {
+				keys[scheme] = getAuthKey(scheme, queryArgs, r, w)
+			}
+		}
+	}
+
+	return keys
+}
+
+// the token exposed by SessionToken, the first credential presented in declaration order
+func firstCredential(reqs []SecurityRequirement, keys map[string]string) string {
+	for _, req := range reqs {
+		for _, scheme := range req.schemes() {
+			if len(keys[scheme]) > 0 {
+				return keys[scheme]
+			}
+		}
+	}
+	return ""
+}
+
+func getAuthKey(scheme string, queryArgs map[string]string, r *http.Request, w http.ResponseWriter) string {
 	authKey := ""
 
-	// why we would have multiple schemes against an endpoint - don't know
-	for scheme, _ := range schemes {
-		// three modes - basic, api_key, oauth2
-		if def, found := _manager().securityDef[scheme]; found {
-			if def.Mode == "basic" {
-				authKey = r.Header.Get("Authorization")
-				if len(authKey) > 0 {
-					authKey = strings.TrimPrefix(authKey, "Basic ")
-					payload, _ := base64.StdEncoding.DecodeString(authKey)
-					authKey = string(payload)
-				}
+	// three modes - basic, api_key, oauth2
+	if def, found := _manager().securityDef[scheme]; found {
+		if def.Mode == "basic" {
+			// the Authorization header may carry another scheme's credential
+			authKey = r.Header.Get("Authorization")
+			if strings.HasPrefix(authKey, "Basic ") {
+				payload, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(authKey, "Basic "))
+				authKey = string(payload)
 			} else {
-				location := def.Location
-				name := def.Name
-				prefix := def.Prefix
-				if def.Mode == "oauth2"  {
-					location = "header"
-					name = "Authorization"
-					prefix = "Bearer "
-				}
+				authKey = ""
+			}
+		} else {
+			location := def.Location
+			name := def.Name
+			prefix := def.Prefix
+			if def.Mode == "oauth2"  {
+				location = "header"
+				name = "Authorization"
+				prefix = "Bearer "
+			}
 
-				if location == "header" {
-					authKey = r.Header.Get(name)
-					if len(authKey) > 0 {
-						w.Header().Set(name, authKey)
-						if strings.Contains(authKey, prefix) {
-							authKey = strings.TrimPrefix(authKey, prefix)
-						}
+			if location == "header" {
+				authKey = r.Header.Get(name)
+				if def.Mode == "oauth2" && strings.HasPrefix(authKey, "Basic ") {
+					authKey = ""
+				}
+				if len(authKey) > 0 {
+					w.Header().Set(name, authKey)
+					if strings.Contains(authKey, prefix) {
+						authKey = strings.TrimPrefix(authKey, prefix)
 					}
-				} else if location == "query" {
-					if authKey, found = queryArgs[name]; found {
-						if strings.Contains(authKey, prefix) {
-							authKey = strings.TrimPrefix(authKey, prefix)
-						}
+				}
+			} else if location == "query" {
+				if authKey, found = queryArgs[name]; found {
+					if strings.Contains(authKey, prefix) {
+						authKey = strings.TrimPrefix(authKey, prefix)
 					}
 				}
-			}
-			if len(authKey) > 0 {
-				break
+			} else if location == "cookie" {
+				// browsers send it on cross site requests too, such endpoints are csrf protected
+				if cookie, err := r.Cookie(name); err == nil {
+					authKey = cookie.Value
+				}
 			}
 		}
 	}
@@ -500,8 +607,6 @@ func getDefaultResponseCode(method string) int {
 			return 200
 		}
 	}
-
-	return 200
 }
 
 func GetPathSecurity() []PathSecurity {
@@ -513,6 +618,9 @@ func GetPathSecurity() []PathSecurity {
 
 		item.Path = cleanPath(eps[key].Signiture)
 		item.Method = eps[key].RequestMethod
+		item.Security = eps[key].Security
+		item.Roles = eps[key].Roles
+		item.Policy = eps[key].Policy
 		if len(eps[key].SecurityScheme) > 0 {
 			item.Scope = make([]string, 0)
 			for _, scope := range eps[key].SecurityScheme {
@@ -31,7 +31,12 @@ import (
 	"io/ioutil"
 	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"github.com/ajg/form"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+	"reflect"
 	"strings"
 )
 
@@ -109,3 +114,165 @@ func formUnMarshal(data []byte, v interface{}) error {
 	err := form.DecodeString(v, string(data))
 	return err
 }
+
+//application/x-protobuf: Only values implementing proto.Message (or whose pointer does) can be marshalled.
+func NewProtobufMarshaller() *Marshaller {
+	m := Marshaller{protobufMarshal, protobufUnMarshal}
+	return &m
+}
+func protobufMarshal(v interface{}) (io.ReadCloser, error) {
+	msg, err := protoMessage(v)
+	if err != nil {
+		return nil, err
+	}
+	p, e := proto.Marshal(msg)
+	if e != nil {
+		return nil, e
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(p)), nil
+}
+func protobufUnMarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("Type %T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+//Service methods usually return messages by value, so take the address of a copy when only the pointer is a proto.Message.
+func protoMessage(v interface{}) (proto.Message, error) {
+	if msg, ok := v.(proto.Message); ok {
+		return msg, nil
+	}
+
+	val := reflect.ValueOf(v)
+	if val.IsValid() && reflect.PtrTo(val.Type()).Implements(reflect.TypeOf((*proto.Message)(nil)).Elem()) {
+		ptr := reflect.New(val.Type())
+		ptr.Elem().Set(val)
+		return ptr.Interface().(proto.Message), nil
+	}
+
+	return nil, fmt.Errorf("Type %T does not implement proto.Message", v)
+}
+
+//application/msgpack
+func NewMsgpackMarshaller() *Marshaller {
+	m := Marshaller{msgpackMarshal, msgpackUnMarshal}
+	return &m
+}
+func msgpackMarshal(v interface{}) (io.ReadCloser, error) {
+	b, e := msgpack.Marshal(v)
+	if e != nil {
+		return nil, e
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(b)), nil
+}
+func msgpackUnMarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+//application/x-ndjson: Slices are written as one json document per line, streamed as each element is encoded.
+//Anything else is written as a single line.
+func NewNDJSONMarshaller() *Marshaller {
+	m := Marshaller{ndjsonMarshal, ndjsonUnMarshal}
+	return &m
+}
+func ndjsonMarshal(v interface{}) (io.ReadCloser, error) {
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr && !val.IsNil() {
+		val = val.Elem()
+	}
+
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		j, e := json.Marshal(v)
+		if e != nil {
+			return nil, e
+		}
+		return ioutil.NopCloser(bytes.NewBuffer(append(j, '\n'))), nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		enc := json.NewEncoder(pw)
+		for i := 0; i < val.Len(); i++ {
+			// Encode terminates each document with a newline
+			if err := enc.Encode(val.Index(i).Interface()); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	return pr, nil
+}
+func ndjsonUnMarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Slice {
+		return dec.Decode(v)
+	}
+
+	slice := ptr.Elem()
+	for dec.More() {
+		elem := reflect.New(slice.Type().Elem())
+		if err := dec.Decode(elem.Interface()); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem.Elem())
+	}
+	ptr.Elem().Set(slice)
+
+	return nil
+}
+
+//application/yaml: The document mirrors the JSON encoding, json tags and omitempty are honoured so both
+//representations of a type agree. Keys keep the order the JSON encoder wrote them in.
+func NewYAMLMarshaller() *Marshaller {
+	m := Marshaller{yamlMarshal, yamlUnMarshal}
+	return &m
+}
+func yamlMarshal(v interface{}) (io.ReadCloser, error) {
+	j, e := json.Marshal(v)
+	if e != nil {
+		return nil, e
+	}
+
+	// json is a subset of yaml, parse into a node tree to keep the key order
+	var doc yaml.Node
+	if e = yaml.Unmarshal(j, &doc); e != nil {
+		return nil, e
+	}
+	blockStyle(&doc)
+
+	buf := new(bytes.Buffer)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if e = enc.Encode(&doc); e != nil {
+		return nil, e
+	}
+	enc.Close()
+	return ioutil.NopCloser(buf), nil
+}
+func yamlUnMarshal(data []byte, v interface{}) error {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+// clears the flow and quoting styles the json parse left on the nodes, the encoder
+// then writes block style and only quotes the scalars that need it
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
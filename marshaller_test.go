@@ -0,0 +1,338 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+package gorest
+
+import (
+	"bytes"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type binaryService struct {
+	RestService	`root:"/binary-service/" consumes:"application/json,application/msgpack" produces:"application/json,application/msgpack"`
+	user		EndPoint	`method:"GET" path:"/user" output:"User"`
+	rename		EndPoint	`method:"PUT" path:"/user/{name:string}" postdata:"User" output:"User"`
+	greeting	EndPoint	`method:"GET" path:"/greeting" output:"*wrapperspb.StringValue" produces:"application/x-protobuf,application/json"`
+}
+
+func (serv binaryService) User() User {
+	return User{Id: "7", FirstName: "David", LastName: "Coperfield", Age: 20, Weight: 70.5}
+}
+
+func (serv binaryService) Rename(u User, name string) User {
+	u.FirstName = name
+	return u
+}
+
+func (serv binaryService) Greeting() *wrapperspb.StringValue {
+	return wrapperspb.String("hello")
+}
+
+func TestProtobufMarshall(t *testing.T) {
+	addMimeType("application/x-protobuf")
+
+	reader, err := interfaceToBytes(wrapperspb.String("hello"), "application/x-protobuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byt, _ := ioutil.ReadAll(reader)
+	AssertEqual(string(byt), "\n\x05hello", "Message marshall", t)
+
+	msg := new(wrapperspb.StringValue)
+	if err := bytesToInterface(bytes.NewBuffer(byt), msg, "application/x-protobuf"); err != nil {
+		t.Error("Error", err.Error())
+	}
+	if msg.GetValue() != "hello" {
+		t.Errorf("message round trip: got %q", msg.GetValue())
+	}
+
+	// only messages can be written or read
+	if _, err := interfaceToBytes(User{}, "application/x-protobuf"); err == nil {
+		t.Error("a struct that is not a proto.Message was marshalled")
+	}
+	if err := bytesToInterface(bytes.NewBuffer(byt), new(User), "application/x-protobuf"); err == nil {
+		t.Error("unmarshalled into a struct that is not a proto.Message")
+	}
+}
+
+func TestMsgpackMarshall(t *testing.T) {
+	addMimeType("application/msgpack")
+
+	u := User{Id: "1", FirstName: "David", LastName: "Coperfield", Age: 20, Weight: 70.5}
+	cases := []struct {
+		name	string
+		in	interface{}
+		out	interface{}
+	}{
+		{"Integer", 12345, new(int)},
+		{"String", "Hello", new(string)},
+		{"Bool", true, new(bool)},
+		{"Float", 36.6, new(float64)},
+		{"Struct", u, new(User)},
+		{"Array", []User{u, u}, new([]User)},
+		{"Map", map[string]User{"One": u}, new(map[string]User)},
+	}
+
+	// bytesToInterface reads scalars as plain text whatever the mime, as path arguments are, so go to the Marshaller
+	m := GetMarshallerByMime("msgpack")
+	for _, tc := range cases {
+		reader, err := m.Marshal(tc.in)
+		if err != nil {
+			t.Errorf("%s marshall: %v", tc.name, err)
+			continue
+		}
+		byt, _ := ioutil.ReadAll(reader)
+		if err := m.Unmarshal(byt, tc.out); err != nil {
+			t.Errorf("%s unmarshall: %v", tc.name, err)
+		} else if got := reflect.ValueOf(tc.out).Elem().Interface(); !reflect.DeepEqual(got, tc.in) {
+			t.Errorf("%s round trip: got %v, expected %v", tc.name, got, tc.in)
+		}
+	}
+
+	// structured values go through the mime
+	reader, err := interfaceToBytes([]User{u}, "application/msgpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byt, _ := ioutil.ReadAll(reader)
+	users := make([]User, 0)
+	if err := bytesToInterface(bytes.NewBuffer(byt), &users, "application/msgpack"); err != nil || len(users) != 1 || users[0] != u {
+		t.Errorf("slice round trip: %v %v", users, err)
+	}
+}
+
+func TestBinaryAcceptNegotiation(t *testing.T) {
+	RegisterService(new(binaryService))
+	srv := httptest.NewServer(Handle())
+	defer srv.Close()
+
+	call := func(method string, path string, accept string, contentType string, body []byte) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, srv.URL + "/binary-service" + path, bytes.NewReader(body))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		byt, _ := ioutil.ReadAll(resp.Body)
+		return resp, byt
+	}
+
+	cases := []struct {
+		accept	string
+		mime	string
+	}{
+		{"application/msgpack", "application/msgpack"},
+		{"application/json", "application/json"},
+		{"", "application/json"},
+		{"text/html, application/msgpack;q=0.9", "application/msgpack"},
+	}
+	for _, tc := range cases {
+		resp, byt := call("GET", "/user", tc.accept, "", nil)
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != tc.mime {
+			t.Errorf("Accept %q: got %d %s, expected %s", tc.accept, resp.StatusCode, resp.Header.Get("Content-Type"), tc.mime)
+			continue
+		}
+		u := User{}
+		if err := bytesToInterface(bytes.NewBuffer(byt), &u, tc.mime); err != nil || u.FirstName != "David" || u.Weight != 70.5 {
+			t.Errorf("Accept %q: decoded %+v %v", tc.accept, u, err)
+		}
+	}
+
+	// a msgpack body in, the same encoding back
+	reader, _ := interfaceToBytes(User{Id: "3", FirstName: "Siya", Age: 29}, "application/msgpack")
+	posted, _ := ioutil.ReadAll(reader)
+	resp, byt := call("PUT", "/user/Dlamini", "application/msgpack", "application/msgpack", posted)
+	u := User{}
+	if err := bytesToInterface(bytes.NewBuffer(byt), &u, "application/msgpack"); resp.StatusCode != 200 || err != nil || u.Id != "3" || u.FirstName != "Dlamini" || u.Age != 29 {
+		t.Errorf("msgpack postdata: %d %+v %v", resp.StatusCode, u, err)
+	}
+
+	// a message is sent as protobuf or json, as asked
+	resp, byt = call("GET", "/greeting", "application/x-protobuf", "", nil)
+	msg := new(wrapperspb.StringValue)
+	if err := bytesToInterface(bytes.NewBuffer(byt), msg, "application/x-protobuf"); resp.Header.Get("Content-Type") != "application/x-protobuf" || err != nil || msg.GetValue() != "hello" {
+		t.Errorf("protobuf output: %s %q %v", resp.Header.Get("Content-Type"), msg.GetValue(), err)
+	}
+	if resp, byt = call("GET", "/greeting", "application/json", "", nil); resp.Header.Get("Content-Type") != "application/json" || !bytes.Contains(byt, []byte("hello")) {
+		t.Errorf("json output of a message: %s %s", resp.Header.Get("Content-Type"), byt)
+	}
+}
+
+func TestNDJSONMarshall(t *testing.T) {
+	addMimeType("application/x-ndjson")
+
+	u := User{Id: "1", FirstName: "David", LastName: "Coperfield", Age: 20}
+	u2 := u
+	u2.Age = 30
+
+	// one document per element, anything else on a single line
+	reader, _ := interfaceToBytes([]User{u, u2}, "application/x-ndjson")
+	expected := `{"Id":"1","FirstName":"David","LastName":"Coperfield","Age":20,"Weight":0}` + "\n" + `{"Id":"1","FirstName":"David","LastName":"Coperfield","Age":30,"Weight":0}` + "\n"
+	if got := readerToString(reader, t); got != expected {
+		t.Errorf("Array marshall: got %q", got)
+	}
+	reader, _ = interfaceToBytes(&u, "application/x-ndjson")
+	if got := readerToString(reader, t); got != `{"Id":"1","FirstName":"David","LastName":"Coperfield","Age":20,"Weight":0}` + "\n" {
+		t.Errorf("Struct marshall: got %q", got)
+	}
+
+	users := make([]User, 0)
+	if err := bytesToInterface(bytes.NewBufferString(expected), &users, "application/x-ndjson"); err != nil {
+		t.Error("Error", err.Error())
+	} else if !reflect.DeepEqual(users, []User{u, u2}) {
+		t.Errorf("Array unmarshall: got %+v", users)
+	}
+
+	single := User{}
+	if err := bytesToInterface(bytes.NewBufferString(`{"FirstName":"Siya"}` + "\n"), &single, "application/x-ndjson"); err != nil || single.FirstName != "Siya" {
+		t.Errorf("Struct unmarshall: %+v %v", single, err)
+	}
+	if err := bytesToInterface(bytes.NewBufferString("{\"Age\":1}\nnot json\n"), &users, "application/x-ndjson"); err == nil {
+		t.Error("a bad line was accepted")
+	}
+}
+
+type yamlDoc struct {
+	Title	string			`json:"title"`
+	Tags	[]string		`json:"tags,omitempty"`
+	Meta	map[string]int		`json:"meta,omitempty"`
+	Note	string			`json:"-"`
+}
+
+type yamlService struct {
+	RestService	`root:"/yaml-service/" consumes:"application/json,application/yaml" produces:"application/json,application/yaml,application/x-yaml" swagger:"spec"`
+	doc		EndPoint	`method:"PUT" path:"/doc" postdata:"yamlDoc" output:"yamlDoc"`
+}
+
+func (serv yamlService) Doc(d yamlDoc) yamlDoc {
+	d.Tags = append(d.Tags, "seen")
+	return d
+}
+
+func TestYAMLMarshall(t *testing.T) {
+	addMimeType("application/yaml")
+
+	// keys in json order and json tags honoured
+	reader, err := interfaceToBytes(yamlDoc{Title: "Orders: 2024", Tags: []string{"a", "b"}, Meta: map[string]int{"v": 2}, Note: "x"}, "application/yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "title: 'Orders: 2024'\ntags:\n  - a\n  - b\nmeta:\n  v: 2\n"
+	if got := readerToString(reader, t); got != expected {
+		t.Errorf("Struct marshall: got %q, expected %q", got, expected)
+	}
+	reader, _ = interfaceToBytes(yamlDoc{Title: "empty"}, "application/yaml")
+	if got := readerToString(reader, t); got != "title: empty\n" {
+		t.Errorf("omitempty marshall: got %q", got)
+	}
+
+	d := yamlDoc{}
+	if err := bytesToInterface(bytes.NewBufferString(expected), &d, "application/yaml"); err != nil {
+		t.Error("Error", err.Error())
+	} else if !reflect.DeepEqual(d, yamlDoc{Title: "Orders: 2024", Tags: []string{"a", "b"}, Meta: map[string]int{"v": 2}}) {
+		t.Errorf("Struct unmarshall: got %+v", d)
+	}
+
+	users := make([]User, 0)
+	if err := bytesToInterface(bytes.NewBufferString("- FirstName: Siya\n  Age: 29\n- FirstName: David\n"), &users, "application/x-yaml"); err != nil {
+		t.Error("Error", err.Error())
+	} else if len(users) != 2 || users[0].FirstName != "Siya" || users[0].Age != 29 || users[1].FirstName != "David" {
+		t.Errorf("Array unmarshall: got %+v", users)
+	}
+
+	if err := bytesToInterface(bytes.NewBufferString("title: [unclosed"), &d, "application/yaml"); err == nil {
+		t.Error("invalid yaml was accepted")
+	}
+}
+
+func TestYAMLAcceptNegotiation(t *testing.T) {
+	RegisterDocumentor("swagger", &Documentor{func(string, map[string]ServiceMetaData, map[string]EndPointStruct, map[string]SecurityStruct) interface{} {
+		return map[string]interface{}{"swagger": "2.0", "info": map[string]string{"title": "yaml"}}
+	}})
+	RegisterService(new(yamlService))
+	srv := httptest.NewServer(Handle())
+	defer srv.Close()
+
+	call := func(method string, path string, accept string, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL + "/yaml-service/" + path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/yaml")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		byt, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(byt)
+	}
+
+	cases := []struct {
+		accept	string
+		mime	string
+		body	string
+	}{
+		{"application/yaml", "application/yaml", "title: report\ntags:\n  - seen\n"},
+		{"application/x-yaml", "application/x-yaml", "title: report\ntags:\n  - seen\n"},
+		{"application/json", "application/json", `{"title":"report","tags":["seen"]}`},
+	}
+	for _, tc := range cases {
+		resp, body := call("PUT", "doc", tc.accept, "title: report\n")
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != tc.mime || body != tc.body {
+			t.Errorf("Accept %q: got %d %s %q", tc.accept, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+	}
+
+	// the swagger document follows the same negotiation, json by default
+	swagger := []struct {
+		accept	string
+		mime	string
+		body	string
+	}{
+		{"application/yaml", "application/yaml", "info:\n  title: yaml\nswagger: \"2.0\"\n"},
+		{"", "application/json", `{"info":{"title":"yaml"},"swagger":"2.0"}`},
+		{"text/html", "application/json", `{"info":{"title":"yaml"},"swagger":"2.0"}`},
+	}
+	for _, tc := range swagger {
+		resp, body := call("GET", "spec", tc.accept, "")
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != tc.mime || body != tc.body {
+			t.Errorf("swagger Accept %q: got %d %s %q", tc.accept, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+//Counters of an endpoint since the process started. The SetMaxConcurrent cap is reported with path and method *.
+type EndpointMetrics struct {
+	Path		string
+	Method		string
+	RateLimited	uint64		// requests refused with 429
+	Shed		uint64		// requests refused with 503 by a concurrency limit
+	InFlight	int
+	Queued		int
+	ConcurrencyLimit int		// the current limit, below maxConcurrent while adaptive limiting holds it down
+	CacheHits	uint64		// responses served by the cache tag
+	CacheMisses	uint64
+}
+
+type endpointCounters struct {
+	path		string
+	method		string
+	rateLimited	uint64
+	cacheHits	uint64
+	cacheMisses	uint64
+	limiter		*concurrencyLimiter
+}
+
+var metricsMu sync.Mutex
+var metrics = make(map[string]*endpointCounters)
+
+func countersFor(ep EndPointStruct) *endpointCounters {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	c, found := metrics[ep.encSigniture]
+	if !found {
+		c = &endpointCounters{path: cleanPath(ep.Signiture), method: ep.RequestMethod, limiter: ep.concurrency}
+		metrics[ep.encSigniture] = c
+	}
+	return c
+}
+
+//Returns the counters of the endpoints that have any, by path and method
+func GetMetrics() []EndpointMetrics {
+	metricsMu.Lock()
+	output := make([]EndpointMetrics, 0, len(metrics) + 1)
+	for _, c := range metrics {
+		m := EndpointMetrics{
+			Path:		c.path,
+			Method:		c.method,
+			RateLimited:	atomic.LoadUint64(&c.rateLimited),
+			CacheHits:	atomic.LoadUint64(&c.cacheHits),
+			CacheMisses:	atomic.LoadUint64(&c.cacheMisses),
+		}
+		if c.limiter != nil {
+			c.limiter.metrics(&m)
+		}
+		output = append(output, m)
+	}
+	metricsMu.Unlock()
+
+	if global, _ := globalLimiter.Load().(*concurrencyLimiter); global != nil {
+		m := EndpointMetrics{Path: "*", Method: "*"}
+		global.metrics(&m)
+		output = append(output, m)
+	}
+
+	sort.Slice(output, func(i, j int) bool {
+		if output[i].Path == output[j].Path {
+			return output[i].Method < output[j].Method
+		}
+		return output[i].Path < output[j].Path
+	})
+	return output
+}
@@ -42,6 +42,12 @@ const (
 	Application_Siren_Json	  = "application/vnd.siren+json"
 	Application_Hal_Json	  = "application/hal+json"
 	Application_Patch_Json	  = "application/strategic-merge-patch+json"
+	Application_Protobuf      = "application/x-protobuf"
+	Application_Msgpack       = "application/msgpack"
+	Application_X_Msgpack     = "application/x-msgpack"
+	Application_X_Ndjson      = "application/x-ndjson"
+	Application_Yaml          = "application/yaml"
+	Application_X_Yaml        = "application/x-yaml"
 	Audio_Xaiff               = "audio/x-aiff"
 	Audio_Xwav                = "audio/x-wav"
 	Image_Cgm                 = "image/cgm"
@@ -64,6 +70,7 @@ const (
 	Multipart_VoiceMessage    = "multipart/voice-message"
 	Text_Enriched             = "text/enriched"
 	Text_Html                 = "text/html"
+	Text_Csv                  = "text/csv"
 	Text_Plain                = "text/plain"
 	Text_RichText             = "text/richtext"
 	Text_Sgml                 = "text/sgml"
@@ -58,7 +58,9 @@
 package gorest
 
 import (
+	"errors"
 	"github.com/rmullinnix461332/logger"
+	"net/http"
 	"reflect"
 	"strings"
 	"strconv"
@@ -88,6 +90,17 @@ const (
 	errorString_RegisterSameMethod = "Can not register two endpoints with same request-method(%s) and same signature: %s VS %s"
 	errorString_UniqueRoot = "Variable length endpoints can only be mounted on a unique root. Root already used: %s <> %s"
 	errorString_Gzip = "Service has invalid gzip value. Defaulting to off settings! %s"
+	errorString_TypeExpr = "Invalid type on the [%s] tag. Endpoint: %s (%s)"
+	errorString_Security = "Invalid security requirement:[%s], expecting scheme:[scope,...] joined by & (all) or | (any)"
+	errorString_RoleSecurity = "EndPoint %s has a role tag but no security, and its service has no realm with a registered RealmAuthorizer to identify callers"
+	errorString_Policy = "Invalid policy:[%s] on endpoint %s (%s)"
+	errorString_CORS = "The cors policy:[%s], is not registered. Please register this policy before registering your service."
+	errorString_CSRF = "Invalid csrf value, expecting true or none. Defaulting to cookie authenticated endpoints! %s"
+	errorString_RateLimit = "Invalid ratelimit:[%s] on %s (%s), expecting e.g. 100/m or 10/s, burst=20, key=ip, algo=window"
+	errorString_Concurrency = "Invalid maxConcurrent:[%s] on %s (%s), expecting e.g. 8 or 8, queue=16, timeout=2s, adaptive"
+	errorString_Cache = "Invalid cache:[%s] on %s (%s), expecting e.g. 30s or 5m, private on a GET endpoint"
+	errorString_ETag = "Invalid etag value, expecting strong, weak or none. Defaulting to no etag! %s"
+	errorString_NilCode = "Invalid nilcode value, expecting 404 or 204. Defaulting to 404! %s"
 )
 
 func prepServiceMetaData(root string, tags reflect.StructTag, i interface{}, name string) ServiceMetaData {
@@ -115,7 +128,7 @@ func prepServiceMetaData(root string, tags reflect.StructTag, i interface{}, nam
 	for i := 0; i < len(md.ConsumesMime); i++ {
 		mimeType := md.ConsumesMime[i]
 		if !addMimeType(mimeType) {
-			logger.Error.Fatalf("[fatal]", errorString_MarshalMimeType, mimeType)
+			logger.Error.Fatalf("[fatal] " + errorString_MarshalMimeType, mimeType)
 		}
 	}
 
@@ -131,14 +144,14 @@ func prepServiceMetaData(root string, tags reflect.StructTag, i interface{}, nam
 	for i := 0; i < len(md.ProducesMime); i++ {
 		mimeType := md.ProducesMime[i]
 		if !addMimeType(mimeType) {
-			logger.Error.Fatalf("[fatal]", errorString_MarshalMimeType, mimeType)
+			logger.Error.Fatalf("[fatal] " + errorString_MarshalMimeType, mimeType)
 		}
 	}
 
 	if tag := tags.Get("gzip"); tag != "" {
 		b, err := strconv.ParseBool(tag)
 		if err != nil {
-			logger.Warning.Printf("[gen]", errorString_Gzip, name)
+			logger.Warning.Printf("[gen] " + errorString_Gzip, name)
 			md.allowGzip = false
 		} else {
 			md.allowGzip = b
@@ -147,6 +160,35 @@ func prepServiceMetaData(root string, tags reflect.StructTag, i interface{}, nam
 		md.allowGzip = false
 	}
 
+	md.realm = tags.Get("realm")
+
+	if tag := tags.Get("security"); tag != "" && tag != "none" {
+		md.Security = parseSecurityTag(tag)
+	}
+
+	if tag := tags.Get("cors"); tag != "" {
+		md.cors = parseCORSTag(tag)
+	}
+
+	if tag := tags.Get("csrf"); tag != "" {
+		md.csrf = parseCSRFTag(tag, name)
+	}
+
+	if tag := tags.Get("ratelimit"); tag != "" && tag != "none" {
+		md.rateLimit = parseRateLimitTag(tag, name)
+	}
+
+	if tag := tags.Get("etag"); tag != "" {
+		md.etag = parseETagTag(tag, name)
+	}
+
+	md.nilCode = http.StatusNotFound
+	if tag := tags.Get("nilcode"); tag != "" {
+		if code := parseNilCode(tag, name); code != 0 {
+			md.nilCode = code
+		}
+	}
+
 	md.Template = i
 	return *md
 }
@@ -169,7 +211,7 @@ func makeEndPointStruct(tags reflect.StructTag, serviceRoot string) EndPointStru
 	if tag := tags.Get("method"); tag != "" {
 		ok := false
 		if ms.RequestMethod, ok = methodMap[tag]; !ok {
-			logger.Error.Fatalf("[fatal]", errorString_UnknownMethod, tag)
+			logger.Error.Fatalf("[fatal] " + errorString_UnknownMethod, tag)
 		}
 
 		if tag := tags.Get("path"); tag != "" {
@@ -181,50 +223,39 @@ func makeEndPointStruct(tags reflect.StructTag, serviceRoot string) EndPointStru
 		}
 
 		if tag := tags.Get("output"); tag != "" {
-			ms.OutputType = tag
-			if strings.HasPrefix(tag, "[]") { //Check for slice/array/list types.
-				ms.OutputTypeIsArray = true
-				ms.OutputType = ms.OutputType[2:]
-			}
-			if strings.HasPrefix(tag, "map[") { //Check for map[string]. We only handle string keyed maps!!!
-
-				if ms.OutputType[4:10] == "string" {
-					ms.OutputTypeIsMap = true
-					ms.OutputType = ms.OutputType[11:]
-				} else {
-					logger.Error.Fatalf("[fatal]", errorString_StringMap, "output", ms.Signiture)
-				}
-
-			}
+			ms.OutputTypeExpr = parseTagType(tag, "output", ms.Signiture)
+			ms.OutputType, ms.OutputTypeIsArray, ms.OutputTypeIsMap = legacyTypeName(ms.OutputTypeExpr)
 		}
 
 		if tag := tags.Get("postdata"); tag != "" {
-			ms.PostdataType = tag
-			if strings.HasPrefix(tag, "[]") { //Check for slice/array/list types.
-				ms.postdataTypeIsArray = true
-				ms.PostdataType = ms.PostdataType[2:]
-			}
-			if strings.HasPrefix(tag, "map[") { //Check for map[string]. We only handle string keyed maps!!!
+			ms.PostdataTypeExpr = parseTagType(tag, "postdata", ms.Signiture)
+			ms.PostdataType, ms.postdataTypeIsArray, ms.postdataTypeIsMap = legacyTypeName(ms.PostdataTypeExpr)
+		}
 
-				if ms.PostdataType[4:10] == "string" {
-					ms.postdataTypeIsMap = true
-					ms.PostdataType = ms.PostdataType[11:]
-				} else {
-					logger.Error.Fatalf("[fatal]", errorString_StringMap, "postdata", ms.Signiture)
-				}
+		if tag := tags.Get("nilcode"); tag != "" {
+			ms.nilCode = parseNilCode(tag, ms.Signiture)
+		}
 
+		// any one of the listed roles, or permissions granted by a role, is sufficient
+		if tag := tags.Get("role"); tag != "" {
+			for _, role := range strings.Split(tag, ",") {
+				if role = strings.TrimSpace(role); role != "" {
+					ms.Roles = append(ms.Roles, role)
+				}
 			}
 		}
 
-		if tag := tags.Get("role"); tag != "" {
-			ms.role = tag
+		// checked once the arguments are bound, e.g. policy:"orders:read if principal.tenant == path.tenantId"
+		if tag := tags.Get("policy"); tag != "" {
+			if err := getPolicyEngine().Validate(tag); err != nil {
+				logger.Error.Fatalf("[fatal] " + errorString_Policy, tag, ms.Signiture, err.Error())
+			}
+			ms.Policy = tag
 		}
 
+		// left empty when not tagged so the service level mime types are inherited
 		ms.ConsumesMime = make([]string, 0)
-		if tag = tags.Get("consumes"); tag == "" {
-			tag = Application_Json // Default
-			ms.ConsumesMime = append(ms.ConsumesMime, tag)
-		} else {
+		if tag = tags.Get("consumes"); tag != "" {
 			cons := strings.Split(tag, ",")
 			ms.ConsumesMime = append(ms.ConsumesMime, cons...)
 		}
@@ -232,15 +263,12 @@ func makeEndPointStruct(tags reflect.StructTag, serviceRoot string) EndPointStru
 		for i := 0; i < len(ms.ConsumesMime); i++ {
 			mimeType := ms.ConsumesMime[i]
 			if !addMimeType(mimeType) {
-				logger.Error.Fatalf("[fatal]", errorString_MarshalMimeType, mimeType)
+				logger.Error.Fatalf("[fatal] " + errorString_MarshalMimeType, mimeType)
 			}
 		}
 
 		ms.ProducesMime = make([]string, 0)
-		if tag = tags.Get("produces"); tag == "" {
-			tag = Application_Json // Default
-			ms.ProducesMime = append(ms.ProducesMime, tag)
-		} else {
+		if tag = tags.Get("produces"); tag != "" {
 			prods := strings.Split(tag, ",")
 			ms.ProducesMime = append(ms.ProducesMime, prods...)
 		}
@@ -248,14 +276,14 @@ func makeEndPointStruct(tags reflect.StructTag, serviceRoot string) EndPointStru
 		for i := 0; i < len(ms.ProducesMime); i++ {
 			mimeType := ms.ProducesMime[i]
 			if !addMimeType(mimeType) {
-				logger.Error.Fatalf("[fatal]", errorString_MarshalMimeType, mimeType)
+				logger.Error.Fatalf("[fatal] " + errorString_MarshalMimeType, mimeType)
 			}
 		}
 
 		if tag := tags.Get("gzip"); tag != "" {
 			b, err := strconv.ParseBool(tag)
 			if err != nil {
-				logger.Warning.Printf("[gen]", errorString_Gzip, ms.Name)
+				logger.Warning.Printf("[gen] " + errorString_Gzip, ms.Name)
 				ms.allowGzip = 2
 			} else if b {
 				ms.allowGzip = 1
@@ -266,27 +294,42 @@ func makeEndPointStruct(tags reflect.StructTag, serviceRoot string) EndPointStru
 			ms.allowGzip = 2
 		}
 
-		if tag := tags.Get("security"); tag != "" {
-			scopes := make([]string, 0)
-
-			if ms.SecurityScheme == nil {
-				ms.SecurityScheme = make(map[string][]string)
-			}
-			name := tag
-			if cindex := strings.Index(tag, ":"); cindex > -1 {
-				name = tag[:strings.Index(tag, ":")]
+		if tag := tags.Get("security"); tag == "none" {
+			ms.public = true
+		} else if tag != "" {
+			ms.Security = parseSecurityTag(tag)
+			ms.SecurityScheme = securitySchemes(ms.Security)
+		}
+		if tag := tags.Get("cors"); tag != "" {
+			ms.cors = parseCORSTag(tag)
+		}
+		if tag := tags.Get("csrf"); tag != "" {
+			ms.csrf = parseCSRFTag(tag, ms.Signiture)
+		}
+		if tag := tags.Get("etag"); tag != "" {
+			ms.etag = parseETagTag(tag, ms.Signiture)
+		}
+		if tag := tags.Get("cache"); tag != "" {
+			opts, err := parseCacheTag(tag)
+			if err == nil && ms.RequestMethod != GET {
+				err = errors.New("only GET responses are cached")
 			}
-
-			if GetAuthorizer(name) == nil {
-				logger.Error.Fatalf("[fatal]", errorString_Scheme, name)
+			if err != nil {
+				logger.Error.Fatalf("[fatal] " + errorString_Cache, tag, ms.Signiture, err.Error())
 			}
-
-			if strings.Index(tag, "[") > -1 {
-				scp := tag[strings.Index(tag, "[")+1:strings.Index(tag, "]")]
-				items := strings.Split(scp, ",")
-				scopes = append(scopes, items...)
+			ms.cache = opts
+		}
+		if tag := tags.Get("maxConcurrent"); tag != "" {
+			opts, err := parseConcurrency(tag)
+			if err != nil {
+				logger.Error.Fatalf("[fatal] " + errorString_Concurrency, tag, ms.Signiture, err.Error())
 			}
-			ms.SecurityScheme[name] = scopes 
+			ms.concurrency = newConcurrencyLimiter(opts)
+		}
+		if tag := tags.Get("ratelimit"); tag == "none" {
+			ms.rateLimit = &RateLimit{}
+		} else if tag != "" {
+			ms.rateLimit = parseRateLimitTag(tag, ms.Signiture)
 		}
 		if tag := tags.Get("perflog"); tag != "" {
 			ms.perfLog = (tag == "true")
@@ -300,6 +343,47 @@ func makeEndPointStruct(tags reflect.StructTag, serviceRoot string) EndPointStru
 	return *ms //Should not get here
 }
 
+func parseTagType(tag string, tagName string, sig string) *TypeExpr {
+	te, err := ParseTypeExpr(tag)
+	if err != nil {
+		logger.Error.Fatalf("[fatal] " + errorString_TypeExpr, tagName, sig, err.Error())
+	}
+
+	// walk down to check every map in the expression is string keyed
+	for item := te; item.Kind != NamedType && item.Kind != InterfaceType; item = item.Elem {
+		if item.Kind == MapType && item.Key.String() != "string" {
+			logger.Error.Fatalf("[fatal] " + errorString_StringMap, tagName, sig)
+		}
+	}
+
+	return te
+}
+
+// the outer slice or map of an expression, kept in OutputType/PostdataType for documentors written
+// against the original tags, e.g. *[]User gives User and [][]int gives []int with isArray set
+func legacyTypeName(te *TypeExpr) (string, bool, bool) {
+	if te.Kind == PointerType {
+		te = te.Elem
+	}
+
+	switch te.Kind {
+	case SliceType:
+		return te.Elem.String(), true, false
+	case MapType:
+		return te.Elem.String(), false, true
+	}
+	return te.String(), false, false
+}
+
+func parseNilCode(tag string, name string) int {
+	code, err := strconv.Atoi(tag)
+	if err != nil || (code != http.StatusNotFound && code != http.StatusNoContent) {
+		logger.Warning.Printf("[gen] " + errorString_NilCode, name)
+		return 0
+	}
+	return code
+}
+
 func encodeSigniture(path string, add bool, parmAsString bool) string {
 	if strings.Index(path, "?") > -1 {
 		path = path[:strings.Index(path, "?")]
@@ -390,7 +474,11 @@ func prepSecurityMetaData(tags reflect.StructTag) SecurityStruct {
 
 func addMimeType(mimeType string) bool {
 	if GetMarshallerByMime(mimeType) == nil {
-		if strings.Contains(mimeType, "json") {
+		if strings.Contains(mimeType, "ndjson") {
+			RegisterMarshaller("ndjson", NewNDJSONMarshaller())
+		} else if strings.Contains(mimeType, "csv") {
+			RegisterMarshaller("csv", NewCSVMarshaller())
+		} else if strings.Contains(mimeType, "json") {
 			RegisterMarshaller("json", NewJSONMarshaller())
 		} else if strings.Contains(mimeType, "xml") {
 			RegisterMarshaller("xml", NewXMLMarshaller())
@@ -400,6 +488,12 @@ func addMimeType(mimeType string) bool {
 			RegisterMarshaller("x-www-form-urlencodedxml", NewFormMarshaller())
 		} else if strings.Contains(mimeType, "form-data") {
 			RegisterMarshaller("form-data", NewJSONMarshaller())
+		} else if strings.Contains(mimeType, "protobuf") {
+			RegisterMarshaller("protobuf", NewProtobufMarshaller())
+		} else if strings.Contains(mimeType, "msgpack") {
+			RegisterMarshaller("msgpack", NewMsgpackMarshaller())
+		} else if strings.Contains(mimeType, "yaml") {
+			RegisterMarshaller("yaml", NewYAMLMarshaller())
 		} else {
 			return false
 		}
@@ -616,7 +710,7 @@ func parseVarPathArgs(ep *EndPointStruct, pathPart string) map[string]string {
 	varsPart := strings.Trim(pathPart[len(ep.root):], "/")
 
 	for upos, str1 := range strings.Split(varsPart, "/") {
-		pathArgs[string(upos)] = strings.Trim(str1, " ")
+		pathArgs[strconv.Itoa(upos)] = strings.Trim(str1, " ")
 	}
 	return pathArgs
 }
@@ -662,3 +756,106 @@ func parseQueryArgs(ep *EndPointStruct, queryPart string) (map[string]string, st
 
 	return queryArgs, xsrft
 }
+
+// security:"Key&Jwt:[read,write]|Basic" - alternatives separated by |, schemes that must all pass joined by &
+func parseSecurityTag(tag string) []SecurityRequirement {
+	reqs := make([]SecurityRequirement, 0)
+
+	for _, alt := range splitOutsideBrackets(tag, '|') {
+		req := make(SecurityRequirement)
+		for _, item := range splitOutsideBrackets(alt, '&') {
+			item = strings.TrimSpace(item)
+			name := item
+			scopes := make([]string, 0)
+
+			if cindex := strings.Index(item, ":"); cindex > -1 {
+				name = item[:cindex]
+				scp := item[cindex+1:]
+				if !strings.HasPrefix(scp, "[") || !strings.HasSuffix(scp, "]") {
+					logger.Error.Fatalf("[fatal] " + errorString_Security, tag)
+				}
+				if scp = scp[1:len(scp)-1]; scp != "" {
+					scopes = append(scopes, strings.Split(scp, ",")...)
+				}
+			}
+
+			if name == "" {
+				logger.Error.Fatalf("[fatal] " + errorString_Security, tag)
+			}
+			if GetAuthorizer(name) == nil {
+				logger.Error.Fatalf("[fatal] " + errorString_Scheme, name)
+			}
+			req[name] = scopes
+		}
+		reqs = append(reqs, req)
+	}
+
+	return reqs
+}
+
+func splitOutsideBrackets(str string, sep byte) []string {
+	parts := make([]string, 0)
+	depth := 0
+	start := 0
+	for i := 0; i < len(str); i++ {
+		switch str[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case sep:
+			if depth == 0 {
+				parts = append(parts, str[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, str[start:])
+}
+
+// cors:"partners" names a policy from RegisterCORSPolicy, cors:"none" turns CORS off
+func parseCORSTag(tag string) string {
+	if tag != "none" && !corsRegistered(tag) {
+		logger.Error.Fatalf("[fatal] " + errorString_CORS, tag)
+	}
+	return tag
+}
+
+func parseRateLimitTag(tag string, name string) *RateLimit {
+	limit, err := parseRateLimit(tag)
+	if err != nil {
+		logger.Error.Fatalf("[fatal] " + errorString_RateLimit, tag, name, err.Error())
+	}
+	return limit
+}
+
+// etag:"true" is a strong etag
+func parseETagTag(tag string, name string) string {
+	switch tag {
+	case "strong", "true":
+		return "strong"
+	case "weak", "none":
+		return tag
+	}
+	logger.Warning.Printf("[gen] " + errorString_ETag, name)
+	return "none"
+}
+
+func parseCSRFTag(tag string, name string) string {
+	if tag == "true" || tag == "none" {
+		return tag
+	}
+	logger.Warning.Printf("[gen] " + errorString_CSRF, name)
+	return ""
+}
+
+// every scheme named by the requirements, with the scopes of all of them
+func securitySchemes(reqs []SecurityRequirement) map[string][]string {
+	schemes := make(map[string][]string)
+	for _, req := range reqs {
+		for name, scopes := range req {
+			schemes[name] = append(schemes[name], scopes...)
+		}
+	}
+	return schemes
+}
@@ -29,7 +29,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
+	"net/http"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 )
 // Helper to get a string out of the ReaderCloser
@@ -158,3 +161,105 @@ func TestBytesToI(t *testing.T) {
 	}
 
 }
+
+func TestParseTypeExpr(t *testing.T) {
+	cases := []struct {
+		expr	string
+		kind	TypeKind
+		out	string
+		err	string
+	}{
+		{"User", NamedType, "User", ""},
+		{" int ", NamedType, "int", ""},
+		{"*User", PointerType, "*User", ""},
+		{"[]string", SliceType, "[]string", ""},
+		{"[][]int", SliceType, "[][]int", ""},
+		{"*[]*models.User", PointerType, "*[]*models.User", ""},
+		{"map[string]int", MapType, "map[string]int", ""},
+		{"map[string][]models.User", MapType, "map[string][]models.User", ""},
+		{"map[string]map[int]*User", MapType, "map[string]map[int]*User", ""},
+		{"interface{}", InterfaceType, "interface{}", ""},
+		{"[]any", SliceType, "[]interface{}", ""},
+		{"github.com/acme/models.User", NamedType, "github.com/acme/models.User", ""},
+		{"", 0, "", "missing type"},
+		{"*", 0, "", "missing type"},
+		{"[]", 0, "", "missing type"},
+		{"map[string", 0, "", "missing ] after map key"},
+		{"map[]int", 0, "", "unexpected ]int"},
+		{"User]", 0, "", "unexpected ]"},
+		{"User extra", 0, "", "unexpected  extra"},
+		{"{}", 0, "", "unexpected {}"},
+	}
+
+	for _, tc := range cases {
+		te, err := ParseTypeExpr(tc.expr)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", tc.expr, err)
+			} else if te.Kind != tc.kind || te.String() != tc.out {
+				t.Errorf("%q: expected kind %d %q, got kind %d %q", tc.expr, tc.kind, tc.out, te.Kind, te.String())
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: expected error containing %q, got %v", tc.expr, tc.err, err)
+		}
+	}
+
+	te, _ := ParseTypeExpr("map[string][]*models.User")
+	if base := te.Base(); base.Name != "models.User" || base.BaseName() != "User" {
+		t.Error("base of a nested type:", base)
+	}
+}
+
+func TestTypeExprMatches(t *testing.T) {
+	// the output of each method signature
+	out := func(fn interface{}) reflect.Type {
+		return reflect.TypeOf(fn).Out(0)
+	}
+
+	cases := []struct {
+		expr	string
+		typ	reflect.Type
+		match	bool
+	}{
+		{"User", out(func() User { return User{} }), true},
+		{"*User", out(func() *User { return nil }), true},
+		{"User", out(func() *User { return nil }), false},
+		{"*User", out(func() User { return User{} }), false},
+		{"gorest.User", out(func() User { return User{} }), true},
+		{"github.com/rmullinnix461332/gorest.User", out(func() User { return User{} }), true},
+		{"models.User", out(func() User { return User{} }), false},
+		{"[]User", out(func() []User { return nil }), true},
+		{"[]User", out(func() [2]User { return [2]User{} }), true},
+		{"[]*User", out(func() []User { return nil }), false},
+		{"[][]int", out(func() [][]int { return nil }), true},
+		{"map[string]User", out(func() map[string]User { return nil }), true},
+		{"map[int]User", out(func() map[string]User { return nil }), false},
+		{"interface{}", out(func() interface{} { return nil }), true},
+		{"any", out(func() interface{} { return nil }), true},
+		{"interface{}", out(func() error { return nil }), false},
+		{"string", out(func() string { return "" }), true},
+		{"int", out(func() int64 { return 0 }), false},
+	}
+
+	for _, tc := range cases {
+		te, err := ParseTypeExpr(tc.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.expr, err)
+		}
+		if te.Matches(tc.typ) != tc.match {
+			t.Errorf("%q against %s: expected match %v", tc.expr, tc.typ, tc.match)
+		}
+		if tc.match && !typeExprOf(tc.typ).Matches(tc.typ) {
+			t.Errorf("%s does not match its own description %s", tc.typ, typeExprOf(tc.typ))
+		}
+	}
+}
+
+func TestParseNilCode(t *testing.T) {
+	cases := map[string]int{"404": http.StatusNotFound, "204": http.StatusNoContent, "200": 0, "none": 0}
+	for tag, code := range cases {
+		if got := parseNilCode(tag, "item"); got != code {
+			t.Errorf("nilcode:%q: expected %d, got %d", tag, code, got)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rmullinnix461332/logger"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+//What a policy is evaluated against: the caller and the request's bound arguments
+type PolicyInput struct {
+	Principal	*Principal
+	Method		string
+	Path		string			// the endpoint's path, e.g. tenants/{tenantId}/orders
+	PathArgs	map[string]string
+	QueryArgs	map[string]string
+	Body		interface{}		// the unmarshalled postdata, nil when the endpoint has none
+}
+
+type PolicyDecision struct {
+	Allow		bool
+	Rule		string			// the rule that allowed the request
+	Reason		string			// why the request was refused
+}
+
+//Evaluates the policy tag of endpoints, after the arguments are bound and before the method is invoked
+type PolicyEngine interface {
+	//Called when a service is registered, an error stops the registration
+	Validate(policy string) error
+	Decide(policy string, in *PolicyInput) PolicyDecision
+}
+
+var policyMu sync.RWMutex
+var policyEngine PolicyEngine = NewExpressionPolicies()
+
+//Replaces the default ExpressionPolicies engine, register it before the services using it
+func RegisterPolicyEngine(engine PolicyEngine) {
+	if engine == nil {
+		logger.Error.Panicln("[sec] policy engine can not be nil")
+	}
+	policyMu.Lock()
+	policyEngine = engine
+	policyMu.Unlock()
+}
+
+func getPolicyEngine() PolicyEngine {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return policyEngine
+}
+
+//The default policy engine. A policy is a list of rules separated by ; and any one rule allows the request:
+//
+//  orders:read if principal.tenant == path.tenantId
+//  orders:write if principal.tenant == path.tenantId && body.customer.id == principal.sub; admin
+//  if query.visibility == 'public' || principal.sub in body.owners
+//
+//The leading permission must be a scope or a role (or a permission granted by a role) of the principal.
+//Conditions compare principal.<sub|tenant|scopes|roles|claim>, path.<param>, query.<param>,
+//body.<field>[.<field>...] and quoted or numeric literals with ==, != and in, joined by && and ||
+//(&& binds tighter). An attribute that is not present never satisfies a comparison.
+type ExpressionPolicies struct {
+	mu		sync.RWMutex
+	compiled	map[string][]policyRule
+}
+
+func NewExpressionPolicies() *ExpressionPolicies {
+	return &ExpressionPolicies{compiled: make(map[string][]policyRule)}
+}
+
+func (e *ExpressionPolicies) Validate(policy string) error {
+	_, err := e.compile(policy)
+	return err
+}
+
+func (e *ExpressionPolicies) Decide(policy string, in *PolicyInput) PolicyDecision {
+	rules, err := e.compile(policy)
+	if err != nil {
+		return PolicyDecision{Reason: err.Error()}
+	}
+
+	reasons := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		if ok, reason := rule.allows(in); ok {
+			return PolicyDecision{Allow: true, Rule: rule.text}
+		} else {
+			reasons = append(reasons, rule.text + ": " + reason)
+		}
+	}
+	return PolicyDecision{Reason: strings.Join(reasons, "; ")}
+}
+
+func (e *ExpressionPolicies) compile(policy string) ([]policyRule, error) {
+	e.mu.RLock()
+	rules, found := e.compiled[policy]
+	e.mu.RUnlock()
+	if found {
+		return rules, nil
+	}
+
+	rules, err := parsePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.compiled[policy] = rules
+	e.mu.Unlock()
+	return rules, nil
+}
+
+type policyRule struct {
+	text		string
+	permission	string
+	anyOf		[][]policyCompare	// alternatives (||) of comparisons that must all hold (&&)
+}
+
+type policyCompare struct {
+	left		policyOperand
+	op		string
+	right		policyOperand
+}
+
+type policyOperand struct {
+	literal		bool
+	value		string		// the literal, or the attribute's source: principal, path, query or body
+	fields		[]string
+}
+
+type policyToken struct {
+	text		string
+	quoted		bool
+}
+
+func (rule policyRule) allows(in *PolicyInput) (bool, string) {
+	if rule.permission != "" {
+		p := in.Principal
+		if p == nil {
+			return false, "no authenticated principal"
+		}
+		if !p.HasScope(rule.permission) && !HasRole(p, []string{rule.permission}) {
+			return false, "permission " + rule.permission + " not held"
+		}
+	}
+	if len(rule.anyOf) == 0 {
+		return true, ""
+	}
+
+	for _, all := range rule.anyOf {
+		matched := true
+		for _, cmp := range all {
+			if !cmp.holds(in) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true, ""
+		}
+	}
+	return false, "condition not met"
+}
+
+func (cmp policyCompare) holds(in *PolicyInput) bool {
+	left := cmp.left.resolve(in)
+	right := cmp.right.resolve(in)
+	if len(left) == 0 || len(right) == 0 {
+		return false
+	}
+
+	switch cmp.op {
+	case "==":
+		return len(left) == 1 && len(right) == 1 && left[0] == right[0]
+	case "!=":
+		return len(left) == 1 && len(right) == 1 && left[0] != right[0]
+	case "in":
+		if len(left) != 1 {
+			return false
+		}
+		for i := range right {
+			if right[i] == left[0] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the values of the operand, empty when the attribute is not present
+func (op policyOperand) resolve(in *PolicyInput) []string {
+	if op.literal {
+		return []string{op.value}
+	}
+
+	switch op.value {
+	case "path":
+		if value, found := in.PathArgs[op.fields[0]]; found {
+			return []string{value}
+		}
+	case "query":
+		if value, found := in.QueryArgs[op.fields[0]]; found && value != "" {
+			return []string{value}
+		}
+	case "principal":
+		p := in.Principal
+		if p == nil {
+			return nil
+		}
+		switch op.fields[0] {
+		case "sub", "subject":
+			return policyValues(p.Subject)
+		case "tenant":
+			return policyValues(p.Tenant)
+		case "scopes":
+			return p.Scopes
+		case "roles":
+			rbacMu.RLock()
+			resolver := roleResolver
+			rbacMu.RUnlock()
+			return resolver(p)
+		}
+		if claim, found := p.Claims[op.fields[0]]; found {
+			return policyValues(walkPolicyFields(reflect.ValueOf(claim), op.fields[1:]))
+		}
+	case "body":
+		if in.Body != nil {
+			return policyValues(walkPolicyFields(reflect.ValueOf(in.Body), op.fields))
+		}
+	}
+	return nil
+}
+
+// follows map keys and struct fields (by name or json name, ignoring case) down from v
+func walkPolicyFields(v reflect.Value, fields []string) interface{} {
+	for _, name := range fields {
+		for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+			v = v.Elem()
+		}
+		if !v.IsValid() {
+			return nil
+		}
+
+		switch v.Kind() {
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return nil
+			}
+			v = v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+		case reflect.Struct:
+			v = policyField(v, name)
+		default:
+			return nil
+		}
+	}
+
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Interface()
+}
+
+func policyField(v reflect.Value, name string) reflect.Value {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		jsonName := strings.Split(f.Tag.Get("json"), ",")[0]
+		if strings.EqualFold(f.Name, name) || (jsonName != "" && strings.EqualFold(jsonName, name)) {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// a scalar as one value, a slice as its elements, nil and empty strings as no value
+func policyValues(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []string:
+		return v
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		values := make([]string, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			values = append(values, fmt.Sprint(rv.Index(i).Interface()))
+		}
+		return values
+	case reflect.Map, reflect.Struct:
+		return nil
+	}
+	return []string{fmt.Sprint(value)}
+}
+
+func parsePolicy(policy string) ([]policyRule, error) {
+	tokens, err := tokenizePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]policyRule, 0)
+	start := 0
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) && !(tokens[i].text == ";" && !tokens[i].quoted) {
+			continue
+		}
+		if i > start {
+			rule, err := parsePolicyRule(tokens[start:i])
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+		start = i + 1
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("empty policy")
+	}
+	return rules, nil
+}
+
+func parsePolicyRule(tokens []policyToken) (policyRule, error) {
+	var rule	policyRule
+
+	texts := make([]string, len(tokens))
+	for i := range tokens {
+		texts[i] = tokens[i].text
+		if tokens[i].quoted {
+			texts[i] = "'" + tokens[i].text + "'"
+		}
+	}
+	rule.text = strings.Join(texts, " ")
+
+	pos := 0
+	if !isPolicyWord(tokens[0], "if") {
+		rule.permission = tokens[0].text
+		pos = 1
+	}
+	if pos == len(tokens) {
+		return rule, nil
+	}
+	if !isPolicyWord(tokens[pos], "if") {
+		return rule, errors.New("expecting if after " + rule.permission + " in rule: " + rule.text)
+	}
+	pos++
+
+	all := make([]policyCompare, 0)
+	for {
+		if pos + 3 > len(tokens) {
+			return rule, errors.New("incomplete condition in rule: " + rule.text)
+		}
+		left, err := parsePolicyOperand(tokens[pos])
+		if err != nil {
+			return rule, err
+		}
+		op := tokens[pos + 1]
+		if op.quoted || (op.text != "==" && op.text != "!=" && op.text != "in") {
+			return rule, errors.New("expecting ==, != or in, found " + op.text + " in rule: " + rule.text)
+		}
+		right, err := parsePolicyOperand(tokens[pos + 2])
+		if err != nil {
+			return rule, err
+		}
+		all = append(all, policyCompare{left: left, op: op.text, right: right})
+		pos += 3
+
+		if pos == len(tokens) {
+			rule.anyOf = append(rule.anyOf, all)
+			return rule, nil
+		}
+		switch {
+		case isPolicyWord(tokens[pos], "&&"):
+		case isPolicyWord(tokens[pos], "||"):
+			rule.anyOf = append(rule.anyOf, all)
+			all = make([]policyCompare, 0)
+		default:
+			return rule, errors.New("expecting && or ||, found " + tokens[pos].text + " in rule: " + rule.text)
+		}
+		pos++
+	}
+}
+
+func parsePolicyOperand(token policyToken) (policyOperand, error) {
+	if token.quoted || strings.IndexAny(token.text[:1], "-0123456789") == 0 {
+		return policyOperand{literal: true, value: token.text}, nil
+	}
+	// a bare word is most likely a misspelt attribute, which would compare as a string and never match
+	if !strings.Contains(token.text, ".") {
+		return policyOperand{}, errors.New("unknown attribute " + token.text + ", quote string literals e.g. '" + token.text + "'")
+	}
+
+	parts := strings.Split(token.text, ".")
+	switch parts[0] {
+	case "principal", "path", "query", "body":
+	default:
+		return policyOperand{}, errors.New("unknown attribute " + token.text + ", expecting principal., path., query. or body.")
+	}
+	for i := 1; i < len(parts); i++ {
+		if parts[i] == "" {
+			return policyOperand{}, errors.New("invalid attribute " + token.text)
+		}
+	}
+	if (parts[0] == "path" || parts[0] == "query") && len(parts) != 2 {
+		return policyOperand{}, errors.New("invalid attribute " + token.text + ", expecting " + parts[0] + ".<param>")
+	}
+	return policyOperand{value: parts[0], fields: parts[1:]}, nil
+}
+
+func isPolicyWord(token policyToken, word string) bool {
+	return !token.quoted && token.text == word
+}
+
+func tokenizePolicy(policy string) ([]policyToken, error) {
+	tokens := make([]policyToken, 0)
+	for i := 0; i < len(policy); {
+		c := policy[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(policy[i+1:], c)
+			if end < 0 {
+				return nil, errors.New("unterminated string in policy: " + policy)
+			}
+			tokens = append(tokens, policyToken{text: policy[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		case c == ';':
+			tokens = append(tokens, policyToken{text: ";"})
+			i++
+		case strings.HasPrefix(policy[i:], "=="), strings.HasPrefix(policy[i:], "!="),
+			strings.HasPrefix(policy[i:], "&&"), strings.HasPrefix(policy[i:], "||"):
+			tokens = append(tokens, policyToken{text: policy[i : i+2]})
+			i += 2
+		default:
+			end := i
+			for end < len(policy) && !strings.ContainsRune(" \t'\";=!&|", rune(policy[end])) {
+				end++
+			}
+			if end == i {
+				return nil, errors.New("unexpected " + string(c) + " in policy: " + policy)
+			}
+			tokens = append(tokens, policyToken{text: policy[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// evaluates the endpoint's policy tag with the registered engine, logging the decision
+func authorizePolicy(rb *ResponseBuilder, ep EndPointStruct, args map[string]string, queryArgs map[string]string, body interface{}) bool {
+	in := &PolicyInput{
+		Principal:	rb.ctx.principal,
+		Method:		ep.RequestMethod,
+		Path:		cleanPath(ep.Signiture),
+		PathArgs:	args,
+		QueryArgs:	queryArgs,
+		Body:		body,
+	}
+	decision := getPolicyEngine().Decide(ep.Policy, in)
+
+	url := rb.ctx.request.URL.Path
+	if decision.Allow {
+		logger.Trace.Println("[sec] policy subject: " + rb.subject() + " method: " + ep.RequestMethod + " url: " + url + " allow: true rule: " + decision.Rule)
+		return true
+	}
+	logger.Warning.Println("[sec] policy subject: " + rb.subject() + " method: " + ep.RequestMethod + " url: " + url + " allow: false reason: " + decision.Reason)
+
+	code := http.StatusForbidden
+	if rb.ctx.principal == nil {
+		code = http.StatusUnauthorized
+	}
+	rb.SetResponseCode(code)
+	rb.SetResponseMsg(http.StatusText(code))
+	return false
+}
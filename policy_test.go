@@ -0,0 +1,155 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"strings"
+	"testing"
+)
+
+type policyOrder struct {
+	Customer	struct {
+		Id	string
+	}
+	Lines		[]string
+}
+
+func TestParsePolicy(t *testing.T) {
+	cases := []struct {
+		policy	string
+		rules	int
+		err	string
+	}{
+		{"admin", 1, ""},
+		{"orders:read if path.tenantId == principal.tenant", 1, ""},
+		{"if principal.sub == 'bob'", 1, ""},
+		{"orders:read if path.id == '7' && query.view != \"full\" || principal.sub in principal.scopes; admin", 2, ""},
+		{"a; ; b", 2, ""},
+		{"", 0, "empty policy"},
+		{"admin if", 0, "incomplete condition"},
+		{"admin if path.id", 0, "incomplete condition"},
+		{"admin principal.sub == 'x'", 0, "expecting if"},
+		{"admin if path.id > '3'", 0, "expecting ==, != or in"},
+		{"admin if path.id = '3'", 0, "unexpected ="},
+		{"admin if path.id == '3' and path.x == '4'", 0, "expecting && or ||"},
+		{"admin if header.x == 'y'", 0, "unknown attribute header.x"},
+		{"admin if path.a.b == 'y'", 0, "expecting path.<param>"},
+		{"admin if body..id == 'y'", 0, "invalid attribute"},
+		{"admin if principal.subject == owner", 0, "unknown attribute owner"},
+		{"admin if subject == 'bob'", 0, "unknown attribute subject"},
+		{"admin if path.id == -1", 1, ""},
+		{"admin if path.id == 'open", 0, "unterminated string"},
+	}
+
+	for _, tc := range cases {
+		rules, err := parsePolicy(tc.policy)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", tc.policy, err)
+			} else if len(rules) != tc.rules {
+				t.Errorf("%q: expected %d rules, got %d", tc.policy, tc.rules, len(rules))
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: expected error containing %q, got %v", tc.policy, tc.err, err)
+		}
+	}
+}
+
+func TestDecidePolicy(t *testing.T) {
+	order := &policyOrder{Lines: []string{"a", "b"}}
+	order.Customer.Id = "bob"
+
+	in := &PolicyInput{
+		Principal:	&Principal{
+			Subject:	"bob",
+			Tenant:		"acme",
+			Scopes:		[]string{"orders:read"},
+			Claims:		map[string]interface{}{"roles": []interface{}{"clerk"}, "dept": map[string]interface{}{"name": "sales"}},
+		},
+		Method:		GET,
+		PathArgs:	map[string]string{"tenantId": "acme", "id": "7"},
+		QueryArgs:	map[string]string{"view": "full", "empty": ""},
+		Body:		order,
+	}
+
+	cases := []struct {
+		policy	string
+		allow	bool
+	}{
+		{"orders:read", true},
+		{"orders:write", false},
+		{"clerk", true},
+		{"orders:read if path.tenantId == principal.tenant", true},
+		{"orders:read if path.tenantId != principal.tenant", false},
+		{"if body.customer.id == principal.sub", true},
+		{"if principal.dept.name == 'sales'", true},
+		{"if query.view == 'full'", true},
+		{"if path.id == 7", true},
+		// && binds tighter than ||
+		{"if path.id == '1' && path.id == '7' || principal.sub == 'bob'", true},
+		{"if principal.sub == 'bob' || path.id == '1' && path.id == '7'", true},
+		{"if path.id == '1' || path.id == '7' && principal.sub == 'eve'", false},
+		{"if path.id == '7' && principal.sub == 'bob' || path.id == '1'", true},
+		// rules separated by ; are alternatives
+		{"orders:write; clerk if path.id == '7'", true},
+		{"orders:write; clerk if path.id == '8'", false},
+		// in tests membership of the right hand values
+		{"if 'orders:read' in principal.scopes", true},
+		{"if 'orders:write' in principal.scopes", false},
+		{"if 'clerk' in principal.roles", true},
+		{"if 'b' in body.lines", true},
+		{"if 'c' in body.lines", false},
+		{"if principal.scopes in principal.scopes", true},
+		{"if body.lines in body.lines", false},
+		// attributes that are not present never match, not even with !=
+		{"if path.missing == path.missing", false},
+		{"if path.missing != 'x'", false},
+		{"if query.empty == ''", false},
+		{"if body.customer.name == 'bob'", false},
+		{"if principal.nothing != 'x'", false},
+		{"if principal.dept.name.first == 'x'", false},
+	}
+
+	engine := NewExpressionPolicies()
+	for _, tc := range cases {
+		if err := engine.Validate(tc.policy); err != nil {
+			t.Errorf("%q: %v", tc.policy, err)
+			continue
+		}
+		if decision := engine.Decide(tc.policy, in); decision.Allow != tc.allow {
+			t.Errorf("%q: expected allow %v, got %+v", tc.policy, tc.allow, decision)
+		}
+	}
+
+	anonymous := &PolicyInput{PathArgs: in.PathArgs}
+	if decision := engine.Decide("orders:read", anonymous); decision.Allow || !strings.Contains(decision.Reason, "no authenticated principal") {
+		t.Errorf("anonymous caller: %+v", decision)
+	}
+	if decision := engine.Decide("if principal.sub != 'bob'", anonymous); decision.Allow {
+		t.Errorf("anonymous caller matched a principal condition: %+v", decision)
+	}
+}
@@ -0,0 +1,366 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/rmullinnix461332/logger"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TokenBucket	= "bucket"	// smooth refill, bursts up to Burst
+	SlidingWindow	= "window"	// at most Limit in any Period, weighting the previous window
+)
+
+//The limit of a ratelimit tag, e.g. ratelimit:"100/m" or ratelimit:"10/s, burst=20, key=ip, algo=window"
+type RateLimit struct {
+	Limit		int
+	Period		time.Duration
+	Burst		int		// token bucket capacity, default Limit
+	Algorithm	string		// TokenBucket or SlidingWindow
+	Key		string		// principal, apikey or ip - empty takes the first available in that order
+}
+
+//The outcome of taking one request from a limit
+type RateLimitResult struct {
+	Allowed		bool
+	Remaining	int
+	Reset		time.Duration	// until the limit is fully available again
+	RetryAfter	time.Duration	// until a refused request would be allowed
+}
+
+//Keeps the state of rate limits, by key. A shared backend (e.g. redis) lets instances share limits.
+type RateLimitStore interface {
+	Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+	Peek(key string, limit RateLimit, now time.Time) (RateLimitResult, error)	// as Take, without taking the request
+}
+
+//Configuration of rate limiting, set with SetRateLimitOptions
+type RateLimitOptions struct {
+	Store		RateLimitStore	// default NewMemoryRateLimitStore()
+	ClientIPHeader	string		// e.g. X-Forwarded-For behind a proxy, its last address is the client
+}
+
+var rateLimitMu sync.RWMutex
+var rateLimitOpts = RateLimitOptions{Store: NewMemoryRateLimitStore()}
+
+func SetRateLimitOptions(opts RateLimitOptions) {
+	if opts.Store == nil {
+		opts.Store = NewMemoryRateLimitStore()
+	}
+	rateLimitMu.Lock()
+	rateLimitOpts = opts
+	rateLimitMu.Unlock()
+}
+
+func rateLimitOptions() RateLimitOptions {
+	rateLimitMu.RLock()
+	defer rateLimitMu.RUnlock()
+	return rateLimitOpts
+}
+
+var rateLimitUnits = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}
+
+// 100/m, 5/10s, optionally followed by burst=, key= and algo=
+func parseRateLimit(tag string) (*RateLimit, error) {
+	parts := strings.Split(tag, ",")
+	rate := strings.SplitN(strings.TrimSpace(parts[0]), "/", 2)
+	if len(rate) != 2 {
+		return nil, errors.New("expecting <count>/<period>")
+	}
+
+	limit := new(RateLimit)
+	var err		error
+	if limit.Limit, err = strconv.Atoi(rate[0]); err != nil || limit.Limit < 1 {
+		return nil, errors.New("invalid count " + rate[0])
+	}
+	if unit, found := rateLimitUnits[rate[1]]; found {
+		limit.Period = unit
+	} else if limit.Period, err = time.ParseDuration(rate[1]); err != nil || limit.Period <= 0 {
+		return nil, errors.New("invalid period " + rate[1] + ", expecting s, m, h, d or a duration")
+	}
+	limit.Burst = limit.Limit
+	limit.Algorithm = TokenBucket
+
+	for _, option := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(option), "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid option " + option)
+		}
+		switch kv[0] {
+		case "burst":
+			if limit.Burst, err = strconv.Atoi(kv[1]); err != nil || limit.Burst < 1 {
+				return nil, errors.New("invalid burst " + kv[1])
+			}
+		case "key":
+			if kv[1] != "principal" && kv[1] != "apikey" && kv[1] != "ip" {
+				return nil, errors.New("invalid key " + kv[1] + ", expecting principal, apikey or ip")
+			}
+			limit.Key = kv[1]
+		case "algo":
+			if kv[1] != TokenBucket && kv[1] != SlidingWindow {
+				return nil, errors.New("invalid algo " + kv[1] + ", expecting bucket or window")
+			}
+			limit.Algorithm = kv[1]
+		default:
+			return nil, errors.New("unknown option " + kv[0])
+		}
+	}
+	return limit, nil
+}
+
+// takes the request from the endpoint's limit, refusing it with a 429 when exhausted
+func checkRateLimit(rb *ResponseBuilder, ep EndPointStruct) bool {
+	opts := rateLimitOptions()
+	client := rateLimitClient(rb, ep.rateLimit.Key, opts)
+
+	result, err := opts.Store.Take(ep.encSigniture + "|" + client, *ep.rateLimit, time.Now())
+	return rateLimitResponse(rb, ep, client, result, err)
+}
+
+// before authentication: an ip keyed limit takes the request, any other refuses the addresses whose failed
+// authentications used up the limit
+func checkRateLimitBeforeAuth(rb *ResponseBuilder, ep EndPointStruct) bool {
+	if ep.rateLimit.Key == "ip" {
+		return checkRateLimit(rb, ep)
+	}
+
+	opts := rateLimitOptions()
+	client := "ip:" + clientIP(rb.ctx.request, opts.ClientIPHeader)
+	result, err := opts.Store.Peek(ep.encSigniture + "|failed|" + client, *ep.rateLimit, time.Now())
+	if err == nil && result.Allowed {
+		// the headers are those of the limit taken after authentication
+		return true
+	}
+	return rateLimitResponse(rb, ep, client, result, err)
+}
+
+// counts a failed authentication against the caller's address, for limits checked after authentication
+func countFailedAuth(rb *ResponseBuilder, ep EndPointStruct) {
+	if ep.rateLimit.Key == "ip" {
+		return
+	}
+
+	opts := rateLimitOptions()
+	client := "ip:" + clientIP(rb.ctx.request, opts.ClientIPHeader)
+	if _, err := opts.Store.Take(ep.encSigniture + "|failed|" + client, *ep.rateLimit, time.Now()); err != nil {
+		logger.Error.Println("[gen] rate limit store: " + err.Error())
+	}
+}
+
+// sets the rate limit headers, and the 429 when the request is refused
+func rateLimitResponse(rb *ResponseBuilder, ep EndPointStruct, client string, result RateLimitResult, err error) bool {
+	limit := *ep.rateLimit
+	if err != nil {
+		// the limit is a protection, an unavailable backend does not take the service down
+		logger.Error.Println("[gen] rate limit store: " + err.Error())
+		return true
+	}
+
+	rb.SetHeader("RateLimit-Limit", strconv.Itoa(limit.Limit))
+	rb.SetHeader("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	rb.SetHeader("RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+	if result.Allowed {
+		return true
+	}
+
+	atomic.AddUint64(&countersFor(ep).rateLimited, 1)
+	if rb.ctx.span != nil {
+		rb.ctx.span.AddEvent("rate limited")
+	}
+	logger.Warning.Println("[gen] rate limited client: " + client + " method: " + ep.RequestMethod + " url: " + rb.ctx.request.URL.Path + " retry after: " + result.RetryAfter.String())
+
+	rb.SetHeader("Retry-After", strconv.Itoa(seconds(result.RetryAfter)))
+	rb.SetResponseCode(http.StatusTooManyRequests)
+	rb.SetResponseMsg(http.StatusText(http.StatusTooManyRequests))
+	return false
+}
+
+// whole seconds, rounded up so clients do not come back early
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// nanoseconds rounded up, a retry is not refused for the float error
+func ceilDuration(ns float64) time.Duration {
+	return time.Duration(math.Ceil(ns))
+}
+
+// who the limit is counted against
+func rateLimitClient(rb *ResponseBuilder, key string, opts RateLimitOptions) string {
+	if (key == "" || key == "principal") && rb.ctx.principal != nil && rb.ctx.principal.Subject != "" {
+		return "principal:" + rb.ctx.principal.Subject
+	}
+	if key == "" || key == "apikey" {
+		for scheme, credential := range rb.ctx.credentials {
+			if credential != "" && _manager().securityDef[scheme].Mode == "api_key" {
+				// the key itself is not kept
+				sum := sha256.Sum256([]byte(credential))
+				return "apikey:" + hex.EncodeToString(sum[:8])
+			}
+		}
+	}
+	return "ip:" + clientIP(rb.ctx.request, opts.ClientIPHeader)
+}
+
+//RateLimitStore kept in memory, limits are per instance
+type MemoryRateLimitStore struct {
+	mu		sync.Mutex
+	states		map[string]*rateState
+	nextPrune	time.Time
+}
+
+type rateState struct {
+	tokens		float64		// bucket
+	updated		time.Time
+	window		time.Time	// window start
+	current		int
+	previous	int
+	expires		time.Time	// when the state is no different from a new one
+}
+
+// how often states past their expiry are dropped
+const rateStatePruneInterval = time.Minute
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{states: make(map[string]*rateState)}
+}
+
+func (m *MemoryRateLimitStore) Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.After(m.nextPrune) {
+		// each state expires by its own limit's period
+		for k, s := range m.states {
+			if now.After(s.expires) {
+				delete(m.states, k)
+			}
+		}
+		m.nextPrune = now.Add(rateStatePruneInterval)
+	}
+
+	state, found := m.states[key]
+	if !found {
+		state = newRateState(limit, now)
+		m.states[key] = state
+	}
+	return state.take(limit, now), nil
+}
+
+func (m *MemoryRateLimitStore) Peek(key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := newRateState(limit, now)
+	if stored, found := m.states[key]; found {
+		*state = *stored
+	}
+	// taken from a copy, the stored state is left as it is
+	return state.take(limit, now), nil
+}
+
+func newRateState(limit RateLimit, now time.Time) *rateState {
+	return &rateState{tokens: float64(limit.Burst), updated: now, window: now.Truncate(limit.Period)}
+}
+
+func (s *rateState) take(limit RateLimit, now time.Time) RateLimitResult {
+	var result	RateLimitResult
+	if limit.Algorithm == SlidingWindow {
+		result = s.takeWindow(limit, now)
+		// the current window's count weighs on the next one
+		s.expires = s.window.Add(2 * limit.Period)
+	} else {
+		result = s.takeToken(limit, now)
+		s.expires = now.Add(result.Reset)
+	}
+	return result
+}
+
+func (s *rateState) takeToken(limit RateLimit, now time.Time) RateLimitResult {
+	rate := float64(limit.Limit) / limit.Period.Seconds()	// tokens per second
+	burst := float64(limit.Burst)
+
+	s.tokens = math.Min(burst, s.tokens + now.Sub(s.updated).Seconds() * rate)
+	s.updated = now
+
+	var result	RateLimitResult
+	if s.tokens >= 1 {
+		s.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = ceilDuration((1 - s.tokens) / rate * float64(time.Second))
+	}
+	result.Remaining = int(s.tokens)
+	result.Reset = time.Duration((burst - s.tokens) / rate * float64(time.Second))
+	return result
+}
+
+func (s *rateState) takeWindow(limit RateLimit, now time.Time) RateLimitResult {
+	start := now.Truncate(limit.Period)
+	if elapsed := start.Sub(s.window); elapsed >= limit.Period {
+		if elapsed == limit.Period {
+			s.previous = s.current
+		} else {
+			s.previous = 0
+		}
+		s.current = 0
+		s.window = start
+	}
+	s.updated = now
+
+	into := now.Sub(s.window)
+	weight := 1 - into.Seconds() / limit.Period.Seconds()
+	estimate := float64(s.previous) * weight + float64(s.current)
+
+	var result	RateLimitResult
+	result.Reset = limit.Period - into
+	if estimate + 1 <= float64(limit.Limit) {
+		s.current++
+		result.Allowed = true
+		result.Remaining = int(float64(limit.Limit) - estimate - 1)
+		return result
+	}
+
+	// when the weighted count of the previous window has fallen far enough
+	free := float64(limit.Limit - 1 - s.current)
+	if s.current < limit.Limit && s.previous > 0 {
+		result.RetryAfter = ceilDuration((1 - free / float64(s.previous)) * float64(limit.Period)) - into
+	} else {
+		result.RetryAfter = limit.Period - into + ceilDuration((1 - float64(limit.Limit - 1) / float64(s.current)) * float64(limit.Period))
+	}
+	return result
+}
@@ -0,0 +1,172 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+package gorest
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	cases := []struct {
+		tag	string
+		limit	RateLimit
+		err	string
+	}{
+		{"100/m", RateLimit{Limit: 100, Period: time.Minute, Burst: 100, Algorithm: TokenBucket}, ""},
+		{"5/10s", RateLimit{Limit: 5, Period: 10 * time.Second, Burst: 5, Algorithm: TokenBucket}, ""},
+		{"10/s, burst=20, key=ip, algo=window", RateLimit{Limit: 10, Period: time.Second, Burst: 20, Algorithm: SlidingWindow, Key: "ip"}, ""},
+		{"1/d,key=apikey", RateLimit{Limit: 1, Period: 24 * time.Hour, Burst: 1, Algorithm: TokenBucket, Key: "apikey"}, ""},
+		{"100", RateLimit{}, "expecting <count>/<period>"},
+		{"0/m", RateLimit{}, "invalid count"},
+		{"x/m", RateLimit{}, "invalid count"},
+		{"10/w", RateLimit{}, "invalid period"},
+		{"10/-1s", RateLimit{}, "invalid period"},
+		{"10/m, burst=0", RateLimit{}, "invalid burst"},
+		{"10/m, key=user", RateLimit{}, "invalid key"},
+		{"10/m, algo=leaky", RateLimit{}, "invalid algo"},
+		{"10/m, size=3", RateLimit{}, "unknown option size"},
+		{"10/m, burst", RateLimit{}, "invalid option"},
+	}
+
+	for _, tc := range cases {
+		limit, err := parseRateLimit(tc.tag)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", tc.tag, err)
+			} else if *limit != tc.limit {
+				t.Errorf("%q: expected %+v, got %+v", tc.tag, tc.limit, *limit)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: expected error containing %q, got %v", tc.tag, tc.err, err)
+		}
+	}
+}
+
+// a minute boundary, for the windows
+var rateLimitEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestTokenBucket(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Limit: 2, Period: time.Second, Burst: 4, Algorithm: TokenBucket}
+	now := rateLimitEpoch
+
+	for i := 0; i < 4; i++ {
+		if result, _ := store.Take("k", limit, now); !result.Allowed || result.Remaining != 3 - i {
+			t.Fatalf("burst request %d: %+v", i, result)
+		}
+	}
+
+	result, _ := store.Take("k", limit, now)
+	if result.Allowed || result.RetryAfter != 500 * time.Millisecond || result.Reset != 2 * time.Second {
+		t.Errorf("empty bucket: %+v", result)
+	}
+	if result, _ = store.Take("k", limit, now.Add(499 * time.Millisecond)); result.Allowed {
+		t.Errorf("before the token is back: %+v", result)
+	}
+	if result, _ = store.Take("k", limit, now.Add(500 * time.Millisecond)); !result.Allowed {
+		t.Errorf("refilled token: %+v", result)
+	}
+
+	// refills up to the burst only
+	if result, _ = store.Take("k", limit, now.Add(time.Hour)); !result.Allowed || result.Remaining != 3 {
+		t.Errorf("refilled bucket: %+v", result)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Limit: 10, Period: time.Minute, Burst: 10, Algorithm: SlidingWindow}
+	now := rateLimitEpoch
+
+	for i := 0; i < 10; i++ {
+		if result, _ := store.Take("k", limit, now); !result.Allowed || result.Remaining != 9 - i {
+			t.Fatalf("request %d: %+v", i, result)
+		}
+	}
+
+	// the full count of this window weighs 90% on the next one 6s into it
+	result, _ := store.Take("k", limit, now)
+	if result.Allowed || result.RetryAfter != 66 * time.Second || result.Reset != time.Minute {
+		t.Errorf("exhausted window: %+v", result)
+	}
+	if result, _ = store.Take("k", limit, now.Add(65 * time.Second)); result.Allowed {
+		t.Errorf("before the previous window has weighed down: %+v", result)
+	}
+
+	// half way into the next window the previous one counts 5
+	half := now.Add(90 * time.Second)
+	store = NewMemoryRateLimitStore()
+	for i := 0; i < 10; i++ {
+		store.Take("k", limit, now)
+	}
+	for i := 0; i < 5; i++ {
+		if result, _ = store.Take("k", limit, half); !result.Allowed {
+			t.Fatalf("request %d half way: %+v", i, result)
+		}
+	}
+	if result, _ = store.Take("k", limit, half); result.Allowed || result.RetryAfter != 6 * time.Second || result.Reset != 30 * time.Second {
+		t.Errorf("exhausted half way: %+v", result)
+	}
+	if result, _ = store.Take("k", limit, half.Add(6 * time.Second)); !result.Allowed {
+		t.Errorf("after the retry: %+v", result)
+	}
+
+	// a window with nothing before it
+	if result, _ = store.Take("k", limit, now.Add(10 * time.Minute)); !result.Allowed || result.Remaining != 9 {
+		t.Errorf("idle window: %+v", result)
+	}
+}
+
+func TestMemoryRateLimitStorePrune(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	hourly := RateLimit{Limit: 1, Period: time.Hour, Burst: 1, Algorithm: TokenBucket}
+	second := RateLimit{Limit: 1, Period: time.Second, Burst: 1, Algorithm: TokenBucket}
+	now := rateLimitEpoch
+
+	store.Take("hourly", hourly, now)
+	store.Take("second", second, now)
+
+	// peeking takes nothing
+	if result, _ := store.Peek("second", second, now.Add(time.Second)); !result.Allowed {
+		t.Errorf("peek at a refilled bucket: %+v", result)
+	}
+	if result, _ := store.Peek("second", second, now.Add(time.Second)); !result.Allowed {
+		t.Errorf("peek took the request: %+v", result)
+	}
+
+	// a take on the short limit prunes its own expired state, not the longer one
+	store.Take("other", second, now.Add(2 * time.Minute))
+	if _, found := store.states["second"]; found {
+		t.Error("expired state was not pruned")
+	}
+	if result, _ := store.Take("hourly", hourly, now.Add(2 * time.Minute)); result.Allowed {
+		t.Errorf("hourly limit was reset by the prune: %+v", result)
+	}
+}
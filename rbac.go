@@ -0,0 +1,169 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+
+package gorest
+
+import (
+	"github.com/rmullinnix461332/logger"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//Maps a role to the permissions it grants. An endpoint's role tag may name roles or permissions.
+type RolePolicy map[string][]string
+
+//Returns the roles held by the principal
+type RoleResolver func(p *Principal) []string
+
+var rbacMu sync.RWMutex
+var rolePolicy RolePolicy
+var roleResolver RoleResolver = ClaimRoles
+
+//Authorizes the callers of a service with a realm tag, for its endpoints with a role tag and no security. It is given
+//the caller's Authorization header, the realm and the http method, and returns whether the caller belongs to the
+//realm. Role tags are checked against the principal it sets with rb.SetPrincipal.
+type RealmAuthorizer func(token string, realm string, method string, rb *ResponseBuilder) bool
+
+var realmAuthorizers = make(map[string]RealmAuthorizer)
+
+//Registers the authorizer of a realm, before the services naming it are registered
+func RegisterRealmAuthorizer(realm string, auth RealmAuthorizer) {
+	if auth == nil {
+		logger.Error.Panicln("[sec] realm authorizer can not be nil")
+	}
+	rbacMu.Lock()
+	realmAuthorizers[realm] = auth
+	rbacMu.Unlock()
+}
+
+func getRealmAuthorizer(realm string) RealmAuthorizer {
+	rbacMu.RLock()
+	defer rbacMu.RUnlock()
+	return realmAuthorizers[realm]
+}
+
+// asks the realm's authorizer to admit the caller, 401 when it does not
+func authorizeRealm(rb *ResponseBuilder, realm string) bool {
+	auth := getRealmAuthorizer(realm)
+	if auth == nil {
+		return true
+	}
+
+	r := rb.ctx.request
+	if !auth(r.Header.Get("Authorization"), realm, r.Method, rb) {
+		logger.Warning.Println("[sec] realm: " + realm + " method: " + r.Method + " url: " + r.URL.Path + " reason: not admitted by the realm authorizer")
+		rb.SetHeader("WWW-Authenticate", `Basic realm="` + realm + `"`)
+		rb.SetResponseCode(http.StatusUnauthorized)
+		rb.SetResponseMsg(http.StatusText(http.StatusUnauthorized))
+		return false
+	}
+	return true
+}
+
+//Registers the role to permission policy used to check endpoint role tags
+func RegisterRolePolicy(policy RolePolicy) {
+	rbacMu.Lock()
+	rolePolicy = policy
+	rbacMu.Unlock()
+}
+
+//Registers how roles are found for a principal, the default is ClaimRoles
+func RegisterRoleResolver(resolver RoleResolver) {
+	if resolver == nil {
+		logger.Error.Panicln("[sec] role resolver can not be nil")
+	}
+	rbacMu.Lock()
+	roleResolver = resolver
+	rbacMu.Unlock()
+}
+
+//The roles in the principal's "roles" or "role" claim, a string or an array of strings
+func ClaimRoles(p *Principal) []string {
+	if p == nil {
+		return nil
+	}
+	for _, name := range []string{"roles", "role"} {
+		switch value := p.Claims[name].(type) {
+		case string:
+			return strings.Fields(strings.Replace(value, ",", " ", -1))
+		case []string:
+			return value
+		case []interface{}:
+			roles := make([]string, 0, len(value))
+			for i := range value {
+				if role, ok := value[i].(string); ok {
+					roles = append(roles, role)
+				}
+			}
+			return roles
+		}
+	}
+	return nil
+}
+
+//Reports whether the principal holds one of the roles, or a role granting one of them as a permission
+func HasRole(p *Principal, required []string) bool {
+	rbacMu.RLock()
+	policy := rolePolicy
+	resolver := roleResolver
+	rbacMu.RUnlock()
+
+	held := resolver(p)
+	for _, role := range held {
+		for _, req := range required {
+			if role == req {
+				return true
+			}
+			for _, perm := range policy[role] {
+				if perm == req {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// checks the endpoint's role tag against the principal established by authorizeRequest or the realm authorizer
+func authorizeRoles(rb *ResponseBuilder, ep EndPointStruct) bool {
+	if rb.ctx.principal == nil {
+		logger.Warning.Println("[sec] roles: " + strings.Join(ep.Roles, ",") + " method: " + rb.ctx.request.Method + " url: " + rb.ctx.request.URL.Path + " reason: no authenticated principal")
+		rb.SetResponseCode(http.StatusUnauthorized)
+		rb.SetResponseMsg(http.StatusText(http.StatusUnauthorized))
+		return false
+	}
+
+	if !HasRole(rb.ctx.principal, ep.Roles) {
+		logger.Warning.Println("[sec] roles: " + strings.Join(ep.Roles, ",") + " subject: " + rb.ctx.principal.Subject + " method: " + rb.ctx.request.Method + " url: " + rb.ctx.request.URL.Path + " reason: role not held")
+		rb.SetResponseCode(http.StatusForbidden)
+		rb.SetResponseMsg(http.StatusText(http.StatusForbidden))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,211 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+
+package gorest
+
+import (
+	"github.com/rmullinnix461332/logger"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type rbacService struct {
+	RestService	`root:"/rbac-service/" consumes:"application/json" produces:"application/json" realm:"rbac-test"`
+	open		EndPoint	`method:"GET" path:"/open" output:"string"`
+	admin		EndPoint	`method:"GET" path:"/admin" output:"string" role:"admin"`
+	orders		EndPoint	`method:"POST" path:"/orders" postdata:"string" role:"orders:write,admin"`
+}
+
+func (serv rbacService) Open() string {
+	return "open"
+}
+
+func (serv rbacService) Admin() string {
+	return serv.Principal().Subject
+}
+
+func (serv rbacService) Orders(order string) {
+}
+
+// a role endpoint without security in a service whose realm has no authorizer
+type unenforcedRoleService struct {
+	RestService	`root:"/unenforced-role-service/" consumes:"application/json" produces:"application/json" realm:"no-authorizer"`
+	admin		EndPoint	`method:"GET" path:"/admin" output:"string" role:"admin"`
+}
+
+func (serv unenforcedRoleService) Admin() string {
+	return ""
+}
+
+// the token is the caller's name, with the roles named after the colon
+func rbacTestAuthorizer(token string, realm string, method string, rb *ResponseBuilder) bool {
+	if token == "" {
+		return false
+	}
+	parts := strings.SplitN(token, ":", 2)
+	p := &Principal{Subject: parts[0], Claims: map[string]interface{}{}}
+	if len(parts) == 2 {
+		p.Claims["roles"] = parts[1]
+	}
+	rb.SetPrincipal(p)
+	return true
+}
+
+func TestClaimRoles(t *testing.T) {
+	cases := []struct {
+		claims	map[string]interface{}
+		roles	[]string
+	}{
+		{map[string]interface{}{"roles": "admin"}, []string{"admin"}},
+		{map[string]interface{}{"roles": "admin, clerk reader"}, []string{"admin", "clerk", "reader"}},
+		{map[string]interface{}{"role": []string{"clerk"}}, []string{"clerk"}},
+		{map[string]interface{}{"roles": []interface{}{"admin", 7, "clerk"}}, []string{"admin", "clerk"}},
+		{map[string]interface{}{"roles": 7}, nil},
+		{map[string]interface{}{}, nil},
+	}
+
+	for _, tc := range cases {
+		if roles := ClaimRoles(&Principal{Claims: tc.claims}); !reflect.DeepEqual(roles, tc.roles) {
+			t.Errorf("%v: expected %v, got %v", tc.claims, tc.roles, roles)
+		}
+	}
+	if ClaimRoles(nil) != nil {
+		t.Error("roles of no principal")
+	}
+}
+
+func TestHasRole(t *testing.T) {
+	RegisterRolePolicy(RolePolicy{"clerk": {"orders:read", "orders:write"}, "auditor": {"orders:read"}})
+	defer RegisterRolePolicy(nil)
+
+	cases := []struct {
+		held		string
+		required	[]string
+		has		bool
+	}{
+		{"admin", []string{"admin"}, true},
+		{"clerk", []string{"admin"}, false},
+		{"clerk", []string{"orders:write"}, true},
+		{"auditor", []string{"orders:write"}, false},
+		{"auditor", []string{"orders:write", "orders:read"}, true},
+		{"auditor clerk", []string{"orders:write"}, true},
+		{"orders:write", []string{"orders:write"}, true},
+		{"", []string{"orders:read"}, false},
+	}
+
+	for _, tc := range cases {
+		p := &Principal{Claims: map[string]interface{}{"roles": tc.held}}
+		if has := HasRole(p, tc.required); has != tc.has {
+			t.Errorf("%q holding %v: expected %v", tc.held, tc.required, tc.has)
+		}
+	}
+
+	// a resolver in place of the roles claim
+	RegisterRoleResolver(func(p *Principal) []string { return []string{p.Subject} })
+	defer RegisterRoleResolver(ClaimRoles)
+	if !HasRole(&Principal{Subject: "clerk"}, []string{"orders:read"}) || HasRole(&Principal{Subject: "guest"}, []string{"orders:read"}) {
+		t.Error("roles from a registered resolver")
+	}
+}
+
+func TestRealmRoles(t *testing.T) {
+	RegisterRealmAuthorizer("rbac-test", rbacTestAuthorizer)
+	RegisterRolePolicy(RolePolicy{"clerk": {"orders:write"}})
+	defer RegisterRolePolicy(nil)
+	RegisterService(new(rbacService))
+	srv := httptest.NewServer(Handle())
+	defer srv.Close()
+
+	cases := []struct {
+		method	string
+		path	string
+		token	string
+		code	int
+	}{
+		{"GET", "/open", "", http.StatusOK},
+		{"GET", "/admin", "", http.StatusUnauthorized},
+		{"GET", "/admin", "bob", http.StatusForbidden},
+		{"GET", "/admin", "bob:clerk", http.StatusForbidden},
+		{"GET", "/admin", "alice:admin", http.StatusOK},
+		{"POST", "/orders", "bob:clerk", http.StatusCreated},
+		{"POST", "/orders", "alice:admin", http.StatusCreated},
+		{"POST", "/orders", "carol:auditor", http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, srv.URL + "/rbac-service" + tc.path, strings.NewReader(`"order"`))
+		req.Header.Set("Content-Type", "application/json")
+		if tc.token != "" {
+			req.Header.Set("Authorization", tc.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s %s as %q: expected %d, got %d", tc.method, tc.path, tc.token, tc.code, resp.StatusCode)
+		}
+		if tc.code == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != `Basic realm="rbac-test"` {
+			t.Error("challenge:", resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+
+	// the CSRF nonce names are not realm credentials
+	req, _ := http.NewRequest("GET", srv.URL + "/rbac-service/admin?xsrft=alice:admin", nil)
+	req.AddCookie(&http.Cookie{Name: "X-Xsrf-Cookie", Value: "alice:admin"})
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("realm token taken from the csrf nonce:", resp.StatusCode)
+	}
+}
+
+func TestUnenforcedRoleFailsRegistration(t *testing.T) {
+	// registration exits the process, so it is run in a child of the test binary
+	if os.Getenv("GOREST_UNENFORCED_ROLE") == "1" {
+		logger.Init("warn")
+		RegisterService(new(unenforcedRoleService))
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestUnenforcedRoleFailsRegistration")
+	cmd.Env = append(os.Environ(), "GOREST_UNENFORCED_ROLE=1")
+	out, err := cmd.CombinedOutput()
+	if _, exited := err.(*exec.ExitError); !exited {
+		t.Fatal("registration did not fail:", err)
+	}
+	if !strings.Contains(string(out), "has a role tag but no security") {
+		t.Error("unexpected failure:", string(out))
+	}
+}
@@ -63,6 +63,8 @@ import (
 	"github.com/rmullinnix461332/logger"
 	"net/http"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -133,6 +135,45 @@ func mapFieldsToMethods(t reflect.Type, f reflect.StructField, typeFullName stri
 			ep.allowGzip = 1
 		}
 	}
+	if ep.nilCode == 0 {
+		ep.nilCode = serviceRoot.nilCode
+	}
+	// endpoints without their own security tag take the service's, unless declared public
+	if len(ep.Security) == 0 && !ep.public && len(serviceRoot.Security) > 0 {
+		ep.Security = append(ep.Security, serviceRoot.Security...)
+		ep.SecurityScheme = securitySchemes(ep.Security)
+	}
+	if ep.cors == "" {
+		ep.cors = serviceRoot.cors
+	}
+	if ep.csrf == "" {
+		ep.csrf = serviceRoot.csrf
+	}
+	if ep.etag == "" {
+		ep.etag = serviceRoot.etag
+	}
+	if ep.etag == "none" {
+		ep.etag = ""
+	}
+	if ep.concurrency != nil {
+		countersFor(ep)
+	}
+	// ratelimit:"none" leaves a zero limit to opt out of the service's
+	if ep.rateLimit == nil {
+		ep.rateLimit = serviceRoot.rateLimit
+	} else if ep.rateLimit.Limit == 0 {
+		ep.rateLimit = nil
+	}
+	if len(ep.Roles) > 0 && len(ep.Security) == 0 && (serviceRoot.realm == "" || getRealmAuthorizer(serviceRoot.realm) == nil) {
+		logger.Error.Fatalf("[fatal] " + errorString_RoleSecurity, f.Name)
+	}
+	// endpoints without their own mime types take the ones declared on the service
+	if len(ep.ConsumesMime) == 0 {
+		ep.ConsumesMime = append(ep.ConsumesMime, serviceRoot.ConsumesMime...)
+	}
+	if len(ep.ProducesMime) == 0 {
+		ep.ProducesMime = append(ep.ProducesMime, serviceRoot.ProducesMime...)
+	}
 
 	var method reflect.Method
 	methodName := strings.ToUpper(f.Name[:1]) + f.Name[1:]
@@ -153,6 +194,7 @@ func mapFieldsToMethods(t reflect.Type, f reflect.StructField, typeFullName stri
 		if !methFound {
 			logger.Error.Panicln("[fatal] Method name not found. " + panicMethNotFound(methFound, ep, t, f, methodName))
 		}
+		inferMethodTypes(method.Type, &ep)
 		if !isLegalForRequestType(method.Type, ep) {
 			logger.Error.Panicln("[fatal] Parameter list not matching. " + panicMethNotFound(methFound, ep, t, f, methodName))
 		}
@@ -164,6 +206,20 @@ func mapFieldsToMethods(t reflect.Type, f reflect.StructField, typeFullName stri
 	logger.Info.Println("[gen] Registerd service:", t.Name(), " endpoint:", ep.RequestMethod, ep.Signiture)
 }
 
+//The output and postdata tags are optional, when missing they are taken from the method signature.
+//A posted entity is the extra leading parameter beyond the path and query parameters.
+func inferMethodTypes(methType reflect.Type, ep *EndPointStruct) {
+	if ep.OutputTypeExpr == nil && methType.NumOut() > 0 {
+		ep.OutputTypeExpr = typeExprOf(methType.Out(0))
+		ep.OutputType, ep.OutputTypeIsArray, ep.OutputTypeIsMap = legacyTypeName(ep.OutputTypeExpr)
+	}
+
+	if ep.PostdataTypeExpr == nil && methType.NumIn() - 1 == ep.paramLen + len(ep.QueryParams) + 1 {
+		ep.PostdataTypeExpr = typeExprOf(methType.In(1))
+		ep.PostdataType, ep.postdataTypeIsArray, ep.postdataTypeIsMap = legacyTypeName(ep.PostdataTypeExpr)
+	}
+}
+
 func isLegalForRequestType(methType reflect.Type, ep EndPointStruct) bool {
 	startParam := 1
 
@@ -177,7 +233,7 @@ func isLegalForRequestType(methType reflect.Type, ep EndPointStruct) bool {
 //			numInputIgnore = 1 //The first param is the default service struct
 //		}
 //	}
-	if len(ep.PostdataType) > 0 {
+	if ep.PostdataTypeExpr != nil {
 		startParam = 2
 	}
 
@@ -186,25 +242,8 @@ func isLegalForRequestType(methType reflect.Type, ep EndPointStruct) bool {
 	}
 
 	//Check the first parameter type for POST and PUT
-	if len(ep.PostdataType) > 0 {
-		startParam++
-		methVal := methType.In(1)
-		if ep.postdataTypeIsArray {
-			if methVal.Kind() == reflect.Slice {
-				methVal = methVal.Elem()
-			} else {
-				return false
-			}
-		}
-		if ep.postdataTypeIsMap {
-			if methVal.Kind() == reflect.Map {
-				methVal = methVal.Elem()
-			} else {
-				return false
-			}
-		}
-
-		if !typeNamesEqual(methVal, ep.PostdataType) {
+	if ep.PostdataTypeExpr != nil {
+		if !declaredTypeMatches(ep.PostdataTypeExpr, methType.In(1)) {
 			return false
 		}
 	}
@@ -241,24 +280,7 @@ func isLegalForRequestType(methType reflect.Type, ep EndPointStruct) bool {
 	}
 	//Check output param type.
 	if methType.NumOut() > 0 {
-		methVal := methType.Out(0)
-
-		if ep.OutputTypeIsArray {
-			if methVal.Kind() == reflect.Slice {
-				methVal = methVal.Elem() //Only convert if it is mentioned as a slice in the tags, otherwise allow for failure panic
-			} else {
-				return false
-			}
-		}
-		if ep.OutputTypeIsMap {
-			if methVal.Kind() == reflect.Map {
-				methVal = methVal.Elem()
-			} else {
-				return false
-			}
-		}
-
-		if !typeNamesEqual(methVal, ep.OutputType) {
+		if !declaredTypeMatches(ep.OutputTypeExpr, methType.Out(0)) {
 			return false
 		}
 	}
@@ -266,36 +288,20 @@ func isLegalForRequestType(methType reflect.Type, ep EndPointStruct) bool {
 	return true
 }
 
-func typeNamesEqual(methVal reflect.Type, name2 string) bool {
-	if strings.Index(name2, ".") == -1 {
-		return methVal.Name() == name2
+// a tag on a method working with an interface documents the concrete type, anything else has to match
+func declaredTypeMatches(te *TypeExpr, t reflect.Type) bool {
+	if t.Kind() == reflect.Interface {
+		return true
 	}
-	//fullName := strings.Replace(methVal.PkgPath(), "/", ".", -1) + "." + methVal.Name()
-	abbrevName := name2[strings.Index(name2, ".") + 1:]
-
-	return abbrevName == methVal.Name()
+	return te.Matches(t)
 }
 
 func panicMethNotFound(methFound bool, ep EndPointStruct, t reflect.Type, f reflect.StructField, methodName string) string {
 
 	var str string
-	isArr := ""
-	postIsArr := ""
-	if ep.OutputTypeIsArray {
-		isArr = "[]"
-	}
-	if ep.OutputTypeIsMap {
-		isArr = "map[string]"
-	}
-	if ep.postdataTypeIsArray {
-		postIsArr = "[]"
-	}
-	if ep.postdataTypeIsMap {
-		postIsArr = "map[string]"
-	}
-	var suffix string = "(" + isArr + ep.OutputType + ")# with one(" + isArr + ep.OutputType + ") return parameter."
+	var suffix string = "(" + ep.OutputTypeExpr.String() + ")# with one(" + ep.OutputTypeExpr.String() + ") return parameter."
 	if ep.RequestMethod == POST || ep.RequestMethod == PUT || ep.RequestMethod == PATCH {
-		str = "PostData " + postIsArr + ep.PostdataType
+		str = "PostData " + ep.PostdataTypeExpr.String()
 		if ep.paramLen > 0 {
 			str += ", "
 		}
@@ -331,23 +337,37 @@ func prepareServe(rb *ResponseBuilder, ep EndPointStruct, args map[string]string
 	//Set the Context; the user can get the context from her services function param
 	servVal.FieldByName("RestService").FieldByName("Context").Set(reflect.ValueOf(rb.ctx))
 
+	//Failed authentications are counted before authentication, so they can not be retried without limit
+	if ep.rateLimit != nil {
+		if !checkRateLimitBeforeAuth(rb, ep) {
+			return
+		}
+	}
+
 	//Check Authorization
 
-	if ep.SecurityScheme != nil {
-		authorized := false
-		for key, scopes := range ep.SecurityScheme {
-			alteredScopes := make([]string, len(scopes))
-			for i := range scopes {
-				alteredScopes[i] = replaceScopeKey(scopes[i], args)
-			}
-			authorized = GetAuthorizer(key)(rb.ctx.xsrftoken, key, alteredScopes, rb.ctx.request.Method, rb)
-			if authorized {
-				break
-			}
+	authenticated := true
+	if len(ep.Security) > 0 {
+		authenticated = authorizeRequest(rb, ep, args, servMeta.realm)
+	} else if servMeta.realm != "" && len(ep.Roles) > 0 {
+		// the realm authorizer only identifies callers for role checks, endpoints without roles stay open
+		authenticated = authorizeRealm(rb, servMeta.realm)
+	}
+	if !authenticated {
+		if ep.rateLimit != nil {
+			countFailedAuth(rb, ep)
 		}
-		if !authorized {
-			// authorizer should log failure reason
-			rb.SetResponseCode(401)
+		return
+	}
+
+	if len(ep.Roles) > 0 {
+		if !authorizeRoles(rb, ep) {
+			return
+		}
+	}
+
+	if ep.rateLimit != nil && ep.rateLimit.Key != "ip" {
+		if !checkRateLimit(rb, ep) {
 			return
 		}
 	}
@@ -364,7 +384,7 @@ func prepareServe(rb *ResponseBuilder, ep EndPointStruct, args map[string]string
 
 	valid, mime := validMime(contentType, ep.ConsumesMime, servMeta.ConsumesMime)
 	if !valid {
-		if len(ep.PostdataType) > 0 {
+		if ep.PostdataTypeExpr != nil {
 			// error - can not accept request
 			logger.Error.Println("[gen] service is not configured to accept Content-Type " + contentType)
 			rb.SetResponseCode(http.StatusBadRequest)
@@ -374,7 +394,10 @@ func prepareServe(rb *ResponseBuilder, ep EndPointStruct, args map[string]string
 	}
 
 	//For POST and PUT, make and add the first "postdata" argument to the argument list
-	if len(ep.PostdataType) > 0 {
+	if ep.PostdataTypeExpr != nil {
+		if !decodeRequestBody(rb) {
+			return
+		}
 
 		body := ""
 		if strings.Contains(contentType, "form-data") {
@@ -395,7 +418,7 @@ func prepareServe(rb *ResponseBuilder, ep EndPointStruct, args map[string]string
 			//println("This is the body of the post:",body)
 			logger.Info.Println("[gen] body of the post " + body)
 
-			if v, valid := makeArg(body, targetMethod.Type.In(1), mime); valid {
+			if v, valid := makeValue(body, targetMethod.Type.In(1), mime); valid {
 				arrArgs = append(arrArgs, v)
 			} else {
 				rb.SetResponseCode(http.StatusBadRequest)
@@ -407,14 +430,14 @@ func prepareServe(rb *ResponseBuilder, ep EndPointStruct, args map[string]string
 
 	if len(args) == ep.paramLen || (ep.isVariableLength && ep.paramLen == 1) {
 		startIndex := 1
-		if len(ep.PostdataType) > 0 {
+		if ep.PostdataTypeExpr != nil {
 			startIndex = 2
 		}
 
 		if ep.isVariableLength {
 			varSliceArgs := reflect.New(targetMethod.Type.In(startIndex)).Elem()
 			for ij := 0; ij < len(args); ij++ {
-				dat := args[string(ij)]
+				dat := args[strconv.Itoa(ij)]
 
 				if v, valid := makeArg(dat, targetMethod.Type.In(startIndex).Elem(), mime); valid {
 					varSliceArgs = reflect.Append(varSliceArgs, v)
@@ -465,6 +488,31 @@ func prepareServe(rb *ResponseBuilder, ep EndPointStruct, args map[string]string
 			startIndex++
 		}
 
+		if ep.Policy != "" {
+			var body	interface{}
+			if ep.PostdataTypeExpr != nil && len(arrArgs) > 0 {
+				body = arrArgs[0].Interface()
+			}
+			if !authorizePolicy(rb, ep, args, queryArgs, body) {
+				return
+			}
+		}
+
+		if ep.cache != nil {
+			key, cacheable := cacheKey(rb, ep, servMeta.realm, args, queryArgs, responseMime(rb.ctx.request.Header.Get("Accept"), ep, servMeta))
+			if cacheable {
+				cached, finish := lookupCache(key)
+				countCache(ep, cached != nil)
+				if cached != nil {
+					serveCached(rb, cached)
+					return
+				}
+				rb.SetHeader("X-Cache", "MISS")
+				before := rb.writer().Header().Clone()
+				defer func() { finish(captureResponse(rb, before, ep.cache.ttl)) }()
+			}
+		}
+
 		//Now call the actual method with the data
 		var ret []reflect.Value
 		if ep.isVariableLength {
@@ -476,39 +524,30 @@ func prepareServe(rb *ResponseBuilder, ep EndPointStruct, args map[string]string
 		if len(ret) == 1 { //This is when we have just called a GET
 			var mimeType	string
 
-			accept := rb.ctx.request.Header.Get("Accept")
-			valid := false
-
-			if len(accept) > 0 {
-				if valid, mimeType = validMime(accept, ep.ProducesMime, servMeta.ProducesMime); valid {
-			//		rb.SetResponseCode(http.StatusBadRequest)
-			//		rb.SetResponseMsg("Service does not support Accept mime type " + mime)
-			//		return rb
-				}
-			}
-			if !valid {
-				if len(ep.ProducesMime) > 0 {
-					mimeType = ep.ProducesMime[0]
-				} else {
-					mimeType = servMeta.ProducesMime[0]
+			// a nil pointer (or interface) means there is nothing to send back, with the code the method set if any
+			if kind := ret[0].Kind(); (kind == reflect.Ptr || kind == reflect.Interface) && ret[0].IsNil() {
+				if rb.ctx.responseCode == 0 {
+					rb.SetResponseCode(ep.nilCode)
+					if ep.nilCode == http.StatusNotFound {
+						rb.SetResponseMsg("The resource in the requested path could not be found.")
+					}
 				}
+				return
 			}
 
+			accept := rb.ctx.request.Header.Get("Accept")
+			mimeType = responseMime(accept, ep, servMeta)
+
 			rb.SetContentType(mimeType)
 
 			// check for hypermedia decorator
 			dec := GetHypermedia()
 			hidec := ret[0].Interface()
 			if dec != nil {
-				scope := make([]string, 0)
 				prefix := "http://" + rb.ctx.request.Host
-				item, found := rb.Session().Get("Scope")
-				if found {
-					iScope := item.([]interface{})
-					scope = make([]string, len(iScope))
-					for i := range iScope {
-						scope[i] = iScope[i].(string)
-					}
+				scope := rb.Session().Scopes()
+				if scope == nil {
+					scope = make([]string, 0)
 				}
 				hidec = dec.Decorate(accept, prefix, hidec, scope)
 			}
@@ -539,6 +578,19 @@ func prepareServe(rb *ResponseBuilder, ep EndPointStruct, args map[string]string
 	return
 }
 
+// the Accept mime type when the endpoint produces it, else its first
+func responseMime(accept string, ep EndPointStruct, servMeta ServiceMetaData) string {
+	if len(accept) > 0 {
+		if valid, mimeType := validMime(accept, ep.ProducesMime, servMeta.ProducesMime); valid {
+			return mimeType
+		}
+	}
+	if len(ep.ProducesMime) > 0 {
+		return ep.ProducesMime[0]
+	}
+	return servMeta.ProducesMime[0]
+}
+
 func makeArg(data string, template reflect.Type, mime string) (reflect.Value, bool) {
 
 	kind := template.Kind()
@@ -551,6 +603,11 @@ func makeArg(data string, template reflect.Type, mime string) (reflect.Value, bo
 		}
 	}
 
+	return makeValue(data, template, mime)
+}
+
+//Unmarshals data, as sent, into a new value of the template type. Used directly for posted entities.
+func makeValue(data string, template reflect.Type, mime string) (reflect.Value, bool) {
 	i := reflect.New(template).Interface()
 
 	if data == "" {
@@ -568,37 +625,80 @@ func makeArg(data string, template reflect.Type, mime string) (reflect.Value, bo
 	return reflect.ValueOf(i).Elem(), true
 }
 
+// Negotiates the mime type against the types offered by the endpoint, or the service when
+// the endpoint does not declare any (it is not a union). mimeType is either a Content-Type or
+// an Accept header; a comma separated list is tried in q-value order and */* or type/* ranges
+// select the first offered type that fits.
 func validMime(mimeType string, epMime []string, srvMime []string) (bool, string) {
-	found := false
-	ctype := ""
-
-	parts := strings.Split(mimeType, ";")
-	for j := range parts {
-		// Endpoint mime type list overrides the one defined at the server
-		// It is not a union
-		if len(epMime) > 0 {
-			for i := range epMime {
-				if parts[j] == epMime[i] {
-					found = true
-					ctype = parts[j]
-					break
-				}
+	offered := epMime
+	if len(offered) == 0 {
+		offered = srvMime
+	}
+
+	for _, accepted := range parseAccept(mimeType) {
+		for i := range offered {
+			if mimeMatches(accepted, offered[i]) {
+				return true, offered[i]
 			}
-		} else {
-			for i := range srvMime {
-				if parts[j] == srvMime[i] {
-					found = true
-					ctype = parts[j]
-					break
+		}
+	}
+
+	return false, ""
+}
+
+type acceptRange struct {
+	mime	string
+	q	float64
+}
+
+// splits an Accept header into its media ranges ordered by preference, ranges with q=0 are dropped
+func parseAccept(header string) []string {
+	ranges := make([]acceptRange, 0)
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mime := strings.ToLower(strings.TrimSpace(params[0]))
+		if mime == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
 				}
 			}
 		}
-		if found {
-			break
+
+		if q > 0 {
+			ranges = append(ranges, acceptRange{mime, q})
 		}
 	}
 
-	return found, ctype
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	mimes := make([]string, len(ranges))
+	for i := range ranges {
+		mimes[i] = ranges[i].mime
+	}
+	return mimes
+}
+
+func mimeMatches(accepted string, offered string) bool {
+	offered = strings.ToLower(strings.TrimSpace(offered))
+
+	if accepted == "*/*" || accepted == offered {
+		return true
+	}
+	if strings.HasSuffix(accepted, "/*") {
+		return strings.HasPrefix(offered, strings.TrimSuffix(accepted, "*"))
+	}
+
+	return false
 }
 
 func replaceScopeKey(scope string, args map[string]string) string {
@@ -0,0 +1,171 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+
+package gorest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nilCodeService struct {
+	RestService	`root:"/nilcode-service/" consumes:"application/json" produces:"application/json"`
+	item		EndPoint	`method:"GET" path:"/items/{id:int}" output:"*string"`
+	replace		EndPoint	`method:"PUT" path:"/items/{id:int}" postdata:"string" output:"*string" nilcode:"204"`
+}
+
+func (serv nilCodeService) Item(id int) *string {
+	switch id {
+	case 1:
+		name := "one"
+		return &name
+	case 2:
+		serv.RB().SetResponseCode(http.StatusConflict)
+	}
+	return nil
+}
+
+func (serv nilCodeService) Replace(name string, id int) *string {
+	if !serv.RB().CheckPreconditions("v2", time.Time{}) {
+		return nil
+	}
+	if id == 9 {
+		serv.RB().SetResponseCode(http.StatusCreated)
+	}
+	return nil
+}
+
+func TestNilOutputCode(t *testing.T) {
+	RegisterService(new(nilCodeService))
+	srv := httptest.NewServer(Handle())
+	defer srv.Close()
+
+	cases := []struct {
+		method	string
+		path	string
+		ifMatch	string
+		code	int
+	}{
+		{"GET", "/items/1", "", http.StatusOK},
+		{"GET", "/items/2", "", http.StatusConflict},
+		{"GET", "/items/3", "", http.StatusNotFound},
+		{"PUT", "/items/1", `"v2"`, http.StatusNoContent},
+		{"PUT", "/items/1", `"v1"`, http.StatusPreconditionFailed},
+		{"PUT", "/items/9", `"v2"`, http.StatusCreated},
+	}
+
+	for _, tc := range cases {
+		var body	*strings.Reader
+		if tc.method == "PUT" {
+			body = strings.NewReader(`"renamed"`)
+		} else {
+			body = strings.NewReader("")
+		}
+		req, _ := http.NewRequest(tc.method, srv.URL + "/nilcode-service" + tc.path, body)
+		req.Header.Set("Content-Type", "application/json")
+		if tc.ifMatch != "" {
+			req.Header.Set("If-Match", tc.ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s %s If-Match %s: expected %d, got %d %s", tc.method, tc.path, tc.ifMatch, tc.code, resp.StatusCode, data)
+		}
+	}
+}
+
+type inferService struct {
+	RestService
+}
+
+func (serv inferService) Get(id int) User					{ return User{} }
+func (serv inferService) List(id int, view string) []*User			{ return nil }
+func (serv inferService) Create(u User, id int) *User				{ return nil }
+func (serv inferService) Tags(tags map[string][]string) map[string]int	{ return nil }
+func (serv inferService) Sum(values ...int) int				{ return 0 }
+func (serv inferService) Append(name string, values ...int) int		{ return 0 }
+func (serv inferService) Ack(id int)						{}
+func (serv inferService) Any(v interface{}) interface{}			{ return nil }
+
+func TestInferMethodTypes(t *testing.T) {
+	cases := []struct {
+		tag		string
+		method		string
+		output		string
+		postdata	string
+		legal		bool
+	}{
+		{`method:"GET" path:"/users/{id:int}"`, "Get", "gorest.User", "", true},
+		{`method:"GET" path:"/users/{id:int}?{view:string}"`, "List", "[]*gorest.User", "", true},
+		{`method:"POST" path:"/users/{id:int}"`, "Create", "*gorest.User", "gorest.User", true},
+		{`method:"PUT" path:"/tags"`, "Tags", "map[string]int", "map[string][]string", true},
+		{`method:"DELETE" path:"/users/{id:int}"`, "Ack", "", "", true},
+		{`method:"POST" path:"/any"`, "Any", "interface{}", "interface{}", true},
+
+		// variadic path parameters are not taken for a posted entity
+		{`method:"GET" path:"/sum/{...:int}"`, "Sum", "int", "", true},
+		{`method:"POST" path:"/sum/{...:int}"`, "Append", "int", "string", true},
+		{`method:"POST" path:"/sum/{...:string}"`, "Append", "int", "string", false},
+
+		// tags win over the signature, and have to agree with it
+		{`method:"GET" path:"/users/{id:int}" output:"gorest.User"`, "Get", "gorest.User", "", true},
+		{`method:"GET" path:"/users/{id:int}" output:"string"`, "Get", "string", "", false},
+		{`method:"GET" path:"/users/{id:int}" output:"*User"`, "Get", "*User", "", false},
+		{`method:"POST" path:"/users/{id:int}" postdata:"string"`, "Create", "*gorest.User", "string", false},
+		{`method:"POST" path:"/users/{id:int}" postdata:"User" output:"User"`, "Create", "User", "User", false},
+
+		// a method working with interface{} is documented by its tags
+		{`method:"POST" path:"/any" postdata:"User" output:"[]User"`, "Any", "[]User", "User", true},
+	}
+
+	// inferred named types are qualified with their package
+	for _, tc := range cases {
+		method, _ := reflect.TypeOf(inferService{}).MethodByName(tc.method)
+		ep := makeEndPointStruct(reflect.StructTag(tc.tag), "/infer-service/")
+		inferMethodTypes(method.Type, &ep)
+
+		if output := ep.OutputTypeExpr.String(); output != tc.output {
+			t.Errorf("%s %s: expected output %q, got %q", tc.method, tc.tag, tc.output, output)
+		}
+		if postdata := ep.PostdataTypeExpr.String(); postdata != tc.postdata {
+			t.Errorf("%s %s: expected postdata %q, got %q", tc.method, tc.tag, tc.postdata, postdata)
+		}
+		if legal := isLegalForRequestType(method.Type, ep); legal != tc.legal {
+			t.Errorf("%s %s: expected legal %v, got %v", tc.method, tc.tag, tc.legal, legal)
+		}
+	}
+}
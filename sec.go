@@ -26,14 +26,74 @@
 
 package gorest
 
-import "github.com/rmullinnix461332/logger"
+import (
+	"github.com/rmullinnix461332/logger"
+	"net/http"
+	"strings"
+)
 
 var authorizers map[string]Authorizer
+var principalAuthorizers map[string]PrincipalAuthorizer
 
 //Signiture of functions to be used as Authorizers
 //  token, scheme, scopes, method, ResponseBuilder
 type Authorizer func(string, string, []string, string, *ResponseBuilder)(bool)
 
+//Signiture of Authorizers that report who was authenticated and why a request was refused
+//  token, scheme, scopes, method, ResponseBuilder
+type PrincipalAuthorizer func(string, string, []string, string, *ResponseBuilder)(AuthResult)
+
+//The authenticated caller of a request, as established by the security scheme's authorizer.
+type Principal struct {
+	Subject		string
+	Scopes		[]string
+	Claims		map[string]interface{}
+	Tenant		string
+}
+
+type AuthDecision int
+
+const (
+	AuthAllow		AuthDecision = iota
+	AuthUnauthenticated	// missing or invalid credentials - 401
+	AuthForbidden		// valid credentials without the required scope - 403
+)
+
+//The outcome of a PrincipalAuthorizer. Reason is logged, it is not sent to the client.
+type AuthResult struct {
+	Decision	AuthDecision
+	Principal	*Principal
+	Reason		string
+}
+
+//Allows the request on behalf of the principal
+func Authenticated(p *Principal) AuthResult {
+	return AuthResult{AuthAllow, p, ""}
+}
+
+//Refuses the request with a 401, the credentials were missing or not valid
+func Unauthenticated(reason string) AuthResult {
+	return AuthResult{AuthUnauthenticated, nil, reason}
+}
+
+//Refuses the request with a 403, the principal is known but lacks the scope
+func Forbidden(p *Principal, reason string) AuthResult {
+	return AuthResult{AuthForbidden, p, reason}
+}
+
+//Reports whether the principal was granted the scope
+func (p *Principal) HasScope(scope string) bool {
+	if p == nil {
+		return false
+	}
+	for i := range p.Scopes {
+		if p.Scopes[i] == scope {
+			return true
+		}
+	}
+	return false
+}
+
 //Registers an Authorizer for the specified security scheme
 func RegisterAuthorizer(scheme string, auth Authorizer){
 	if authorizers == nil{
@@ -42,6 +102,40 @@ func RegisterAuthorizer(scheme string, auth Authorizer){
 	
 	if _,found := authorizers[scheme]; !found{
 		authorizers[scheme] = auth
+		registerPrincipalAuthorizer(scheme, legacyAuthorizer(auth))
+	}
+}
+
+//Registers a PrincipalAuthorizer for the specified security scheme
+func RegisterPrincipalAuthorizer(scheme string, auth PrincipalAuthorizer) {
+	if authorizers == nil{
+		authorizers = make(map[string]Authorizer,0)
+	}
+
+	if _, found := authorizers[scheme]; !found {
+		authorizers[scheme] = func(token string, scheme string, scopes []string, method string, rb *ResponseBuilder) bool {
+			result := auth(token, scheme, scopes, method, rb)
+			rb.ctx.principal = result.Principal
+			return result.Decision == AuthAllow
+		}
+		registerPrincipalAuthorizer(scheme, auth)
+	}
+}
+
+func registerPrincipalAuthorizer(scheme string, auth PrincipalAuthorizer) {
+	if principalAuthorizers == nil {
+		principalAuthorizers = make(map[string]PrincipalAuthorizer, 0)
+	}
+	principalAuthorizers[scheme] = auth
+}
+
+// a plain Authorizer can not tell missing credentials from missing scope, a refusal is a 401
+func legacyAuthorizer(auth Authorizer) PrincipalAuthorizer {
+	return func(token string, scheme string, scopes []string, method string, rb *ResponseBuilder) AuthResult {
+		if auth(token, scheme, scopes, method, rb) {
+			return Authenticated(rb.ctx.principal)
+		}
+		return Unauthenticated("authorizer for " + scheme + " refused the request")
 	}
 }
 
@@ -54,6 +148,15 @@ func GetAuthorizer(scheme string)(a Authorizer){
 	return 
 }
 
+//Returns the registred PrincipalAuthorizer for the specified scheme, Authorizers are adapted
+func GetPrincipalAuthorizer(scheme string) (a PrincipalAuthorizer) {
+	if principalAuthorizers == nil {
+		principalAuthorizers = make(map[string]PrincipalAuthorizer, 0)
+	}
+	a, _ = principalAuthorizers[scheme]
+	return
+}
+
 //This is the default and exmaple authorizer that is used to authorize requests to endpints with a security scheme
 //It always allows access and returns nil for SessionData.  
 func DefaultAuthorizer(token string, scheme string, scopes []string, method string, rb *ResponseBuilder) bool {
@@ -61,3 +164,112 @@ func DefaultAuthorizer(token string, scheme string, scopes []string, method stri
 	return true
 }
 
+// Evaluates the endpoint's security requirements in order until one is satisfied, any of them is sufficient.
+// Every scheme in a requirement must allow the request, each is given the credential extracted for it.
+// A refusal is a 403 when a scheme recognised the caller, otherwise a 401 challenging for every scheme tried.
+func authorizeRequest(rb *ResponseBuilder, ep EndPointStruct, args map[string]string, realm string) bool {
+	forbidden := false
+	tried := make(map[string]bool)
+	schemes := make([]string, 0)
+
+	for _, req := range ep.Security {
+		var principal *Principal
+		satisfied := true
+
+		for _, key := range req.schemes() {
+			scopes := req[key]
+			alteredScopes := make([]string, len(scopes))
+			for i := range scopes {
+				alteredScopes[i] = replaceScopeKey(scopes[i], args)
+			}
+
+			if !tried[key] {
+				tried[key] = true
+				schemes = append(schemes, key)
+			}
+
+			auth := GetPrincipalAuthorizer(key)
+			if auth == nil {
+				logger.Error.Println("[sec] no authorizer registered for scheme " + key)
+				satisfied = false
+				break
+			}
+
+			result := auth(rb.ctx.credentials[key], key, alteredScopes, rb.ctx.request.Method, rb)
+			if result.Decision == AuthAllow {
+				// the first scheme that identifies the caller provides the principal
+				if principal == nil {
+					principal = result.Principal
+				}
+				continue
+			}
+
+			if result.Decision == AuthForbidden {
+				forbidden = true
+				rb.ctx.principal = result.Principal
+			}
+			if result.Reason != "" {
+				logger.Warning.Println("[sec] scheme: " + key + " method: " + rb.ctx.request.Method + " url: " + rb.ctx.request.URL.Path + " reason: " + result.Reason)
+			}
+			satisfied = false
+			break
+		}
+
+		if satisfied {
+			rb.ctx.principal = principal
+			return true
+		}
+	}
+
+	if forbidden {
+		for _, key := range schemes {
+			if _manager().securityDef[key].Mode == "oauth2" {
+				rb.AddHeader("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+				break
+			}
+		}
+		rb.SetResponseCode(http.StatusForbidden)
+		rb.SetResponseMsg(http.StatusText(http.StatusForbidden))
+		return false
+	}
+
+	for _, key := range schemes {
+		if challenge := authChallenge(_manager().securityDef[key], realm, rb.ctx.credentials[key] != ""); challenge != "" {
+			rb.AddHeader("WWW-Authenticate", challenge)
+		}
+	}
+	rb.SetResponseCode(http.StatusUnauthorized)
+	rb.SetResponseMsg(http.StatusText(http.StatusUnauthorized))
+	return false
+}
+
+// the WWW-Authenticate challenge for a security definition (RFC 7235, RFC 6750 for bearer tokens)
+func authChallenge(def SecurityStruct, realm string, tokenSent bool) string {
+	params := make([]string, 0)
+	if realm != "" {
+		params = append(params, `realm="` + realm + `"`)
+	}
+
+	scheme := ""
+	switch def.Mode {
+	case "basic":
+		scheme = "Basic"
+	case "oauth2":
+		scheme = "Bearer"
+		if tokenSent {
+			params = append(params, `error="invalid_token"`)
+		}
+	case "api_key":
+		scheme = "ApiKey"
+		if def.Name != "" {
+			params = append(params, `name="` + def.Name + `"`, `in="` + def.Location + `"`)
+		}
+	default:
+		return ""
+	}
+
+	if len(params) == 0 {
+		return scheme
+	}
+	return scheme + " " + strings.Join(params, ", ")
+}
@@ -0,0 +1,205 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+
+package gorest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// a credential names its holder, the holder of "weak" has no scopes
+func secTestAuthorizer(token string, scheme string, scopes []string, method string, rb *ResponseBuilder) AuthResult {
+	switch token {
+	case "":
+		return Unauthenticated("no credential")
+	case "weak":
+		p := &Principal{Subject: "weak"}
+		if len(scopes) > 0 {
+			return Forbidden(p, "missing scope")
+		}
+		return Authenticated(p)
+	case "alice", "bob":
+		return Authenticated(&Principal{Subject: token, Scopes: scopes})
+	}
+	return Unauthenticated("unknown credential")
+}
+
+func registerSecTestSchemes() {
+	RegisterPrincipalAuthorizer("SecA", secTestAuthorizer)
+	RegisterPrincipalAuthorizer("SecB", secTestAuthorizer)
+}
+
+func TestParseSecurityTag(t *testing.T) {
+	registerSecTestSchemes()
+
+	cases := []struct {
+		tag	string
+		reqs	[]SecurityRequirement
+	}{
+		{"SecA", []SecurityRequirement{{"SecA": {}}}},
+		{"SecA:[]", []SecurityRequirement{{"SecA": {}}}},
+		{"SecA:[read,write]", []SecurityRequirement{{"SecA": {"read", "write"}}}},
+		{"SecA&SecB:[read]", []SecurityRequirement{{"SecA": {}, "SecB": {"read"}}}},
+		{"SecA|SecB", []SecurityRequirement{{"SecA": {}}, {"SecB": {}}}},
+		{" SecA:[a|b] & SecB | SecB:[c&d] ", []SecurityRequirement{{"SecA": {"a|b"}, "SecB": {}}, {"SecB": {"c&d"}}}},
+	}
+
+	for _, tc := range cases {
+		if reqs := parseSecurityTag(tc.tag); !reflect.DeepEqual(reqs, tc.reqs) {
+			t.Errorf("%q: expected %v, got %v", tc.tag, tc.reqs, reqs)
+		}
+	}
+}
+
+func TestAuthorizeRequest(t *testing.T) {
+	registerSecTestSchemes()
+
+	cases := []struct {
+		name		string
+		tag		string
+		credentials	map[string]string
+		code		int
+		subject		string
+	}{
+		{"single scheme", "SecA", map[string]string{"SecA": "alice"}, 0, "alice"},
+		{"missing credential", "SecA", map[string]string{}, http.StatusUnauthorized, ""},
+		{"unknown credential", "SecA", map[string]string{"SecA": "mallory"}, http.StatusUnauthorized, ""},
+		{"insufficient scope", "SecA:[admin]", map[string]string{"SecA": "weak"}, http.StatusForbidden, "weak"},
+		{"and, both", "SecA&SecB", map[string]string{"SecA": "alice", "SecB": "bob"}, 0, "alice"},
+		{"and, one missing", "SecA&SecB", map[string]string{"SecA": "alice"}, http.StatusUnauthorized, ""},
+		{"and, one lacking scope", "SecA&SecB:[admin]", map[string]string{"SecA": "alice", "SecB": "weak"}, http.StatusForbidden, "weak"},
+		{"or, first", "SecA|SecB", map[string]string{"SecA": "alice"}, 0, "alice"},
+		{"or, second", "SecA|SecB", map[string]string{"SecB": "bob"}, 0, "bob"},
+		{"or, none", "SecA|SecB", map[string]string{}, http.StatusUnauthorized, ""},
+		{"or, scope lacking then missing", "SecA:[admin]|SecB", map[string]string{"SecA": "weak"}, http.StatusForbidden, "weak"},
+		{"or, scope lacking then satisfied", "SecA:[admin]|SecB", map[string]string{"SecA": "weak", "SecB": "bob"}, 0, "bob"},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/orders", nil)
+		rb := &ResponseBuilder{ctx: &Context{writer: httptest.NewRecorder(), request: req, credentials: tc.credentials}}
+		ep := EndPointStruct{Security: parseSecurityTag(tc.tag)}
+
+		allowed := authorizeRequest(rb, ep, nil, "")
+		if allowed != (tc.code == 0) || rb.ctx.responseCode != tc.code {
+			t.Errorf("%s: expected code %d, got allowed %v code %d", tc.name, tc.code, allowed, rb.ctx.responseCode)
+		}
+		subject := ""
+		if rb.ctx.principal != nil {
+			subject = rb.ctx.principal.Subject
+		}
+		if subject != tc.subject {
+			t.Errorf("%s: expected principal %q, got %q", tc.name, tc.subject, subject)
+		}
+	}
+
+	// scopes naming a path argument are given its value
+	var given	[]string
+	RegisterPrincipalAuthorizer("SecScopes", func(token string, scheme string, scopes []string, method string, rb *ResponseBuilder) AuthResult {
+		given = scopes
+		return Authenticated(&Principal{Subject: token})
+	})
+	rb := &ResponseBuilder{ctx: &Context{writer: httptest.NewRecorder(), request: httptest.NewRequest("GET", "/orders/7", nil), credentials: map[string]string{"SecScopes": "alice"}}}
+	authorizeRequest(rb, EndPointStruct{Security: parseSecurityTag("SecScopes:[orders{id}]")}, map[string]string{"id": "7"}, "")
+	if !reflect.DeepEqual(given, []string{"orders[7]"}) {
+		t.Error("scope with a path argument:", given)
+	}
+}
+
+type defaultSecService struct {
+	RestService	`root:"/default-sec-service/" consumes:"application/json" produces:"application/json" security:"SecTestKey"`
+	SecTestKey	Security	`mode:"api_key" location:"header" name:"X-Sec-Test-Key"`
+	inherited	EndPoint	`method:"GET" path:"/inherited" output:"string"`
+	open		EndPoint	`method:"GET" path:"/open" output:"string" security:"none"`
+}
+
+func (serv defaultSecService) Inherited() string {
+	return serv.Principal().Subject
+}
+
+func (serv defaultSecService) Open() string {
+	return "open"
+}
+
+func TestServiceDefaultSecurity(t *testing.T) {
+	RegisterPrincipalAuthorizer("SecTestKey", secTestAuthorizer)
+	RegisterService(new(defaultSecService))
+	srv := httptest.NewServer(Handle())
+	defer srv.Close()
+
+	cases := []struct {
+		path	string
+		key	string
+		code	int
+		body	string
+	}{
+		{"/inherited", "", http.StatusUnauthorized, ""},
+		{"/inherited", "mallory", http.StatusUnauthorized, ""},
+		{"/inherited", "alice", http.StatusOK, `"alice"`},
+		{"/open", "", http.StatusOK, `"open"`},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest("GET", srv.URL + "/default-sec-service" + tc.path, nil)
+		if tc.key != "" {
+			req.Header.Set("X-Sec-Test-Key", tc.key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.code || (tc.body != "" && string(body) != tc.body) {
+			t.Errorf("%s with key %q: expected %d %s, got %d %s", tc.path, tc.key, tc.code, tc.body, resp.StatusCode, body)
+		}
+	}
+
+	found := 0
+	for _, ps := range GetPathSecurity() {
+		switch ps.Path {
+		case "default-sec-service/inherited":
+			found++
+			if !reflect.DeepEqual(ps.Security, []SecurityRequirement{{"SecTestKey": {}}}) {
+				t.Error("inherited security:", ps.Security)
+			}
+		case "default-sec-service/open":
+			found++
+			if len(ps.Security) != 0 {
+				t.Error("security:none kept:", ps.Security)
+			}
+		}
+	}
+	if found != 2 {
+		t.Error("endpoints missing from GetPathSecurity:", found)
+	}
+}
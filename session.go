@@ -0,0 +1,427 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/rmullinnix461332/logger"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A session as kept by a SessionStore
+type StoredSession struct {
+	Values		map[string]interface{}	`json:"values"`
+	Created		time.Time		`json:"created"`
+	LastAccess	time.Time		`json:"lastAccess"`
+	Expires		time.Time		`json:"expires"`	// the earlier of the idle and absolute expiry
+}
+
+//Keeps sessions between requests, by session id
+type SessionStore interface {
+	Load(id string) (StoredSession, bool, error)
+	Save(id string, session StoredSession) error
+	Delete(id string) error
+}
+
+//Configuration of persistent sessions, set with SetSessionStore
+type SessionOptions struct {
+	Store		SessionStore
+	Secret		[]byte			// signs the session cookie, share it between instances; random when empty
+	EncryptionKey	[]byte			// 16, 24 or 32 bytes, when set the cookie is AES-GCM encrypted instead of signed
+	CookieName	string			// default gorest_session
+	Path		string			// default /
+	Domain		string
+	Secure		bool			// always mark the cookie Secure, it is for https requests
+	SameSite	http.SameSite		// default Lax
+	IdleTimeout	time.Duration		// default 30 minutes
+	AbsoluteTimeout	time.Duration		// default 12 hours
+}
+
+// values that describe the request, or are set by authorizers from its credentials, they are not persisted
+var requestScopedKeys = map[string]bool{SessionHost: true, SessionUserID: true, SessionUserUUID: true, SessionScope: true, SessionScopeContext: true}
+
+var sessionMu sync.RWMutex
+var sessionOpts *SessionOptions
+
+// the persisted side of a request's SessionData
+type sessionState struct {
+	opts		*SessionOptions
+	writer		http.ResponseWriter
+	secure		bool
+	id		string
+	created		time.Time
+}
+
+//Makes SessionData persistent: values set during a request are saved in the store and read back on the
+//client's later requests, identified by the session cookie. Without a store SessionData lasts one request.
+func SetSessionStore(opts SessionOptions) {
+	if opts.Store == nil {
+		logger.Error.Panicln("[sec] sessions need a session store")
+	}
+	if opts.Secret == nil {
+		logger.Warning.Println("[sec] sessions: no secret, session cookies will not be accepted after a restart or by other instances")
+		opts.Secret = randomBytes(32)
+	}
+	if opts.EncryptionKey != nil {
+		if _, err := aes.NewCipher(opts.EncryptionKey); err != nil {
+			logger.Error.Panicln("[sec] sessions: invalid encryption key: " + err.Error())
+		}
+	}
+	if opts.CookieName == "" {
+		opts.CookieName = "gorest_session"
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.SameSite == 0 {
+		opts.SameSite = http.SameSiteLaxMode
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = 30 * time.Minute
+	}
+	if opts.AbsoluteTimeout == 0 {
+		opts.AbsoluteTimeout = 12 * time.Hour
+	}
+
+	sessionMu.Lock()
+	sessionOpts = &opts
+	sessionMu.Unlock()
+}
+
+func sessionOptions() *SessionOptions {
+	sessionMu.RLock()
+	defer sessionMu.RUnlock()
+	return sessionOpts
+}
+
+//Returns the id of the persistent session, empty when there is none yet
+func (this *ResponseBuilder) SessionID() string {
+	if state := this.ctx.sessData.state; state != nil {
+		return state.id
+	}
+	return ""
+}
+
+//Moves the session to a new id, keeping its values. Call it on login (and on privilege changes)
+//so an id known before authentication can not be used to ride the authenticated session.
+func (this *ResponseBuilder) RegenerateSession() {
+	state := this.ctx.sessData.state
+	if state == nil {
+		logger.Warning.Println("[sec] sessions: RegenerateSession called without a session store")
+		return
+	}
+	if state.id != "" {
+		if err := state.opts.Store.Delete(state.id); err != nil {
+			logger.Error.Println("[sec] sessions: could not delete the replaced session: " + err.Error())
+		}
+	}
+	state.start()
+}
+
+//Ends the session, its values are removed from the store and the request, and the cookie is expired
+func (this *ResponseBuilder) DestroySession() {
+	state := this.ctx.sessData.state
+	if state == nil {
+		return
+	}
+	if state.id != "" {
+		if err := state.opts.Store.Delete(state.id); err != nil {
+			logger.Error.Println("[sec] sessions: could not delete the session: " + err.Error())
+		}
+		state.id = ""
+		state.setCookie("", -1)
+	}
+	for key := range this.ctx.sessData.relSessionData {
+		if !requestScopedKeys[key] {
+			delete(this.ctx.sessData.relSessionData, key)
+		}
+	}
+}
+
+// a new id, sent to the client straight away so it is set before the response is written
+func (state *sessionState) start() {
+	state.id = base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	state.created = time.Now()
+	state.setCookie(state.opts.seal(state.id), int(state.opts.AbsoluteTimeout / time.Second))
+}
+
+func (state *sessionState) setCookie(value string, maxAge int) {
+	cookie := &http.Cookie{
+		Name:		state.opts.CookieName,
+		Value:		value,
+		Path:		state.opts.Path,
+		Domain:		state.opts.Domain,
+		MaxAge:		maxAge,
+		Secure:		state.opts.Secure || state.secure,
+		HttpOnly:	true,
+		SameSite:	state.opts.SameSite,
+	}
+	if maxAge > 0 {
+		cookie.Expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+	}
+	http.SetCookie(state.writer, cookie)
+}
+
+// reads the session named by the request's cookie into the SessionData
+func loadSession(rb *ResponseBuilder) {
+	opts := sessionOptions()
+	if opts == nil {
+		return
+	}
+	state := &sessionState{opts: opts, writer: rb.ctx.writer, secure: rb.ctx.request.TLS != nil}
+	rb.ctx.sessData.state = state
+
+	cookie, err := rb.ctx.request.Cookie(opts.CookieName)
+	if err != nil {
+		return
+	}
+	id, valid := opts.open(cookie.Value)
+	if !valid {
+		logger.Warning.Println("[sec] sessions: invalid session cookie from " + rb.ctx.request.RemoteAddr)
+		return
+	}
+
+	stored, found, err := opts.Store.Load(id)
+	if err != nil {
+		logger.Error.Println("[sec] sessions: could not load the session: " + err.Error())
+		return
+	}
+	if !found {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(stored.LastAccess) > opts.IdleTimeout || now.Sub(stored.Created) > opts.AbsoluteTimeout {
+		logger.Info.Println("[sec] sessions: session expired, created: " + stored.Created.Format(time.RFC3339) + " last access: " + stored.LastAccess.Format(time.RFC3339))
+		opts.Store.Delete(id)
+		state.setCookie("", -1)
+		return
+	}
+
+	state.id = id
+	state.created = stored.Created
+	for key, value := range stored.Values {
+		if !requestScopedKeys[key] {
+			rb.ctx.sessData.relSessionData[key] = value
+		}
+	}
+}
+
+// writes the request's session values back to the store
+func saveSession(rb *ResponseBuilder) {
+	state := rb.ctx.sessData.state
+	if state == nil || state.id == "" {
+		return
+	}
+
+	values := make(map[string]interface{})
+	for key, value := range rb.ctx.sessData.relSessionData {
+		if !requestScopedKeys[key] {
+			values[key] = value
+		}
+	}
+
+	now := time.Now()
+	expires := now.Add(state.opts.IdleTimeout)
+	if absolute := state.created.Add(state.opts.AbsoluteTimeout); absolute.Before(expires) {
+		expires = absolute
+	}
+	stored := StoredSession{Values: values, Created: state.created, LastAccess: now, Expires: expires}
+	if err := state.opts.Store.Save(state.id, stored); err != nil {
+		logger.Error.Println("[sec] sessions: could not save the session: " + err.Error())
+	}
+}
+
+// the cookie value for a session id, encrypted when there is an encryption key, signed otherwise
+func (opts *SessionOptions) seal(id string) string {
+	if opts.EncryptionKey != nil {
+		gcm := opts.gcm()
+		nonce := randomBytes(gcm.NonceSize())
+		return base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(id), nil))
+	}
+	mac := hmac.New(sha256.New, opts.Secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (opts *SessionOptions) open(value string) (string, bool) {
+	if opts.EncryptionKey != nil {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		gcm := opts.gcm()
+		if err != nil || len(data) < gcm.NonceSize() {
+			return "", false
+		}
+		id, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+		return string(id), err == nil
+	}
+
+	dot := strings.LastIndex(value, ".")
+	if dot < 1 {
+		return "", false
+	}
+	id := value[:dot]
+	return id, hmac.Equal([]byte(opts.seal(id)), []byte(value))
+}
+
+func (opts *SessionOptions) gcm() cipher.AEAD {
+	block, _ := aes.NewCipher(opts.EncryptionKey)
+	gcm, _ := cipher.NewGCM(block)
+	return gcm
+}
+
+//SessionStore kept in memory, sessions are lost on restart
+type MemorySessionStore struct {
+	mu		sync.Mutex
+	sessions	map[string]StoredSession
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]StoredSession)}
+}
+
+func (m *MemorySessionStore) Load(id string) (StoredSession, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, found := m.sessions[id]
+	return session, found, nil
+}
+
+func (m *MemorySessionStore) Save(id string, session StoredSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.sessions) > 10000 {
+		now := time.Now()
+		for key, s := range m.sessions {
+			if now.After(s.Expires) {
+				delete(m.sessions, key)
+			}
+		}
+	}
+	m.sessions[id] = session
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	return nil
+}
+
+//SessionStore keeping each session in a json file of the directory. Values are read back as json
+//types, e.g. numbers as float64.
+type FileSessionStore struct {
+	dir		string
+}
+
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{dir: dir}, nil
+}
+
+// file names are a hash of the id, so listing the directory does not reveal session ids
+func (f *FileSessionStore) file(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:]) + ".json")
+}
+
+func (f *FileSessionStore) Load(id string) (StoredSession, bool, error) {
+	var session	StoredSession
+
+	data, err := ioutil.ReadFile(f.file(id))
+	if os.IsNotExist(err) {
+		return session, false, nil
+	} else if err != nil {
+		return session, false, err
+	}
+	if err := json.Unmarshal(data, &session); err != nil {
+		return session, false, errors.New("corrupt session file " + f.file(id) + ": " + err.Error())
+	}
+	return session, true, nil
+}
+
+func (f *FileSessionStore) Save(id string, session StoredSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(f.dir, ".session-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), f.file(id))
+}
+
+func (f *FileSessionStore) Delete(id string) error {
+	if err := os.Remove(f.file(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//Removes the files of expired sessions, run it periodically
+func (f *FileSessionStore) DeleteExpired() error {
+	files, err := filepath.Glob(filepath.Join(f.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, name := range files {
+		var session	StoredSession
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if json.Unmarshal(data, &session) != nil || now.After(session.Expires) {
+			os.Remove(name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+package gorest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sessionService struct {
+	RestService	`root:"/session-service/" consumes:"application/json" produces:"application/json"`
+	cart		EndPoint	`method:"GET" path:"/cart" output:"string"`
+	add		EndPoint	`method:"PUT" path:"/cart/{item:string}"`
+	login		EndPoint	`method:"POST" path:"/login" postdata:"string"`
+	logout		EndPoint	`method:"DELETE" path:"/login"`
+}
+
+func (serv sessionService) Cart() string {
+	item, _ := serv.Session().Get("cart")
+	s, _ := item.(string)
+	return s
+}
+
+func (serv sessionService) Add(item string) {
+	serv.Session().Set("cart", item)
+}
+
+func (serv sessionService) Login(user string) {
+	serv.RB().RegenerateSession()
+	serv.Session().Set("user", user)
+}
+
+func (serv sessionService) Logout() {
+	serv.RB().DestroySession()
+}
+
+func TestSessionCookieSealing(t *testing.T) {
+	cases := []struct {
+		name	string
+		opts	SessionOptions
+		other	SessionOptions
+	}{
+		{"signed", SessionOptions{Secret: []byte("secret-one")}, SessionOptions{Secret: []byte("secret-two")}},
+		{"aes-128", SessionOptions{EncryptionKey: []byte("0123456789abcdef")}, SessionOptions{EncryptionKey: []byte("fedcba9876543210")}},
+		{"aes-256", SessionOptions{EncryptionKey: []byte("0123456789abcdef0123456789abcdef")}, SessionOptions{EncryptionKey: []byte("0123456789abcdef0123456789abcdeX")}},
+	}
+
+	for _, tc := range cases {
+		value := tc.opts.seal("session-id")
+		if id, valid := tc.opts.open(value); !valid || id != "session-id" {
+			t.Errorf("%s: round trip gave %q %v", tc.name, id, valid)
+		}
+		if _, valid := tc.other.open(value); valid {
+			t.Errorf("%s: opened with another key", tc.name)
+		}
+		tampered := []byte(value)
+		tampered[len(tampered) / 2] ^= 1
+		if id, valid := tc.opts.open(string(tampered)); valid && id == "session-id" {
+			t.Errorf("%s: tampered cookie accepted", tc.name)
+		}
+		if _, valid := tc.opts.open(""); valid {
+			t.Errorf("%s: empty cookie accepted", tc.name)
+		}
+		if tc.opts.EncryptionKey != nil && (strings.Contains(value, "session-id") || value == tc.opts.seal("session-id")) {
+			t.Errorf("%s: id readable or nonce reused: %s", tc.name, value)
+		}
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sessions")
+	store, err := NewFileSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Round(time.Second)
+	store.Save("live", StoredSession{Values: map[string]interface{}{"count": 3, "name": "ann"}, Created: now, LastAccess: now, Expires: now.Add(time.Hour)})
+	store.Save("stale", StoredSession{Created: now, LastAccess: now, Expires: now.Add(-time.Minute)})
+
+	session, found, err := store.Load("live")
+	if err != nil || !found {
+		t.Fatal("saved session not found:", err)
+	}
+	// json types come back
+	if session.Values["count"] != 3.0 || session.Values["name"] != "ann" || !session.Created.Equal(now) {
+		t.Errorf("loaded session: %+v", session)
+	}
+	if _, found, _ := store.Load("missing"); found {
+		t.Error("missing session found")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		if strings.Contains(f.Name(), "live") || strings.Contains(f.Name(), "stale") {
+			t.Error("file name gives the session id away:", f.Name())
+		}
+	}
+
+	store.DeleteExpired()
+	if _, found, _ := store.Load("stale"); found {
+		t.Error("expired session kept")
+	}
+	store.Delete("live")
+	if _, found, _ := store.Load("live"); found {
+		t.Error("deleted session kept")
+	}
+
+	ioutil.WriteFile(store.file("corrupt"), []byte("{"), 0600)
+	if _, _, err := store.Load("corrupt"); err == nil {
+		t.Error("corrupt session file loaded")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	RegisterService(new(sessionService))
+	srv := httptest.NewServer(Handle())
+	defer srv.Close()
+	defer func() {
+		sessionMu.Lock()
+		sessionOpts = nil
+		sessionMu.Unlock()
+	}()
+
+	fileStore, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name	string
+		opts	SessionOptions
+	}{
+		{"signed", SessionOptions{Store: NewMemorySessionStore(), Secret: []byte("session-test-secret")}},
+		{"encrypted", SessionOptions{Store: NewMemorySessionStore(), EncryptionKey: []byte("0123456789abcdef")}},
+		{"file", SessionOptions{Store: fileStore, Secret: []byte("session-test-secret")}},
+	}
+
+	for _, tc := range cases {
+		SetSessionStore(tc.opts)
+		opts := sessionOptions()
+
+		call := func(method string, path string, cookie *http.Cookie) (string, *http.Cookie) {
+			req, _ := http.NewRequest(method, srv.URL + "/session-service" + path, strings.NewReader(`"ann"`))
+			req.Header.Set("Content-Type", "application/json")
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			for _, c := range resp.Cookies() {
+				if c.Name == opts.CookieName {
+					return string(body), c
+				}
+			}
+			return string(body), nil
+		}
+		age := func(cookie *http.Cookie, created time.Duration, lastAccess time.Duration) {
+			id, _ := opts.open(cookie.Value)
+			stored, _, _ := opts.Store.Load(id)
+			stored.Created = stored.Created.Add(-created)
+			stored.LastAccess = stored.LastAccess.Add(-lastAccess)
+			opts.Store.Save(id, stored)
+		}
+
+		// a session starts on the first value set
+		if body, cookie := call("GET", "/cart", nil); body != `""` || cookie != nil {
+			t.Errorf("%s: session without values: %s %v", tc.name, body, cookie)
+		}
+		_, cookie := call("PUT", "/cart/apple", nil)
+		if cookie == nil || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+			t.Fatalf("%s: session cookie: %+v", tc.name, cookie)
+		}
+		if body, _ := call("GET", "/cart", cookie); body != `"apple"` {
+			t.Errorf("%s: value not kept: %s", tc.name, body)
+		}
+		if body, _ := call("GET", "/cart", &http.Cookie{Name: opts.CookieName, Value: cookie.Value + "x"}); body != `""` {
+			t.Errorf("%s: altered cookie accepted: %s", tc.name, body)
+		}
+
+		// a new id on login, the values move with it
+		_, renewed := call("POST", "/login", cookie)
+		if renewed == nil || renewed.Value == cookie.Value {
+			t.Fatalf("%s: session not regenerated: %+v", tc.name, renewed)
+		}
+		if body, _ := call("GET", "/cart", cookie); body != `""` {
+			t.Errorf("%s: replaced id still works: %s", tc.name, body)
+		}
+		if body, _ := call("GET", "/cart", renewed); body != `"apple"` {
+			t.Errorf("%s: values lost on regeneration: %s", tc.name, body)
+		}
+
+		// idle and absolute expiry
+		age(renewed, 0, opts.IdleTimeout + time.Minute)
+		if body, expired := call("GET", "/cart", renewed); body != `""` || expired == nil || expired.MaxAge >= 0 {
+			t.Errorf("%s: idle session kept: %s %+v", tc.name, body, expired)
+		}
+		_, cookie = call("PUT", "/cart/pear", nil)
+		age(cookie, opts.AbsoluteTimeout + time.Minute, 0)
+		if body, _ := call("GET", "/cart", cookie); body != `""` {
+			t.Errorf("%s: session past its absolute timeout kept: %s", tc.name, body)
+		}
+
+		_, cookie = call("PUT", "/cart/plum", nil)
+		if _, cleared := call("DELETE", "/login", cookie); cleared == nil || cleared.MaxAge >= 0 {
+			t.Errorf("%s: cookie not cleared: %+v", tc.name, cleared)
+		}
+		if body, _ := call("GET", "/cart", cookie); body != `""` {
+			t.Errorf("%s: destroyed session kept: %s", tc.name, body)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+package gorest
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"time"
+)
+
+//Keys the framework and its authorizers set in SessionData, read them with the typed methods
+const (
+	SessionHost		= "Host"		// the request's Host header
+	SessionUserID		= "UserId"		// the user claim of an oauth2 jwt, the user of basic authentication
+	SessionUserUUID		= "UserUUID"		// the useruuid claim of an oauth2 jwt
+	SessionScope		= "Scope"		// the scopes granted by the credential, []string
+	SessionScopeContext	= "ScopeContext"	// the bracketed list of a matched scope, e.g. orders[12,14] gives "12,14"
+)
+
+//A request scoped value of type T. Each NewKey is distinct, so libraries can keep values in
+//SessionData without colliding with each other or with string keys. The values are never persisted.
+type Key[T any] struct {
+	name		string
+}
+
+//Creates a key, the name is only used for debugging
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+func (k *Key[T]) String() string {
+	return k.name
+}
+
+func (k *Key[T]) Get(sess SessionData) (T, bool) {
+	value, found := sess.values[k]
+	if !found {
+		var zero	T
+		return zero, false
+	}
+	return value.(T), true
+}
+
+func (k *Key[T]) Set(sess SessionData, value T) {
+	sess.values[k] = value
+}
+
+//Returns the value of the key as a T. Besides values stored as a T, numbers are converted between
+//int, int64 and float64, []interface{} of strings is read as []string and RFC 3339 strings as time.Time,
+//which are the forms values take after a round trip through a json session store.
+//The second value is false when the key is not set or can not be read as a T.
+func Get[T any](sess SessionData, key string) (T, bool) {
+	var out		T
+
+	value, found := sess.relSessionData[key]
+	if !found || value == nil {
+		return out, false
+	}
+	if typed, ok := value.(T); ok {
+		return typed, true
+	}
+
+	switch p := any(&out).(type) {
+	case *int:
+		n, ok := intValue(value)
+		if ok && n >= math.MinInt && n <= math.MaxInt {
+			*p = int(n)
+			return out, true
+		}
+	case *int64:
+		n, ok := intValue(value)
+		*p = n
+		return out, ok
+	case *float64:
+		f, ok := floatValue(value)
+		*p = f
+		return out, ok
+	case *[]string:
+		list, ok := value.([]interface{})
+		if !ok {
+			return out, false
+		}
+		strs := make([]string, len(list))
+		for i := range list {
+			if strs[i], ok = list[i].(string); !ok {
+				return out, false
+			}
+		}
+		*p = strs
+		return out, true
+	case *time.Time:
+		if s, ok := value.(string); ok {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			*p = t
+			return out, err == nil
+		}
+	}
+	return out, false
+}
+
+//Get the value of the item referenced by key as a string, false when it is not set or not a string
+func (sess SessionData) GetString(key string) (string, bool) {
+	return Get[string](sess, key)
+}
+
+func (sess SessionData) GetInt(key string) (int, bool) {
+	return Get[int](sess, key)
+}
+
+func (sess SessionData) GetStrings(key string) ([]string, bool) {
+	return Get[[]string](sess, key)
+}
+
+func (sess SessionData) GetTime(key string) (time.Time, bool) {
+	return Get[time.Time](sess, key)
+}
+
+//The request's Host header
+func (sess SessionData) Host() string {
+	host, _ := sess.GetString(SessionHost)
+	return host
+}
+
+//The request's Origin header, empty for same origin requests
+func (sess SessionData) Origin() string {
+	if sess.ctx == nil {
+		return ""
+	}
+	return sess.ctx.request.Header.Get("Origin")
+}
+
+//The request's X-Request-Id header, or the id generated for it, sent back in the response
+func (sess SessionData) RequestID() string {
+	if sess.ctx == nil {
+		return ""
+	}
+	return sess.ctx.requestID
+}
+
+//The principal authenticated for the request, nil when there is none
+func (sess SessionData) Principal() *Principal {
+	if sess.ctx == nil {
+		return nil
+	}
+	return sess.ctx.principal
+}
+
+//The scopes of the principal, or those an authorizer left in the Scope key
+func (sess SessionData) Scopes() []string {
+	if p := sess.Principal(); p != nil && p.Scopes != nil {
+		return p.Scopes
+	}
+	scopes, _ := sess.GetStrings(SessionScope)
+	return scopes
+}
+
+func (sess SessionData) UserID() string {
+	user, _ := sess.GetString(SessionUserID)
+	return user
+}
+
+func (sess SessionData) ScopeContext() string {
+	context, _ := sess.GetString(SessionScopeContext)
+	return context
+}
+
+func intValue(value interface{}) (int64, bool) {
+	switch n := value.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	case float32, float64:
+		f := reflect.ValueOf(n).Float()
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(f), true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v.Uint()), true
+	}
+	return 0, false
+}
+
+func floatValue(value interface{}) (float64, bool) {
+	if n, ok := value.(json.Number); ok {
+		f, err := n.Float64()
+		return f, err == nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	}
+	return 0, false
+}
@@ -0,0 +1,175 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+
+package gorest
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionDataGet(t *testing.T) {
+	when := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	sess := SessionData{relSessionData: map[string]interface{}{
+		"int":		42,
+		"int8":		int8(-3),
+		"uint":		uint(7),
+		"bigUint":	uint64(math.MaxUint64),
+		"float":	42.0,
+		"fraction":	2.5,
+		"hugeFloat":	1e20,
+		"number":	json.Number("12"),
+		"numberFrac":	json.Number("1.5"),
+		"string":	"hello",
+		"numeric":	"12",
+		"strings":	[]string{"a", "b"},
+		"list":		[]interface{}{"a", "b"},
+		"mixedList":	[]interface{}{"a", 1},
+		"time":		when,
+		"timeString":	"2024-05-06T07:08:09Z",
+		"badTime":	"yesterday",
+		"nil":		nil,
+	}}
+
+	cases := []struct {
+		name	string
+		get	func() (interface{}, bool)
+		value	interface{}
+		found	bool
+	}{
+		{"int", func() (interface{}, bool) { return Get[int](sess, "int") }, 42, true},
+		{"int from int8", func() (interface{}, bool) { return Get[int](sess, "int8") }, -3, true},
+		{"int from uint", func() (interface{}, bool) { return Get[int](sess, "uint") }, 7, true},
+		{"int from a whole float", func() (interface{}, bool) { return Get[int](sess, "float") }, 42, true},
+		{"int from a fraction", func() (interface{}, bool) { return Get[int](sess, "fraction") }, 0, false},
+		{"int from a float out of range", func() (interface{}, bool) { return Get[int](sess, "hugeFloat") }, 0, false},
+		{"int from json.Number", func() (interface{}, bool) { return Get[int](sess, "number") }, 12, true},
+		{"int from a fractional json.Number", func() (interface{}, bool) { return Get[int](sess, "numberFrac") }, 0, false},
+		{"int from a string", func() (interface{}, bool) { return Get[int](sess, "numeric") }, 0, false},
+		{"int64 from a uint out of range", func() (interface{}, bool) { return Get[int64](sess, "bigUint") }, int64(0), false},
+		{"int64 from int", func() (interface{}, bool) { return Get[int64](sess, "int") }, int64(42), true},
+		{"float64 from int", func() (interface{}, bool) { return Get[float64](sess, "int") }, 42.0, true},
+		{"float64 from json.Number", func() (interface{}, bool) { return Get[float64](sess, "numberFrac") }, 1.5, true},
+		{"float64 from a string", func() (interface{}, bool) { return Get[float64](sess, "string") }, 0.0, false},
+		{"string", func() (interface{}, bool) { return Get[string](sess, "string") }, "hello", true},
+		{"string from int", func() (interface{}, bool) { return Get[string](sess, "int") }, "", false},
+		{"strings", func() (interface{}, bool) { return Get[[]string](sess, "strings") }, []string{"a", "b"}, true},
+		{"strings from a list", func() (interface{}, bool) { return Get[[]string](sess, "list") }, []string{"a", "b"}, true},
+		{"strings from a mixed list", func() (interface{}, bool) { return Get[[]string](sess, "mixedList") }, []string(nil), false},
+		{"time", func() (interface{}, bool) { return Get[time.Time](sess, "time") }, when, true},
+		{"time from RFC 3339", func() (interface{}, bool) { return Get[time.Time](sess, "timeString") }, when, true},
+		{"time from another string", func() (interface{}, bool) { return Get[time.Time](sess, "badTime") }, time.Time{}, false},
+		{"nil", func() (interface{}, bool) { return Get[string](sess, "nil") }, "", false},
+		{"missing", func() (interface{}, bool) { return Get[int](sess, "missing") }, 0, false},
+	}
+
+	for _, tc := range cases {
+		value, found := tc.get()
+		if found != tc.found || (found && !reflect.DeepEqual(value, tc.value)) {
+			t.Errorf("%s: expected %v %v, got %v %v", tc.name, tc.value, tc.found, value, found)
+		}
+	}
+}
+
+func TestSessionDataAfterJSON(t *testing.T) {
+	// the forms values take when read back from a json session store
+	data, _ := json.Marshal(map[string]interface{}{"count": 3, "roles": []string{"a"}, "at": time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)})
+	values := make(map[string]interface{})
+	json.Unmarshal(data, &values)
+	sess := SessionData{relSessionData: values}
+
+	if n, ok := sess.GetInt("count"); !ok || n != 3 {
+		t.Error("int after json:", n, ok)
+	}
+	if roles, ok := sess.GetStrings("roles"); !ok || !reflect.DeepEqual(roles, []string{"a"}) {
+		t.Error("strings after json:", roles, ok)
+	}
+	if at, ok := sess.GetTime("at"); !ok || at.Hour() != 7 {
+		t.Error("time after json:", at, ok)
+	}
+}
+
+func TestSessionKeys(t *testing.T) {
+	sess := SessionData{relSessionData: make(map[string]interface{}), values: make(map[interface{}]interface{})}
+	first := NewKey[string]("tenant")
+	second := NewKey[string]("tenant")
+	count := NewKey[int]("count")
+
+	if value, found := first.Get(sess); found || value != "" {
+		t.Error("unset key:", value, found)
+	}
+	first.Set(sess, "acme")
+	count.Set(sess, 3)
+	if value, found := first.Get(sess); !found || value != "acme" {
+		t.Error("typed key:", value, found)
+	}
+	if _, found := second.Get(sess); found {
+		t.Error("keys with the same name collide")
+	}
+	if n, _ := count.Get(sess); n != 3 {
+		t.Error("int key:", n)
+	}
+	if _, found := sess.Get("tenant"); found || first.String() != "tenant" {
+		t.Error("typed key visible as a string key")
+	}
+}
+
+func TestSessionFrameworkKeys(t *testing.T) {
+	req := httptest.NewRequest("GET", "/x", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	ctx := &Context{request: req, requestID: "req-1"}
+	sess := SessionData{relSessionData: map[string]interface{}{
+		SessionHost:		"api.example.com",
+		SessionUserID:		"ann",
+		SessionScope:		[]string{"read"},
+		SessionScopeContext:	"12,14",
+	}, ctx: ctx}
+
+	if sess.Host() != "api.example.com" || sess.Origin() != "https://app.example.com" || sess.RequestID() != "req-1" || sess.UserID() != "ann" || sess.ScopeContext() != "12,14" {
+		t.Error("framework keys:", sess.Host(), sess.Origin(), sess.RequestID(), sess.UserID(), sess.ScopeContext())
+	}
+
+	// the principal's scopes come first
+	if sess.Principal() != nil || !reflect.DeepEqual(sess.Scopes(), []string{"read"}) {
+		t.Error("scopes without a principal:", sess.Scopes())
+	}
+	ctx.principal = &Principal{Subject: "ann", Scopes: []string{"write"}}
+	if sess.Principal().Subject != "ann" || !reflect.DeepEqual(sess.Scopes(), []string{"write"}) {
+		t.Error("scopes of the principal:", sess.Scopes())
+	}
+
+	// outside a request
+	empty := SessionData{relSessionData: make(map[string]interface{})}
+	if empty.Origin() != "" || empty.RequestID() != "" || empty.Principal() != nil || empty.Host() != "" || empty.Scopes() != nil {
+		t.Error("session data without a request")
+	}
+}
@@ -58,6 +58,25 @@ func cleanPath(inPath string) string {
         return path
 }
 
+// appends the mime types not already in the list, services commonly share
+// json and only differ in their alternate (protobuf, msgpack, ...) types
+func appendMime(list []string, mimes ...string) []string {
+	for _, mime := range mimes {
+		found := false
+		for _, item := range list {
+			if item == mime {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, mime)
+		}
+	}
+
+	return list
+}
+
 func isPrimitive(varType string) bool {
 	_, found := primitives[varType]
 	return found
@@ -116,8 +116,8 @@ func swaggerDocumentor12(basePath string, svcTypes map[string]gorest.ServiceMeta
 	x := 0
 	var svcInt 	reflect.Type 
 	for _, st := range svcTypes {
-		spec12.Produces = append(spec12.Produces, st.ProducesMime...)
-		spec12.Consumes = append(spec12.Consumes, st.ConsumesMime...)
+		spec12.Produces = appendMime(spec12.Produces, st.ProducesMime...)
+		spec12.Consumes = appendMime(spec12.Consumes, st.ConsumesMime...)
 	
         	svcInt = reflect.TypeOf(st.Template)
 
@@ -171,10 +171,8 @@ func swaggerDocumentor12(basePath string, svcTypes map[string]gorest.ServiceMeta
 		op.Consumes = append(op.Consumes, ep.ConsumesMime...)
 
 		op.Method = ep.RequestMethod
-		if strings.Index(ep.OutputType, ".") > 0 {
-			op.Type = ep.OutputType[strings.Index(ep.OutputType, ".")+1:]
-		} else {
-			op.Type = ep.OutputType
+		if ep.OutputTypeExpr != nil {
+			op.Type = ep.OutputTypeExpr.Base().BaseName()
 		}
 		op.Parameters = make([]Parameter, len(ep.Params) + len(ep.QueryParams))
 		//op.Authorizations = make([]Authorization, 0)
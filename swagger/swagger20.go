@@ -87,6 +87,8 @@ type OperationObject struct {
 	Schemes		[]string		`json:"schemes,omitempty"`
 	Deprecated	bool			`json:"deprecated,omitempty"`
 	Security	[]SecurityRequirement	`json:"security,omitempty"`
+	Roles		[]string		`json:"x-roles,omitempty"`
+	Policy		string			`json:"x-policy,omitempty"`
 }
 
 // Allows Referencing an external resource for extended documentation
@@ -292,8 +294,8 @@ func swaggerDocumentor20(basePath string, svcTypes map[string]gorest.ServiceMeta
 	x := 0
 	var svcInt 	reflect.Type 
 	for _, st := range svcTypes {
-		spec20.Produces = append(spec20.Produces, st.ProducesMime...)
-		spec20.Consumes = append(spec20.Consumes, st.ConsumesMime...)
+		spec20.Produces = appendMime(spec20.Produces, st.ProducesMime...)
+		spec20.Consumes = appendMime(spec20.Consumes, st.ConsumesMime...)
 	
         	svcInt = reflect.TypeOf(st.Template)
 
@@ -338,9 +340,11 @@ func swaggerDocumentor20(basePath string, svcTypes map[string]gorest.ServiceMeta
 		op.Consumes = append(op.Consumes, ep.ConsumesMime...)
 		op.Produces = append(op.Produces, ep.ProducesMime...)
 
-		if ep.SecurityScheme != nil {
-			op.Security = append(op.Security, ep.SecurityScheme)
+		for _, req := range ep.Security {
+			op.Security = append(op.Security, SecurityRequirement(req))
 		}
+		op.Roles = ep.Roles
+		op.Policy = ep.Policy
 
 		switch (ep.RequestMethod) {
 		case "GET":
@@ -392,17 +396,14 @@ func swaggerDocumentor20(basePath string, svcTypes map[string]gorest.ServiceMeta
 			pnum++
 		}
 
-		if ep.PostdataType != "" {
+		if ep.PostdataTypeExpr != nil {
 			var par		ParameterObject
 
 			par.In = "body"
-			par.Name = ep.PostdataType
+			par.Name = ep.PostdataTypeExpr.Base().BaseName()
 			par.Description = ""
 			par.Required = true
-
-			var schema	SchemaObject
-			schema.Ref = "#/definitions/" + ep.PostdataType
-			par.Schema = &schema
+			par.Schema = schemaForTypeExpr(ep.PostdataTypeExpr)
 
 			op.Parameters = append(op.Parameters, par)
 		}
@@ -416,50 +417,11 @@ func swaggerDocumentor20(basePath string, svcTypes map[string]gorest.ServiceMeta
 		methType := svcInt.Method(ep.MethodNumberInParent).Type
 		// skip the fuction class pointer
 		for i := 1; i < methType.NumIn(); i++ {
-			inType := methType.In(i)
-			if inType.Kind() == reflect.Struct {
-				if _, ok := spec20.Definitions[inType.Name()]; ok {
-					continue  // definition already exists
-				}
-
-				schema := populateDefinitions(inType)
-
-				spec20.Definitions[inType.Name()] = schema
-			}
-
-			// inType.Kind() == reflect.Slice (arrays)
+			addDefinition(methType.In(i))
 		}
 
 		for i := 0; i < methType.NumOut(); i++ {
-			outType := methType.Out(i)
-			if outType.Kind() == reflect.Struct {
-				if _, ok := spec20.Definitions[outType.Name()]; ok {
-					continue  // definition already exists
-				}
-
-				schema := populateDefinitions(outType)
-
-				spec20.Definitions[outType.Name()] = schema
-			}  else if outType.Kind() == reflect.Slice {
-				et := outType.Elem()
-				parts := strings.Split(et.String(), ".")
-				name := ""
-				if len(parts) > 1 {
-					name = parts[1]
-				} else {
-					name = parts[0]
-				}
-
-				if et.Kind() == reflect.Struct {
-					if _, ok := spec20.Definitions[name]; ok {
-						continue  // definition already exists
-					}
-
-					schema := populateDefinitions(et)
-	
-					spec20.Definitions[name] = schema
-				}
-			}
+			addDefinition(methType.Out(i))
 		}
 	}	
 
@@ -589,38 +551,7 @@ func populateResponseObject(tags reflect.StructTag, ep gorest.EndPointStruct) ma
 				resp.Description = cd_msg[1]
 				
 				if cd_msg[2] == "output}" {
-					var schema	SchemaObject
-
-					if ep.OutputTypeIsArray {
-						schema.Type = "array"
-						var items	SchemaObject
-
-						if isPrimitive(ep.OutputType)  {
-							items.Type, items.Format = primitiveFormat(ep.OutputType)
-						} else {
-							items.Ref = "#/definitions/" + ep.OutputType
-						}
-
-						schema.Items = &items
-					} else if ep.OutputTypeIsMap {
-						// think only map[string] is supported
-						schema.Type = "object"
-						var valSchema		SchemaObject
-
-						if isPrimitive(ep.OutputType) {
-							valSchema.Type, valSchema.Format = primitiveFormat(ep.OutputType)
-						} else {
-							valSchema.Ref = "#/definitions/" + ep.OutputType
-						}
-						schema.AdditionalProps = &valSchema
-					} else {
-						if isPrimitive(ep.OutputType)  {
-							schema.Type, schema.Format = primitiveFormat(ep.OutputType)
-						} else {
-							schema.Ref = "#/definitions/" + ep.OutputType
-						}
-					}
-					resp.Schema = &schema
+					resp.Schema = schemaForTypeExpr(ep.OutputTypeExpr)
 				}
 			}
 
@@ -630,6 +561,58 @@ func populateResponseObject(tags reflect.StructTag, ep gorest.EndPointStruct) ma
 	return responses
 }
 
+// builds the schema for an output or postdata type, nesting arrays (slices) and
+// objects (string keyed maps) down to a primitive or a definition reference
+func schemaForTypeExpr(te *gorest.TypeExpr) *SchemaObject {
+	var schema	SchemaObject
+
+	if te == nil {
+		return nil
+	}
+
+	switch te.Kind {
+	case gorest.PointerType:
+		return schemaForTypeExpr(te.Elem)
+	case gorest.SliceType:
+		schema.Type = "array"
+		schema.Items = schemaForTypeExpr(te.Elem)
+	case gorest.MapType:
+		schema.Type = "object"
+		schema.AdditionalProps = schemaForTypeExpr(te.Elem)
+	case gorest.InterfaceType:
+		schema.Type = "object"
+	default:
+		if isPrimitive(te.Name) {
+			schema.Type, schema.Format = primitiveFormat(te.Name)
+		} else if isPrimitive(te.BaseName()) {
+			schema.Type, schema.Format = primitiveFormat(te.BaseName())
+		} else {
+			schema.Ref = "#/definitions/" + te.BaseName()
+		}
+	}
+
+	return &schema
+}
+
+// adds the definition for the struct at the bottom of any pointers, slices and maps
+func addDefinition(t reflect.Type) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct || isPrimitive(t.String()) {
+		return
+	}
+	if _, ok := spec20.Definitions[t.Name()]; ok {
+		return  // definition already exists
+	}
+
+	// set placeholder to prevent deal with recursive structures
+	var placeHolder         SchemaObject
+	_spec20().Definitions[t.Name()] = placeHolder
+	_spec20().Definitions[t.Name()] = populateDefinitions(t)
+}
+
 func populateDefinitions(t reflect.Type) SchemaObject {
 	var model	SchemaObject
 
@@ -31,6 +31,11 @@ import (
 )
 
 func TestingAuthorizer(token string, realm string, method string, rb *ResponseBuilder) (bool) {
+	roles := []string{"var-user", "string-user", "post-user"}
+	if token == "fox" {
+		roles = append(roles, "postInt-user")
+	}
+	rb.SetPrincipal(&Principal{Subject: token, Claims: map[string]interface{}{"roles": roles}})
 	return true
 }
 
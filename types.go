@@ -0,0 +1,199 @@
+//Copyright 2014  (rmullinnix461332@gmail.com). All rights reserved.
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions
+//are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in the documentation and/or other materials provided with the
+//     distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+//IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+//OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+//IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+//SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+//PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+//OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+//WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+//OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+//ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+
+
+package gorest
+
+import (
+	"errors"
+	"path"
+	"reflect"
+	"strings"
+)
+
+type TypeKind int
+
+const (
+	NamedType TypeKind = iota
+	PointerType
+	SliceType
+	MapType
+	InterfaceType
+)
+
+//A parsed output or postdata tag, e.g. *User, [][]int, map[string][]models.User or interface{}.
+//Named types may be qualified with a package name or import path.
+type TypeExpr struct {
+	Kind	TypeKind
+	Name	string		// named types only
+	Key	*TypeExpr	// map key
+	Elem	*TypeExpr	// pointer, slice and map element
+}
+
+//Parses a Go type expression as written in an endpoint tag.
+func ParseTypeExpr(expr string) (*TypeExpr, error) {
+	te, rest, err := parseTypeExpr(strings.TrimSpace(expr))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, errors.New("unexpected " + rest + " in type " + expr)
+	}
+	return te, nil
+}
+
+func parseTypeExpr(expr string) (*TypeExpr, string, error) {
+	switch {
+	case expr == "":
+		return nil, "", errors.New("missing type")
+	case strings.HasPrefix(expr, "*"):
+		elem, rest, err := parseTypeExpr(expr[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		return &TypeExpr{Kind: PointerType, Elem: elem}, rest, nil
+	case strings.HasPrefix(expr, "[]"):
+		elem, rest, err := parseTypeExpr(expr[2:])
+		if err != nil {
+			return nil, "", err
+		}
+		return &TypeExpr{Kind: SliceType, Elem: elem}, rest, nil
+	case strings.HasPrefix(expr, "map["):
+		key, rest, err := parseTypeExpr(expr[4:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, "]") {
+			return nil, "", errors.New("missing ] after map key in " + expr)
+		}
+		elem, rest, err := parseTypeExpr(rest[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		return &TypeExpr{Kind: MapType, Key: key, Elem: elem}, rest, nil
+	case strings.HasPrefix(expr, "interface{}"):
+		return &TypeExpr{Kind: InterfaceType}, expr[len("interface{}"):], nil
+	}
+
+	end := strings.IndexAny(expr, "[]*{} ")
+	if end == -1 {
+		end = len(expr)
+	}
+	if end == 0 {
+		return nil, "", errors.New("unexpected " + expr)
+	}
+
+	name := expr[:end]
+	if name == "any" {
+		return &TypeExpr{Kind: InterfaceType}, expr[end:], nil
+	}
+	return &TypeExpr{Kind: NamedType, Name: name}, expr[end:], nil
+}
+
+//Describes a reflected type, named types are qualified with their package name.
+func typeExprOf(t reflect.Type) *TypeExpr {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return &TypeExpr{Kind: PointerType, Elem: typeExprOf(t.Elem())}
+	case reflect.Slice, reflect.Array:
+		// named slices and maps are described by structure so documentors can reach the element
+		return &TypeExpr{Kind: SliceType, Elem: typeExprOf(t.Elem())}
+	case reflect.Map:
+		return &TypeExpr{Kind: MapType, Key: typeExprOf(t.Key()), Elem: typeExprOf(t.Elem())}
+	case reflect.Interface:
+		if t.Name() == "" && t.NumMethod() == 0 {
+			return &TypeExpr{Kind: InterfaceType}
+		}
+	}
+
+	if t.PkgPath() == "" {
+		return &TypeExpr{Kind: NamedType, Name: t.Name()}
+	}
+	return &TypeExpr{Kind: NamedType, Name: path.Base(t.PkgPath()) + "." + t.Name()}
+}
+
+//Writes the expression back out in Go syntax.
+func (te *TypeExpr) String() string {
+	if te == nil {
+		return ""
+	}
+
+	switch te.Kind {
+	case PointerType:
+		return "*" + te.Elem.String()
+	case SliceType:
+		return "[]" + te.Elem.String()
+	case MapType:
+		return "map[" + te.Key.String() + "]" + te.Elem.String()
+	case InterfaceType:
+		return "interface{}"
+	}
+	return te.Name
+}
+
+//The name of a named type without its package qualifier.
+func (te *TypeExpr) BaseName() string {
+	return te.Name[strings.LastIndex(te.Name, ".") + 1:]
+}
+
+//The named or interface type at the bottom of any pointers, slices and maps.
+func (te *TypeExpr) Base() *TypeExpr {
+	for te.Kind == PointerType || te.Kind == SliceType || te.Kind == MapType {
+		te = te.Elem
+	}
+	return te
+}
+
+//Reports whether t is the type described by the expression. An unqualified name matches a type of that name
+//in any package, a qualified one also requires the package name or full import path to match.
+func (te *TypeExpr) Matches(t reflect.Type) bool {
+	switch te.Kind {
+	case PointerType:
+		return t.Kind() == reflect.Ptr && te.Elem.Matches(t.Elem())
+	case SliceType:
+		return (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && te.Elem.Matches(t.Elem())
+	case MapType:
+		return t.Kind() == reflect.Map && te.Key.Matches(t.Key()) && te.Elem.Matches(t.Elem())
+	case InterfaceType:
+		return t.Kind() == reflect.Interface && t.NumMethod() == 0
+	}
+
+	return typeNamesEqual(t, te.Name)
+}
+
+func typeNamesEqual(methVal reflect.Type, name2 string) bool {
+	dot := strings.LastIndex(name2, ".")
+	if dot == -1 {
+		return methVal.Name() == name2
+	}
+
+	if name2[dot + 1:] != methVal.Name() {
+		return false
+	}
+
+	qualifier := name2[:dot]
+	return methVal.PkgPath() == qualifier || path.Base(methVal.PkgPath()) == qualifier
+}
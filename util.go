@@ -44,13 +44,7 @@ func Marshal(i interface{}, mime string) (io.ReadCloser, error) {
 //Marshals the data in interface i into a byte slice, using the Marhaller/Unmarshaller specified in mime.
 //The Marhaller/Unmarshaller must have been registered before using gorest.RegisterMarshaller
 func interfaceToBytes(i interface{}, mime string) (io.ReadCloser, error) {
-	marshalType := mime
-
-	if strings.Contains(mime, "json") {
-		marshalType = "json"
-	} else if strings.Contains(mime, "xml") {
-		marshalType = "xml"
-	}
+	marshalType := marshallerKey(mime)
 
 	m := GetMarshallerByMime(marshalType)
 	if m != nil {
@@ -86,6 +80,28 @@ func interfaceToBytes(i interface{}, mime string) (io.ReadCloser, error) {
 	}
 }
 
+//Maps a mime type onto the key its Marshaller is registered under. Structured suffixes such as
+//application/vnd.siren+json share the marshaller of their base encoding.
+func marshallerKey(mime string) string {
+	if strings.Contains(mime, "ndjson") {
+		return "ndjson"
+	} else if strings.Contains(mime, "csv") {
+		return "csv"
+	} else if strings.Contains(mime, "json") {
+		return "json"
+	} else if strings.Contains(mime, "xml") {
+		return "xml"
+	} else if strings.Contains(mime, "protobuf") {
+		return "protobuf"
+	} else if strings.Contains(mime, "msgpack") {
+		return "msgpack"
+	} else if strings.Contains(mime, "yaml") {
+		return "yaml"
+	}
+
+	return mime
+}
+
 //Unmarshals the data in buf into interface i, using the Marhaller/Unmarshaller specified in mime.
 //The Marhaller/Unmarshaller must have been registered before using gorest.RegisterMarshaller
 func Unmarshal(buf *bytes.Buffer, i interface{}, mime string) error {
@@ -93,13 +109,9 @@ func Unmarshal(buf *bytes.Buffer, i interface{}, mime string) error {
 }
 
 func bytesToInterface(buf *bytes.Buffer, i interface{}, mime string) error {
-	marshalType := mime
+	marshalType := marshallerKey(mime)
 
-	if strings.Contains(mime, "json") {
-		marshalType = "json"
-	} else if strings.Contains(mime, "xml") {
-		marshalType = "xml"
-	} else if strings.Contains(mime, "form-data") {
+	if strings.Contains(mime, "form-data") {
 		return nil
 	}
 
@@ -109,6 +121,12 @@ func bytesToInterface(buf *bytes.Buffer, i interface{}, mime string) error {
 	}
 
 	switch v.Kind() {
+	case reflect.Ptr:
+		// e.g. postdata:"*User", allocate and decode into the target
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return bytesToInterface(buf, v.Interface(), mime)
 	case reflect.Bool:
 
 		n, err := strconv.ParseBool(buf.String())